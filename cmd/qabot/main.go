@@ -2,21 +2,32 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/vaaandark/qabot/pkg/chatcontext"
 	"github.com/vaaandark/qabot/pkg/chatter"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
 	"github.com/vaaandark/qabot/pkg/dialog"
 	"github.com/vaaandark/qabot/pkg/idmap"
+	"github.com/vaaandark/qabot/pkg/imagecache"
 	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
 	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/quota"
 	"github.com/vaaandark/qabot/pkg/receiver"
+	"github.com/vaaandark/qabot/pkg/routing"
 	"github.com/vaaandark/qabot/pkg/sender"
+	"github.com/vaaandark/qabot/pkg/speech"
+	"github.com/vaaandark/qabot/pkg/usage"
 	"github.com/vaaandark/qabot/pkg/util"
+	"github.com/vaaandark/qabot/pkg/workqueue"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/syndtr/goleveldb/leveldb"
@@ -31,7 +42,13 @@ func addHttpUrlPrefix(url string) string {
 
 func main() {
 	eventEndpoint := flag.String("event-endpoint", "127.0.0.1:8080", "onebot 上报事件地址")
+	intakeBuffer := flag.Int("intake-buffer", 256, "收到但还没交给 chatter 的事件数上限")
+	intakeOverflow := flag.String("intake-overflow", string(receiver.DropNewest), "事件缓冲区满时的策略：drop-newest 丢弃新事件，drop-oldest 丢弃最早的事件")
+	metricsEndpoint := flag.String("metrics-endpoint", "", "不为空时在这个地址的 /debug/vars 提供事件缓冲区和消息队列的统计数据")
 	endpoint := flag.String("endpoint", "http://127.0.0.1:3000", "请求地址")
+	accessToken := flag.String("access-token", "", "调用 onebot API 时使用的 access token，反向 WebSocket 连接也要带上它")
+	secret := flag.String("secret", "", "校验 onebot HTTP 上报签名（X-Signature）的密钥")
+	reverseWsEndpoint := flag.String("reverse-ws-endpoint", "", "onebot 反向 WebSocket 监听地址，设置后事件和 API 调用都走 WebSocket，不再使用 -event-endpoint 和 -endpoint")
 	whitelist := flag.String("whitelist", "whitelist.json", "白名单文件路径（白名单文件可热更新）")
 	providerConfig := flag.String("provider-config", "provider-config.json", "大语言模型提供商配置文件")
 	privatePromptPath := flag.String("private-prompt", "", "私聊中给大语言模型的提示词路径")
@@ -42,7 +59,19 @@ func main() {
 	dialogAuthConfig := flag.String("dialog-auth-config", "dialog-auth-config.yaml", "查看对话历史记录认证的配置文件")
 	dialogFuzzId := flag.Bool("dialog-fuzz-id", true, "查看对话历史记录时隐藏对话的群 ID 或用户 ID")
 	idMapPath := flag.String("id-map", "id-map.json", "群 id 和群名或用户 id 与用户名对应关系的配置文件")
-	maxConcurrent := flag.Int64("max-concurrent", 5, "向大语言模型提问的最大并发数")
+	maxConcurrent := flag.Int("max-concurrent", 5, "向大语言模型提问的最大并发数")
+	queueDepth := flag.Int("queue-depth", 100, "排队等待回答的消息数上限，超过时提示用户稍后再试")
+	routingConfig := flag.String("routing-config", "", "按群或用户选择提供商、模型和提示词的规则文件")
+	summaryConfig := flag.String("summary-config", "", "回复链过长时自动生成摘要的配置文件")
+	noticeConfig := flag.String("notice-config", "", "戳一戳、入群欢迎和自动通过好友/入群邀请的配置文件")
+	maxToolRounds := flag.Int("max-tool-rounds", 5, "一次回答中大语言模型最多调用几轮工具")
+	imageCacheDir := flag.String("image-cache-dir", "image-cache", "缓存用户发送的图片的目录")
+	imageCacheMaxMB := flag.Int64("image-cache-max-mb", 1024, "图片缓存的总大小上限（MB）")
+	imageCacheTTL := flag.Duration("image-cache-ttl", 30*24*time.Hour, "图片超过这么久没有使用就从缓存中删除")
+	imageMaxDimension := flag.Int("image-max-dimension", 2048, "图片最长边超过时缩小后再发给模型")
+	ttsConfig := flag.String("tts-config", "", "文字转语音的配置文件，设置后可以用 /tts 开启语音回答")
+	sttConfig := flag.String("stt-config", "", "语音转文字的配置文件，不设置时不回答语音消息")
+	toolsConfig := flag.String("tools-config", "", "内置工具（时间、计算器、单位和汇率换算）的配置文件")
 
 	flag.Parse()
 	log.Printf("Command line args: %s", strings.Join(os.Args, ", "))
@@ -53,7 +82,10 @@ func main() {
 
 	*endpoint = addHttpUrlPrefix(*endpoint)
 
-	receivedMessageCh := make(chan messageenvelope.MessageEnvelope)
+	if *intakeBuffer <= 0 {
+		log.Panicf("intake-buffer must be positive")
+	}
+	receivedMessageCh := make(chan messageenvelope.MessageEnvelope, *intakeBuffer)
 	toSendMessageCh := make(chan messageenvelope.MessageEnvelope)
 
 	db, err := leveldb.OpenFile(*dbPath, nil)
@@ -72,7 +104,108 @@ func main() {
 		log.Panicf("Failed to parse provider config file: %v", err)
 	}
 
-	c, err := chatter.NewChatter(ctx, receivedMessageCh, toSendMessageCh, *whitelist, chatContext, providers, *maxConcurrent)
+	var router *routing.Router
+	if len(*routingConfig) != 0 {
+		router, err = routing.LoadRouterFromFile(*routingConfig)
+		if err != nil {
+			log.Panicf("Failed to parse routing config file: %v", err)
+		}
+		if err := router.Validate(providers); err != nil {
+			log.Panicf("Invalid routing config: %v", err)
+		}
+	}
+
+	var summary *chatter.SummaryConfig
+	if len(*summaryConfig) != 0 {
+		summary, err = chatter.LoadSummaryConfigFromFile(*summaryConfig)
+		if err != nil {
+			log.Panicf("Failed to parse summary config file: %v", err)
+		}
+	}
+
+	var notice *chatter.NoticeConfig
+	if len(*noticeConfig) != 0 {
+		notice, err = chatter.LoadNoticeConfigFromFile(*noticeConfig, providers)
+		if err != nil {
+			log.Panicf("Failed to parse notice config file: %v", err)
+		}
+	}
+
+	builtinConfig := &tool.BuiltinConfig{}
+	if len(*toolsConfig) != 0 {
+		builtinConfig, err = tool.LoadBuiltinConfigFromFile(*toolsConfig)
+		if err != nil {
+			log.Panicf("Failed to parse tools config file: %v", err)
+		}
+	}
+	tools := tool.NewRegistry()
+	if err := tool.RegisterBuiltins(tools, *builtinConfig); err != nil {
+		log.Panicf("Failed to register builtin tools: %v", err)
+	}
+
+	images, err := imagecache.NewCache(imagecache.Config{
+		Dir:           *imageCacheDir,
+		MaxTotalBytes: *imageCacheMaxMB << 20,
+		// 大多数服务商限制 base64 图片不超过 10MB，编码后会变大三分之一
+		MaxImageBytes: 5 << 20,
+		MaxDimension:  *imageMaxDimension,
+		TTL:           *imageCacheTTL,
+	})
+	if err != nil {
+		log.Panicf("Failed to init image cache: %v", err)
+	}
+	go images.Run(ctx, time.Hour)
+
+	var transcriber speech.Transcriber
+	if len(*sttConfig) != 0 {
+		config, err := speech.LoadSTTConfigFromFile(*sttConfig)
+		if err != nil {
+			log.Panicf("Failed to parse stt config file: %v", err)
+		}
+		transcriber, err = speech.NewTranscriber(*config)
+		if err != nil {
+			log.Panicf("Failed to init stt: %v", err)
+		}
+	}
+
+	var synthesizer speech.Synthesizer
+	if len(*ttsConfig) != 0 {
+		config, err := speech.LoadTTSConfigFromFile(*ttsConfig)
+		if err != nil {
+			log.Panicf("Failed to parse tts config file: %v", err)
+		}
+		synthesizer, err = speech.NewSynthesizer(*config)
+		if err != nil {
+			log.Panicf("Failed to init tts: %v", err)
+		}
+	}
+
+	intake, err := receiver.NewIntake(receivedMessageCh, receiver.OverflowPolicy(*intakeOverflow))
+	if err != nil {
+		log.Panicf("Failed to init intake: %v", err)
+	}
+	r := receiver.NewReceiver(intake, *secret)
+	var reverseWs *receiver.ReverseWSServer
+	var oneBot *onebot.Client
+	if len(*reverseWsEndpoint) != 0 {
+		reverseWs = receiver.NewReverseWSServer(r, *accessToken)
+		oneBot = onebot.NewClient(reverseWs)
+	} else {
+		oneBot = onebot.NewClient(onebot.NewHttpTransport(*endpoint, *accessToken))
+	}
+	preferences := preference.NewStore(db)
+	quotas := quota.NewStore(db)
+	usages := usage.NewStore(db)
+
+	if *maxConcurrent <= 0 {
+		log.Panicf("max-concurrent must be positive")
+	}
+	queue, err := workqueue.NewQueue(db, *queueDepth)
+	if err != nil {
+		log.Panicf("Failed to restore work queue: %v", err)
+	}
+
+	c, err := chatter.NewChatter(ctx, receivedMessageCh, toSendMessageCh, *whitelist, chatContext, providers, router, preferences, summary, notice, tools, *maxToolRounds, images, oneBot, transcriber, queue, quotas, usages, *maxConcurrent)
 	if err != nil {
 		log.Panicf("Failed to init chatter: %v", err)
 	}
@@ -80,7 +213,7 @@ func main() {
 	if len(*dialogUrlBase) == 0 {
 		*dialogUrlBase = *dialogEndpoint
 	}
-	s := sender.NewSender(toSendMessageCh, *chatContext, *endpoint, *dialogUrlBase)
+	s := sender.NewSender(toSendMessageCh, *chatContext, oneBot, *dialogUrlBase, preferences, synthesizer)
 
 	stopCh := util.SetupSignalHandler()
 
@@ -89,10 +222,26 @@ func main() {
 
 	g, _ := errgroup.WithContext(context.Background())
 
-	g.Go(func() error {
-		log.Printf("Event listening service starting on %s", *eventEndpoint)
-		return http.ListenAndServe(*eventEndpoint, receiver.NewReceiver(receivedMessageCh))
-	})
+	if reverseWs != nil {
+		g.Go(func() error {
+			log.Printf("Reverse websocket service starting on %s", *reverseWsEndpoint)
+			return http.ListenAndServe(*reverseWsEndpoint, reverseWs)
+		})
+	} else {
+		g.Go(func() error {
+			log.Printf("Event listening service starting on %s", *eventEndpoint)
+			return http.ListenAndServe(*eventEndpoint, r)
+		})
+	}
+
+	if len(*metricsEndpoint) != 0 {
+		expvar.Publish("intake", expvar.Func(func() any { return intake.Stats() }))
+		expvar.Publish("queue", expvar.Func(func() any { return queue.Stats() }))
+		g.Go(func() error {
+			log.Printf("Metrics service starting on %s", *metricsEndpoint)
+			return http.ListenAndServe(*metricsEndpoint, expvar.Handler())
+		})
+	}
 
 	idMap, err := idmap.LoadIdMapFromFile(*idMapPath)
 	if err != nil {
@@ -108,7 +257,7 @@ func main() {
 			return http.ListenAndServe(*dialogEndpoint,
 				dialog.RateLimiter(
 					dialog.BasicAuth(auth,
-						dialog.NewDialogHtmlBuilder(*chatContext, auth, *dialogFuzzId, *idMap))))
+						dialog.NewDialogHtmlBuilder(*chatContext, auth, *dialogFuzzId, *idMap, usages))))
 		})
 	}
 
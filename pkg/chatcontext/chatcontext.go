@@ -3,6 +3,7 @@ package chatcontext
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -13,12 +14,69 @@ import (
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/vaaandark/qabot/pkg/idmap"
 )
 
+// 数据库里还存着其他数据，遍历上下文时只看这些前缀
+var contextKeyPrefixes = []string{"group/", "user/"}
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// DeepSeek 等服务商单独返回的思考过程，不会写入上下文
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	// role 为 tool 时对应的调用
+	ToolCallId string `json:"tool_call_id,omitempty"`
+	// 用户消息中的图片，只保存引用，请求支持图片的提供商时才会带上
+	Images []Image `json:"images,omitempty"`
+	// 内容是语音转写的文字
+	Voice bool `json:"voice,omitempty"`
+}
+
+type Image struct {
+	Url string `json:"url,omitempty"`
+	// onebot 实现给出的文件名
+	File string `json:"file,omitempty"`
+	// 图片缓存中的内容哈希，原始 URL 过期后用它找回图片
+	Hash string `json:"hash,omitempty"`
+}
+
+type ToolCall struct {
+	// 只在流式输出的增量中出现
+	Index    *int             `json:"index,omitempty"`
+	Id       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// 服务商返回的 token 用量，一次回答中多轮工具调用的用量会加在一起
+type Usage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	// 已经包含在 CompletionTokens 中
+	ReasoningTokens int64 `json:"reasoning_tokens,omitempty"`
+	// 按回答时的价格估算的费用
+	Cost float64 `json:"cost,omitempty"`
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		ReasoningTokens:  u.ReasoningTokens + other.ReasoningTokens,
+		Cost:             u.Cost + other.Cost,
+	}
+}
+
+func (u Usage) TotalTokens() int64 {
+	return u.PromptTokens + u.CompletionTokens
 }
 
 type ContextNodeKey struct {
@@ -31,6 +89,23 @@ type ContextNodeValue struct {
 	ReplyTo   *int32    `json:"reply_to,omitempty"`
 	Message   Message   `json:"message"`
 	Timestamp time.Time `json:"timestamp,omitempty"`
+	// 用户用 /model 为这条消息开始的对话指定的提供商
+	PinnedModel string `json:"pinned_model,omitempty"`
+	// 从根消息到这条消息（包括）的摘要，加载上下文时代替这些消息
+	Summary string `json:"summary,omitempty"`
+	// 得到这条回复之前模型调用工具的过程，加载上下文时放在这条消息前面
+	ToolMessages []Message `json:"tool_messages,omitempty"`
+	// 被撤回的消息不再显示，也不会出现在之后的上下文中
+	Recalled bool `json:"recalled,omitempty"`
+	// 助手消息的 token 用量，服务商没有返回时为空
+	Usage *Usage `json:"usage,omitempty"`
+	// 流式回复分成多条消息发送，除了最后一条以外都指向最后一条，回复哪一条都能接上对话
+	AliasOf *int32 `json:"alias_of,omitempty"`
+}
+
+type ContextNode struct {
+	MessageId int32
+	ContextNodeValue
 }
 
 func NewContextNodeValue(replyTo *int32, message Message, timestamp time.Time) ContextNodeValue {
@@ -82,14 +157,26 @@ type ChatContext struct {
 	GroupPrompt   []Message
 }
 
+type DialogToolCall struct {
+	Name      string
+	Arguments string
+	Result    string
+}
+
 type DialogNode struct {
-	Id        string `json:"id"`
-	Role      string `json:"role"`
-	Content   string `json:"content"`
+	Id        string           `json:"id"`
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Summary   string           `json:"summary,omitempty"`
+	ToolCalls []DialogToolCall `json:"tool_calls,omitempty"`
+	Images    []Image          `json:"images,omitempty"`
+	Voice     bool             `json:"voice,omitempty"`
+	Usage     *Usage           `json:"usage,omitempty"`
 	MessageId int32
 	ReplyTo   *int32
 	Timestamp time.Time
 	Children  []*DialogNode `json:"children"`
+	recalled  bool
 }
 
 func NewDialogNode(id, role, text string, messageId int32, replyTo *int32, timestamp time.Time, children []*DialogNode) *DialogNode {
@@ -117,6 +204,18 @@ func maskLastFour(input string) string {
 	}
 }
 
+// 网页上显示的群或用户 ID，可以隐藏后四位并带上群名或用户名
+func DisplayId(id string, fuzzId bool, idMap idmap.IdMap) string {
+	name := idMap.LookupName(id)
+	if fuzzId {
+		id = maskLastFour(id)
+	}
+	if name != nil {
+		id = fmt.Sprintf("%s@%s", id, *name)
+	}
+	return id
+}
+
 type Dialogs struct {
 	Welcome               string
 	IndexedDialogTreesmap map[string][]*DialogNode
@@ -149,13 +248,7 @@ func (cc ChatContext) BuildIndexedDialogTrees(fuzzId bool, all bool, allowed []s
 				continue
 			}
 		}
-		name := idMap.LookupName(id)
-		if fuzzId {
-			id = maskLastFour(id)
-		}
-		if name != nil {
-			id = fmt.Sprintf("%s@%s", id, *name)
-		}
+		id = DisplayId(id, fuzzId, idMap)
 		trees, exist := indexedDialogTrees[id]
 		if exist {
 			trees = append(trees, root)
@@ -179,33 +272,92 @@ func (cc ChatContext) BuildIndexedDialogTrees(fuzzId bool, all bool, allowed []s
 
 func visitNode(key string, roots *[]*DialogNode, nodeMap map[string]*DialogNode) {
 	node := nodeMap[key]
-	if node.ReplyTo == nil {
-		*roots = append(*roots, node)
-	} else {
-		parentKey := fmt.Sprintf("%s/%d", node.Id, *node.ReplyTo)
-		if parentNode, exist := nodeMap[parentKey]; exist {
+	if node.recalled {
+		return
+	}
+	// 撤回的消息不显示，回复它的消息接到更上面的消息下
+	replyTo := node.ReplyTo
+	for replyTo != nil {
+		parentKey := fmt.Sprintf("%s/%d", node.Id, *replyTo)
+		parentNode, exist := nodeMap[parentKey]
+		if !exist {
+			return
+		}
+		if !parentNode.recalled {
 			parentNode.Children = append(parentNode.Children, node)
+			return
 		}
+		replyTo = parentNode.ReplyTo
 	}
+	*roots = append(*roots, node)
+}
+
+func buildDialogToolCalls(toolMessages []Message) []DialogToolCall {
+	results := make(map[string]string)
+	for _, message := range toolMessages {
+		if message.Role == "tool" {
+			results[message.ToolCallId] = message.Content
+		}
+	}
+
+	calls := []DialogToolCall{}
+	for _, message := range toolMessages {
+		for _, call := range message.ToolCalls {
+			calls = append(calls, DialogToolCall{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+				Result:    results[call.Id],
+			})
+		}
+	}
+	return calls
 }
 
 func (cc ChatContext) buildDialogTrees() ([]*DialogNode, error) {
 	nodeMap := make(map[string]*DialogNode)
-	iter := cc.db.NewIterator(nil, nil)
+	aliases := make(map[string]int32)
+
+	for _, prefix := range contextKeyPrefixes {
+		iter := cc.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			key := string(iter.Key())
+			var val ContextNodeValue
+			if err := json.Unmarshal(iter.Value(), &val); err != nil {
+				log.Printf("Failed to unmarshal: %v", err)
+				continue
+			}
+			messageId, err := strconv.Atoi(path.Base(key))
+			if err != nil {
+				log.Printf("Failed to unmarshal: %v", err)
+				continue
+			}
+			if val.AliasOf != nil {
+				aliases[key] = *val.AliasOf
+				continue
+			}
+			node := NewDialogNode(path.Dir(key), val.Message.Role, val.Message.Content, int32(messageId), val.ReplyTo, val.Timestamp, []*DialogNode{})
+			node.Summary = val.Summary
+			node.ToolCalls = buildDialogToolCalls(val.ToolMessages)
+			node.Images = val.Message.Images
+			node.Voice = val.Message.Voice
+			node.Usage = val.Usage
+			node.recalled = val.Recalled
+			nodeMap[key] = node
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
 
-	for iter.Next() {
-		key := string(iter.Key())
-		var val ContextNodeValue
-		if err := json.Unmarshal(iter.Value(), &val); err != nil {
-			log.Printf("Failed to unmarshal: %v", err)
+	// 回复流式回复中间一段的消息接到整个回答下面
+	for _, node := range nodeMap {
+		if node.ReplyTo == nil {
 			continue
 		}
-		messageId, err := strconv.Atoi(path.Base(key))
-		if err != nil {
-			log.Printf("Failed to unmarshal: %v", err)
-			continue
+		if messageId, ok := aliases[fmt.Sprintf("%s/%d", node.Id, *node.ReplyTo)]; ok {
+			node.ReplyTo = &messageId
 		}
-		nodeMap[key] = NewDialogNode(path.Dir(key), val.Message.Role, val.Message.Content, int32(messageId), val.ReplyTo, val.Timestamp, []*DialogNode{})
 	}
 
 	roots := []*DialogNode{}
@@ -246,7 +398,7 @@ func NewChatContext(db *leveldb.DB, privatePromptPath, groupPromptPath string) (
 }
 
 func (cc ChatContext) IsBotReply(userId, groupId *int64, messageId int32) bool {
-	val, err := cc.lookupContextNode(userId, groupId, messageId)
+	_, val, err := cc.lookupContextNode(userId, groupId, messageId)
 	if err != nil || val == nil {
 		return false
 	}
@@ -254,14 +406,93 @@ func (cc ChatContext) IsBotReply(userId, groupId *int64, messageId int32) bool {
 }
 
 func (cc ChatContext) AddContextNode(userId, groupId *int64, messageId int32, replyTo *int32, message Message, timestamp time.Time) error {
+	return cc.AddContextNodeValue(userId, groupId, messageId, NewContextNodeValue(replyTo, message, timestamp))
+}
+
+func (cc ChatContext) AddContextNodeValue(userId, groupId *int64, messageId int32, value ContextNodeValue) error {
 	key := NewContextNodeKey(userId, groupId, messageId).Key()
-	val, err := NewContextNodeValue(replyTo, message, timestamp).Value()
+	val, err := value.Value()
 	if err != nil {
 		return err
 	}
 	return cc.db.Put(key, val, nil)
 }
 
+// 让 aliases 中的消息都指向 messageId 的节点
+func (cc ChatContext) AddAliases(userId, groupId *int64, messageId int32, aliases []int32) error {
+	value, err := ContextNodeValue{AliasOf: &messageId}.Value()
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, alias := range aliases {
+		if alias != messageId {
+			batch.Put(NewContextNodeKey(userId, groupId, alias).Key(), value)
+		}
+	}
+	return cc.db.Write(batch, nil)
+}
+
+// 给这条消息开始的对话指定提供商，之后顺着回复链的消息都会使用它
+func (cc ChatContext) PinModel(userId, groupId *int64, messageId int32, model string) error {
+	messageId, val, err := cc.lookupContextNode(userId, groupId, messageId)
+	if err != nil {
+		return err
+	}
+	val.PinnedModel = model
+	b, err := val.Value()
+	if err != nil {
+		return err
+	}
+	return cc.db.Put(NewContextNodeKey(userId, groupId, messageId).Key(), b, nil)
+}
+
+func (cc ChatContext) SetSummary(userId, groupId *int64, messageId int32, summary string) error {
+	messageId, val, err := cc.lookupContextNode(userId, groupId, messageId)
+	if err != nil {
+		return err
+	}
+	val.Summary = summary
+	b, err := val.Value()
+	if err != nil {
+		return err
+	}
+	return cc.db.Put(NewContextNodeKey(userId, groupId, messageId).Key(), b, nil)
+}
+
+// 撤回的消息可能还没有加入上下文，这时什么都不做
+func (cc ChatContext) SetRecalled(userId, groupId *int64, messageId int32) error {
+	messageId, val, err := cc.lookupContextNode(userId, groupId, messageId)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	val.Recalled = true
+	b, err := val.Value()
+	if err != nil {
+		return err
+	}
+	return cc.db.Put(NewContextNodeKey(userId, groupId, messageId).Key(), b, nil)
+}
+
+// 顺着回复链向上找最近一次指定的提供商
+func (cc ChatContext) LookupPinnedModel(userId, groupId *int64, messageId int32) string {
+	for {
+		_, val, err := cc.lookupContextNode(userId, groupId, messageId)
+		if err != nil {
+			return ""
+		}
+		if len(val.PinnedModel) != 0 {
+			return val.PinnedModel
+		}
+		if val.IsRoot() {
+			return ""
+		}
+		messageId = *val.ReplyTo
+	}
+}
+
 func (cc ChatContext) lookupLatestMessageId(userId, groupId *int64) *int32 {
 	iter := cc.db.NewIterator(nil, nil)
 	defer iter.Release()
@@ -278,6 +509,9 @@ func (cc ChatContext) lookupLatestMessageId(userId, groupId *int64) *int32 {
 			log.Printf("Failed to unmarshal: %v", err)
 			continue
 		}
+		if val.Recalled || val.AliasOf != nil {
+			continue
+		}
 		if val.Timestamp.After(latestTimestamp) {
 			latestTimestamp = val.Timestamp
 			n, err := strconv.ParseInt(path.Base(string(iter.Key())), 10, 32)
@@ -293,18 +527,22 @@ func (cc ChatContext) lookupLatestMessageId(userId, groupId *int64) *int32 {
 	return messageId
 }
 
-func (cc ChatContext) lookupContextNode(userId, groupId *int64, messageId int32) (*ContextNodeValue, error) {
+// 返回的 messageId 是别名指向的节点
+func (cc ChatContext) lookupContextNode(userId, groupId *int64, messageId int32) (int32, *ContextNodeValue, error) {
 	key := NewContextNodeKey(userId, groupId, messageId).Key()
 	b, err := cc.db.Get(key, nil)
 	if err != nil {
-		return nil, err
+		return messageId, nil, err
 	}
 
 	val := &ContextNodeValue{}
 	if err := json.Unmarshal(b, val); err != nil {
-		return nil, err
+		return messageId, nil, err
+	}
+	if val.AliasOf != nil && *val.AliasOf != messageId {
+		return cc.lookupContextNode(userId, groupId, *val.AliasOf)
 	}
-	return val, nil
+	return messageId, val, nil
 }
 
 func (cc ChatContext) LoadContextLatestMessages(userId, groupId *int64) ([]Message, error) {
@@ -322,23 +560,58 @@ func BuildNicknamePrompt(nickname string) Message {
 	}
 }
 
-func (cc ChatContext) LoadContextMessages(userId, groupId *int64, messageId int32) ([]Message, error) {
-	reversedMessages := []Message{}
+func BuildSummaryPrompt(summary string) Message {
+	return Message{
+		Role:    "system",
+		Content: fmt.Sprintf("以下是之前对话的摘要：\n%s", summary),
+	}
+}
+
+// 从 messageId 顺着回复链向上加载到根消息或者最近的摘要为止，返回的节点从旧到新排列，
+// 遇到摘要时 summary 为摘要节点，它本身不在返回的节点中，被撤回的节点会被跳过
+func (cc ChatContext) LoadContextNodes(userId, groupId *int64, messageId int32) (nodes []ContextNode, summary *ContextNode, err error) {
+	reversedNodes := []ContextNode{}
 	for {
-		val, err := cc.lookupContextNode(userId, groupId, messageId)
+		var val *ContextNodeValue
+		messageId, val, err = cc.lookupContextNode(userId, groupId, messageId)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		node := ContextNode{MessageId: messageId, ContextNodeValue: *val}
+		// 最新的消息一定要保留，摘要只用来代替更早的消息
+		if len(val.Summary) != 0 && len(reversedNodes) != 0 {
+			summary = &node
+			break
+		}
+		if !val.Recalled {
+			reversedNodes = append(reversedNodes, node)
 		}
-		reversedMessages = append(reversedMessages, val.Message)
 		if val.IsRoot() {
 			break
 		}
 		messageId = *val.ReplyTo
 	}
 
-	messages := make([]Message, 0, len(reversedMessages))
-	for i := len(reversedMessages) - 1; i >= 0; i-- {
-		messages = append(messages, reversedMessages[i])
+	nodes = make([]ContextNode, 0, len(reversedNodes))
+	for i := len(reversedNodes) - 1; i >= 0; i-- {
+		nodes = append(nodes, reversedNodes[i])
+	}
+	return nodes, summary, nil
+}
+
+func (cc ChatContext) LoadContextMessages(userId, groupId *int64, messageId int32) ([]Message, error) {
+	nodes, summary, err := cc.LoadContextNodes(userId, groupId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(nodes)+1)
+	if summary != nil {
+		messages = append(messages, BuildSummaryPrompt(summary.Summary))
+	}
+	for _, node := range nodes {
+		messages = append(messages, node.ToolMessages...)
+		messages = append(messages, node.Message)
 	}
 	return messages, nil
 }
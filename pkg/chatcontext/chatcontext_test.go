@@ -0,0 +1,95 @@
+package chatcontext
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/idmap"
+)
+
+func newTestChatContext(t *testing.T) *ChatContext {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	prompt := filepath.Join(dir, "prompt.json")
+	if err := os.WriteFile(prompt, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := NewChatContext(db, prompt, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+func int32Ptr(n int32) *int32 {
+	return &n
+}
+
+// 流式回复分成 11、12、13 三条消息发送，上下文记在 13 上
+func TestStreamAliases(t *testing.T) {
+	groupId := int64(100)
+	userId := int64(1)
+	now := time.Now()
+
+	for _, replyTo := range []int32{11, 12, 13} {
+		t.Run("", func(t *testing.T) {
+			cc := newTestChatContext(t)
+			if err := cc.AddContextNode(&userId, &groupId, 10, nil, Message{Role: "user", Content: "q"}, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := cc.AddContextNode(&userId, &groupId, 13, int32Ptr(10), Message{Role: "assistant", Content: "a"}, now.Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if err := cc.AddAliases(&userId, &groupId, 13, []int32{11, 12}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cc.AddContextNode(&userId, &groupId, 20, &replyTo, Message{Role: "user", Content: "more"}, now.Add(2*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cc.IsBotReply(&userId, &groupId, replyTo) {
+				t.Errorf("IsBotReply(%d) = false", replyTo)
+			}
+
+			messages, err := cc.LoadContextMessages(&userId, &groupId, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 3 || messages[1].Content != "a" {
+				t.Errorf("messages = %+v", messages)
+			}
+
+			// 通过别名修改的是整个回答
+			if err := cc.PinModel(&userId, &groupId, replyTo, "p"); err != nil {
+				t.Fatal(err)
+			}
+			if got := cc.LookupPinnedModel(&userId, &groupId, 20); got != "p" {
+				t.Errorf("pinned model = %q, want p", got)
+			}
+			if !cc.IsBotReply(&userId, &groupId, 11) {
+				t.Errorf("alias was overwritten")
+			}
+
+			dialogs, err := cc.BuildIndexedDialogTrees(false, true, nil, "", idmap.IdMap{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trees := dialogs.IndexedDialogTreesmap["group/100"]
+			if len(trees) != 1 {
+				t.Fatalf("trees = %d, want 1", len(trees))
+			}
+			answer := trees[0].Children
+			if len(answer) != 1 || answer[0].MessageId != 13 || len(answer[0].Children) != 1 || answer[0].Children[0].MessageId != 20 {
+				t.Errorf("dialog tree is wrong: %+v", trees[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package chatcontext
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// 每条消息的角色和分隔符大约占用的 token
+	messageOverheadTokens = 4
+	// 英文等按大约 4 个字节一个 token 估算
+	bytesPerLatinToken = 4
+	// 一张图片按高清模式下大约占用的 token 估算
+	imageTokens = 765
+
+	TruncateDropOldest = "drop_oldest"
+	TruncateKeepRoot   = "keep_root"
+)
+
+// 不依赖分词器的粗略估算：中日韩字符每个算一个 token，其余按字节数估算，宁可多估
+func EstimateTokens(text string) int {
+	tokens := 0
+	latinBytes := 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+			unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			tokens++
+		} else {
+			latinBytes += utf8.RuneLen(r)
+		}
+	}
+	return tokens + (latinBytes+bytesPerLatinToken-1)/bytesPerLatinToken
+}
+
+func EstimateMessageTokens(message Message) int {
+	tokens := messageOverheadTokens + EstimateTokens(message.Content) + len(message.Images)*imageTokens
+	for _, call := range message.ToolCalls {
+		tokens += EstimateTokens(call.Function.Name) + EstimateTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+func EstimateMessagesTokens(messages []Message) int {
+	total := 0
+	for _, message := range messages {
+		total += EstimateMessageTokens(message)
+	}
+	return total
+}
+
+type TruncationPolicy struct {
+	// drop_oldest：从最早的消息开始丢弃；keep_root：保留根消息和最近的 KeepLatest 条
+	Strategy   string `json:"strategy,omitempty"`
+	KeepLatest int    `json:"keep_latest,omitempty"`
+}
+
+// 截断历史消息使其和系统提示词一起不超过 maxTokens，系统提示词和最后一条消息总会保留
+func TruncateMessages(system, history []Message, maxTokens int, policy TruncationPolicy) []Message {
+	if maxTokens <= 0 || len(history) == 0 {
+		return history
+	}
+
+	budget := maxTokens - EstimateMessagesTokens(system)
+	if policy.Strategy == TruncateKeepRoot && len(history) > 1 {
+		return truncateKeepRoot(history, budget, policy.KeepLatest)
+	}
+	return truncateDropOldest(history, budget)
+}
+
+// 从最后一条开始往前，返回预算内能保留的第一条消息的下标
+func fitFromEnd(history []Message, budget int) int {
+	start := len(history) - 1
+	used := EstimateMessageTokens(history[start])
+	for start > 0 {
+		cost := EstimateMessageTokens(history[start-1])
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start--
+	}
+	return start
+}
+
+func truncateDropOldest(history []Message, budget int) []Message {
+	start := fitFromEnd(history, budget)
+	// 有些服务商要求第一条非系统消息必须是用户发的
+	for start < len(history)-1 && history[start].Role != "user" {
+		start++
+	}
+	return history[start:]
+}
+
+func truncateKeepRoot(history []Message, budget int, keepLatest int) []Message {
+	root := history[0]
+	rest := history[1:]
+	if keepLatest > 0 && len(rest) > keepLatest {
+		rest = rest[len(rest)-keepLatest:]
+	}
+
+	start := fitFromEnd(rest, budget-EstimateMessageTokens(root))
+	// 根消息后面要接角色不同的消息，保证一问一答交替，也不能从工具调用的结果开始
+	for start < len(rest)-1 && (rest[start].Role == root.Role || rest[start].Role == "tool") {
+		start++
+	}
+	tail := rest[start:]
+	if len(tail) == len(history)-1 {
+		return history
+	}
+	// 连根消息都放不下，或者无法交替，只能放弃根消息
+	if tail[0].Role == root.Role || EstimateMessageTokens(root)+EstimateMessagesTokens(tail) > budget {
+		return tail
+	}
+	return append([]Message{root}, tail...)
+}
@@ -0,0 +1,136 @@
+package chatcontext
+
+import (
+	"strings"
+	"testing"
+)
+
+func toolExchange(question, answer string) []Message {
+	return []Message{
+		{Role: "user", Content: question},
+		{Role: "assistant", ToolCalls: []ToolCall{{Id: "call", Type: "function", Function: ToolCallFunction{Name: "calculator", Arguments: strings.Repeat("1+", 50) + "1"}}}},
+		{Role: "tool", ToolCallId: "call", Content: strings.Repeat("result ", 50)},
+		{Role: "assistant", Content: answer},
+	}
+}
+
+// 工具的结果前面必须是带有对应 tool_calls 的助手消息
+func checkToolResults(t *testing.T, messages []Message) {
+	t.Helper()
+	calls := map[string]bool{}
+	for _, message := range messages {
+		for _, call := range message.ToolCalls {
+			calls[call.Id] = true
+		}
+		if message.Role == "tool" && !calls[message.ToolCallId] {
+			t.Fatalf("tool result %q without its tool call in %+v", message.ToolCallId, messages)
+		}
+	}
+}
+
+func TestTruncateKeepsToolCallsWithResults(t *testing.T) {
+	history := append(toolExchange("q1", "a1"), toolExchange("q2", "a2")...)
+	history = append(history, Message{Role: "user", Content: "q3"})
+	full := EstimateMessagesTokens(history)
+
+	for _, policy := range []TruncationPolicy{
+		{Strategy: TruncateDropOldest},
+		{Strategy: TruncateKeepRoot},
+		{Strategy: TruncateKeepRoot, KeepLatest: 2},
+		{Strategy: TruncateKeepRoot, KeepLatest: 5},
+	} {
+		// 从不截断到只剩最后一条消息，每种预算都检查一遍
+		for budget := full; budget > 0; budget-- {
+			truncated := TruncateMessages(nil, history, budget, policy)
+			if len(truncated) == 0 || truncated[len(truncated)-1].Content != "q3" {
+				t.Fatalf("%+v budget %d: latest message dropped: %+v", policy, budget, truncated)
+			}
+			checkToolResults(t, truncated)
+		}
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"你好", 2},
+		{"你好ab", 3},
+		{"こんにちは", 5},
+		{"안녕", 2},
+		{"é", 1},
+	}
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.text); got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.text, got, tt.want)
+		}
+	}
+
+	message := Message{Role: "user", Content: "abcd", Images: []Image{{}, {}}}
+	if got, want := EstimateMessageTokens(message), messageOverheadTokens+1+2*imageTokens; got != want {
+		t.Errorf("message with images: got %d, want %d", got, want)
+	}
+}
+
+func TestTruncateMessages(t *testing.T) {
+	// 每条消息 messageOverheadTokens + 1 = 5 个 token
+	message := func(role, name string) Message {
+		return Message{Role: role, Content: name + strings.Repeat("_", bytesPerLatinToken-len(name))}
+	}
+	history := []Message{
+		message("user", "u1"),
+		message("assistant", "a1"),
+		message("user", "u2"),
+		message("assistant", "a2"),
+		message("user", "u3"),
+	}
+	system := []Message{message("system", "s")}
+
+	tests := []struct {
+		name      string
+		system    []Message
+		maxTokens int
+		policy    TruncationPolicy
+		want      []string
+	}{
+		{"no limit", nil, 0, TruncationPolicy{}, []string{"u1", "a1", "u2", "a2", "u3"}},
+		{"default fits", nil, 25, TruncationPolicy{}, []string{"u1", "a1", "u2", "a2", "u3"}},
+		{"default is drop oldest", nil, 20, TruncationPolicy{}, []string{"u2", "a2", "u3"}},
+		{"drop oldest starts with user", nil, 20, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u2", "a2", "u3"}},
+		{"drop oldest exact", nil, 15, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u2", "a2", "u3"}},
+		{"drop oldest skips assistant", nil, 14, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u3"}},
+		{"latest always kept", nil, 1, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u3"}},
+		{"system counts", system, 20, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u2", "a2", "u3"}},
+		{"system leaves room for latest only", system, 19, TruncationPolicy{Strategy: TruncateDropOldest}, []string{"u3"}},
+		{"keep root fits", nil, 25, TruncationPolicy{Strategy: TruncateKeepRoot}, []string{"u1", "a1", "u2", "a2", "u3"}},
+		{"keep root alternates", nil, 20, TruncationPolicy{Strategy: TruncateKeepRoot}, []string{"u1", "a2", "u3"}},
+		{"keep root exact", nil, 15, TruncationPolicy{Strategy: TruncateKeepRoot}, []string{"u1", "a2", "u3"}},
+		{"root dropped when it does not fit", nil, 14, TruncationPolicy{Strategy: TruncateKeepRoot}, []string{"u3"}},
+		{"keep latest", nil, 100, TruncationPolicy{Strategy: TruncateKeepRoot, KeepLatest: 2}, []string{"u1", "a2", "u3"}},
+		{"keep latest odd", nil, 100, TruncationPolicy{Strategy: TruncateKeepRoot, KeepLatest: 3}, []string{"u1", "a2", "u3"}},
+		{"keep latest larger than history", nil, 100, TruncationPolicy{Strategy: TruncateKeepRoot, KeepLatest: 10}, []string{"u1", "a1", "u2", "a2", "u3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			truncated := TruncateMessages(tt.system, history, tt.maxTokens, tt.policy)
+			got := []string{}
+			for _, m := range truncated {
+				got = append(got, strings.TrimRight(m.Content, "_"))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	single := []Message{message("user", "u1")}
+	for _, policy := range []TruncationPolicy{{Strategy: TruncateDropOldest}, {Strategy: TruncateKeepRoot}} {
+		if got := TruncateMessages(nil, single, 1, policy); len(got) != 1 {
+			t.Errorf("%+v: single message dropped: %+v", policy, got)
+		}
+	}
+}
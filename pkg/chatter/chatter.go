@@ -4,20 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vaaandark/qabot/pkg/chatcontext"
 	"github.com/vaaandark/qabot/pkg/chatter/cmd"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
 	"github.com/vaaandark/qabot/pkg/chatter/whitelist"
+	"github.com/vaaandark/qabot/pkg/imagecache"
+	"github.com/vaaandark/qabot/pkg/keypool"
 	"github.com/vaaandark/qabot/pkg/messageenvelope"
 	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
 	"github.com/vaaandark/qabot/pkg/providerconfig"
-	"golang.org/x/sync/semaphore"
+	"github.com/vaaandark/qabot/pkg/quota"
+	"github.com/vaaandark/qabot/pkg/routing"
+	"github.com/vaaandark/qabot/pkg/speech"
+	"github.com/vaaandark/qabot/pkg/usage"
+	"github.com/vaaandark/qabot/pkg/util"
+	"github.com/vaaandark/qabot/pkg/workqueue"
 )
 
 type Chatter struct {
@@ -28,16 +39,40 @@ type Chatter struct {
 	CmdAdaptor        cmd.Cmd
 	ChatContext       *chatcontext.ChatContext
 	Providers         []providerconfig.ProviderConfig
-	MaxConcurrent     *semaphore.Weighted
+	Router            *routing.Router
+	Preferences       preference.Store
+	Summary           *SummaryConfig
+	Notice            *NoticeConfig
+	Tools             *tool.Registry
+	MaxToolRounds     int
+	Images            *imagecache.Cache
+	OneBot            *onebot.Client
+	Transcriber       speech.Transcriber
+	Queue             *workqueue.Queue
+	Quota             *quota.Store
+	Usage             *usage.Store
+	// 同时处理消息的 worker 数
+	MaxConcurrent int
+	// 正在生成摘要的节点，避免重复生成
+	summarizing *sync.Map
+	// 正在处理的消息，值是取消函数
+	generating *sync.Map
+	// 排队和限额的提示先放在这里，不让发送慢拖住收消息
+	statusCh chan messageenvelope.MessageEnvelope
 }
 
-func NewChatter(ctx context.Context, receiveMessageCh, toSendMessageCh chan messageenvelope.MessageEnvelope, whitelistFilePath string, chatContext *chatcontext.ChatContext, providers []providerconfig.ProviderConfig, maxConcurrentNum int64) (*Chatter, error) {
+func NewChatter(ctx context.Context, receiveMessageCh, toSendMessageCh chan messageenvelope.MessageEnvelope, whitelistFilePath string, chatContext *chatcontext.ChatContext, providers []providerconfig.ProviderConfig, router *routing.Router, preferences preference.Store, summary *SummaryConfig, notice *NoticeConfig, tools *tool.Registry, maxToolRounds int, images *imagecache.Cache, oneBot *onebot.Client, transcriber speech.Transcriber, queue *workqueue.Queue, quotas *quota.Store, usages *usage.Store, maxConcurrent int) (*Chatter, error) {
 	wa, err := whitelist.NewWhitelist(whitelistFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	ca := cmd.NewCmd(*wa)
+	// 在复制之前创建，之后所有副本共享同一个 key 池和熔断器
+	for i := range providers {
+		providers[i].Init()
+	}
+
+	ca := cmd.NewCmd(*wa, providers, preferences, quotas, usages)
 
 	return &Chatter{
 		ctx:               ctx,
@@ -47,11 +82,32 @@ func NewChatter(ctx context.Context, receiveMessageCh, toSendMessageCh chan mess
 		CmdAdaptor:        ca,
 		ChatContext:       chatContext,
 		Providers:         providers,
-		MaxConcurrent:     semaphore.NewWeighted(maxConcurrentNum),
+		Router:            router,
+		Preferences:       preferences,
+		Summary:           summary,
+		Notice:            notice,
+		Tools:             tools,
+		MaxToolRounds:     maxToolRounds,
+		Images:            images,
+		OneBot:            oneBot,
+		Transcriber:       transcriber,
+		Queue:             queue,
+		Quota:             quotas,
+		Usage:             usages,
+		MaxConcurrent:     maxConcurrent,
+		summarizing:       &sync.Map{},
+		generating:        &sync.Map{},
+		statusCh:          make(chan messageenvelope.MessageEnvelope, statusBuffer),
 	}, nil
 }
 
 func (c Chatter) Run(stopCh <-chan struct{}) {
+	for i := 0; i < c.MaxConcurrent; i++ {
+		go c.work()
+	}
+	go c.forwardStatus(stopCh)
+	defer c.Queue.Close()
+
 	for {
 		select {
 		case m, ok := <-c.ReceivedMessageCh:
@@ -59,6 +115,26 @@ func (c Chatter) Run(stopCh <-chan struct{}) {
 				return
 			}
 
+			switch m.Category {
+			case onebot.CategoryRecall:
+				// 撤回通知和消息按顺序处理，撤回时消息一定已经开始处理了
+				c.recall(m)
+				continue
+			case onebot.CategoryPoke:
+				if c.Notice.generatesPoke() {
+					// 要调用提供商，和提问一样排队，受 worker 数的限制
+					if c.isWhitelisted(m) && c.Notice.IsEnabled(handlerPoke, m.GroupId) {
+						c.enqueue(m)
+					}
+					continue
+				}
+				go c.handleNotice(m)
+				continue
+			case onebot.CategoryJoin, onebot.CategoryFriendRequest, onebot.CategoryGroupInvite:
+				go c.handleNotice(m)
+				continue
+			}
+
 			if m.Category == onebot.CategoryCmd || m.Category == onebot.CategoryChat {
 				if m.IsInGroup() {
 					if !c.WhitelistAdaptor.HasGroup(*m.GroupId) {
@@ -71,131 +147,516 @@ func (c Chatter) Run(stopCh <-chan struct{}) {
 				}
 			}
 
-			go c.doChat(m)
+			c.enqueue(m)
 		case <-stopCh:
 			return
 		}
 	}
 }
 
-func (c Chatter) doPost(messages []chatcontext.Message, provider *providerconfig.ProviderConfig) (*chatcontext.Message, error) {
+func (c Chatter) doPost(ctx context.Context, messages []chatcontext.Message, provider *providerconfig.ProviderConfig, tools []tool.Definition, toolChoice string, onDelta func(reasoning, content string)) (*chatcontext.Message, *chatcontext.Usage, error) {
 	if provider == nil {
-		return nil, fmt.Errorf("empty provider")
+		return nil, nil, fmt.Errorf("empty provider")
 	}
 
 	apiUrl := provider.Url
-	apiModel := provider.Model
-	apiKey := provider.NextKey()
+	keyPool := provider.KeyPool()
+	apiKey, err := keyPool.Next()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if provider.Reasoning && len(messages) > 0 {
+	if provider.Reasoning && len(messages) > 0 && messages[len(messages)-1].Role == "user" {
+		// 重试时会复用 messages，不能直接修改
+		messages = append([]chatcontext.Message{}, messages...)
 		thinkLabel := "<think>"
 		content := messages[len(messages)-1].Content
 		messages[len(messages)-1].Content = content + thinkLabel
 	}
 
-	request := CompletionRequestFromContext(apiModel, messages)
+	request := CompletionRequestFromContext(provider, messages, tools, toolChoice)
 
 	requestBytes, err := json.Marshal(request)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", apiUrl, bytes.NewReader(requestBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewReader(requestBytes))
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 	req.Header.Set("Content-Type", "application/json")
+	if provider.Stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	for k, v := range provider.Headers {
+		req.Header.Set(k, v)
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		keyPool.ReportFailure(apiKey, 0, 0, err)
+		return nil, nil, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodyLen))
+		statusErr := StatusError{
+			StatusCode: res.StatusCode,
+			RetryAfter: keypool.ParseRetryAfter(res.Header.Get("Retry-After")),
+			Body:       strings.TrimSpace(string(body)),
+		}
+		keyPool.ReportFailure(apiKey, statusErr.StatusCode, statusErr.RetryAfter, statusErr)
+		return nil, nil, statusErr
+	}
+	keyPool.ReportSuccess(apiKey)
+
+	// 有些服务商会忽略 stream 参数，直接返回完整的 JSON
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return readStream(res.Body, onDelta)
+	}
+
 	responseBytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	response := CompletionResponse{}
 	if err := json.Unmarshal(responseBytes, &response); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	message := response.GetMessage()
-	return message, nil
+	return message, response.Usage.GetUsage(), nil
 }
 
-func (c Chatter) chatWithLlm(p providerconfig.ProviderConfig, m messageenvelope.MessageEnvelope) error {
-	ctx, cancel := context.WithTimeout(c.ctx, time.Second*10)
-	defer cancel()
+func (c Chatter) chatWithLlm(ctx context.Context, m messageenvelope.MessageEnvelope) error {
+	if c.ChatContext == nil {
+		return nil
+	}
 
-	if err := c.MaxConcurrent.Acquire(ctx, 1); err != nil {
-		return err
+	if m.ReplyTo != nil && !c.ChatContext.IsBotReply(&m.UserId, m.GroupId, *m.ReplyTo) {
+		// 回复的不是 bot 的情况，不关心！
+		// 除非 at 了 bot 并且被回复的是合并转发，这时展开它，从这条消息开始新的对话
+		if !m.IsAt {
+			return nil
+		}
+		forwards := c.repliedForwards(*m.ReplyTo)
+		if len(forwards) == 0 {
+			return nil
+		}
+		m.Forwards = append(forwards, m.Forwards...)
+		m.ReplyTo = nil
 	}
-	defer c.MaxConcurrent.Release(1)
 
-	if c.ChatContext == nil {
+	charge, ok := c.allowQuota(m)
+	if !ok {
 		return nil
 	}
+	answered := false
+	defer func() {
+		if !answered {
+			c.refundQuota(m, charge)
+		}
+	}()
+
+	if m.Record != nil {
+		text, err := c.transcribe(ctx, *m.Record)
+		if err != nil {
+			log.Printf("Failed to transcribe voice message from %s: %v", m.GetNamespacedUserID(), err)
+			return nil
+		}
+		if len(text) == 0 {
+			return nil
+		}
+		log.Printf("Transcribe voice message from %s: %s", m.GetNamespacedUserID(), util.TruncateLogStr(text))
+		m.Text = text
+	}
 
-	if m.ReplyTo != nil {
-		// 回复的不是 bot 且没有 at bot 的情况，不关心！
-		if !c.ChatContext.IsBotReply(&m.UserId, m.GroupId, *m.ReplyTo) && !m.IsAt {
+	if len(m.Forwards) != 0 {
+		quoted, err := c.flattenForwards(m.Forwards)
+		if err != nil {
+			log.Printf("Failed to get forward message from %s: %v", m.GetNamespacedUserID(), err)
 			return nil
 		}
+		m.Text = strings.TrimSpace(quoted + "\n\n" + m.Text)
 	}
 
+	m.Images = c.cacheImages(m.Images)
 	err := c.ChatContext.AddContextNode(&m.UserId, m.GroupId, m.MessageId, m.ReplyTo, chatcontext.Message{
 		Role:    "user",
 		Content: m.Text,
+		Images:  m.Images,
+		Voice:   m.Record != nil,
 	}, m.Timestamp)
 	if err != nil {
 		log.Printf("Failed to add user context: %v", err)
 		return nil
 	}
+	// 加入上下文之前就被撤回了
+	if isRecalled(ctx) {
+		if err := c.ChatContext.SetRecalled(&m.UserId, m.GroupId, m.MessageId); err != nil {
+			log.Printf("Failed to mark message %d as recalled: %v", m.MessageId, err)
+		}
+		return nil
+	}
+	if len(m.PinnedModel) != 0 {
+		if err := c.ChatContext.PinModel(&m.UserId, m.GroupId, m.MessageId, m.PinnedModel); err != nil {
+			log.Printf("Failed to pin model: %v", err)
+		}
+	}
 
+	providers := c.Providers
+	var toolNames []string
 	var systemPrompt []chatcontext.Message
 	if m.GroupId != nil {
 		systemPrompt = c.ChatContext.GroupPrompt
 	} else {
 		systemPrompt = c.ChatContext.PrivatePrompt
 	}
+	// 群聊中先看群的规则，再看用户的规则
+	if rule := c.Router.Lookup(m.GetNamespacedGroupOrUserID(), m.GetNamespacedUserID()); rule != nil {
+		providers = rule.SelectProviders(providers)
+		toolNames = rule.Tools
+		if prompt := rule.BuildSystemPrompt(); prompt != nil {
+			systemPrompt = prompt
+		}
+	}
+	// 对话里指定的提供商优先于用户的设置，两者都优先于路由规则
+	model := c.ChatContext.LookupPinnedModel(&m.UserId, m.GroupId, m.MessageId)
+	if len(model) == 0 {
+		model, _ = c.Preferences.Get(preference.KindModel, m.GetNamespacedUserID())
+	}
+	if len(model) != 0 {
+		providers = c.preferProvider(providers, model)
+	}
+	// 复制一份，避免多个对话同时 append 到共享的提示词上
+	systemPrompt = append([]chatcontext.Message{}, systemPrompt...)
 	if m.Nickname != "" {
 		systemPrompt = append(systemPrompt, chatcontext.BuildNicknamePrompt(m.Nickname))
 	}
 
-	messages, err := c.ChatContext.LoadContextMessages(&m.UserId, m.GroupId, m.MessageId)
+	history, err := c.ChatContext.LoadContextMessages(&m.UserId, m.GroupId, m.MessageId)
 	if err != nil {
 		log.Printf("Failed to load context: %v", err)
 		return nil
 	}
-	messages = append(systemPrompt, messages...)
+	// 摘要和提示词一样不能被截断
+	for len(history) > 1 && history[0].Role == "system" {
+		systemPrompt = append(systemPrompt, history[0])
+		history = history[1:]
+	}
 
-	message, err := c.doPost(messages, &p)
-	if err != nil {
-		return err
-	} else if message == nil {
-		return fmt.Errorf("empty message")
+	for _, p := range providers {
+		breaker := p.Breaker()
+		if !breaker.Allow() {
+			log.Printf("Skip provider %s: circuit breaker is open", p.Name)
+			continue
+		}
+
+		err := c.chatWithProvider(ctx, p, m, systemPrompt, history, toolNames)
+		if err == nil {
+			answered = true
+			breaker.Success()
+			go c.maybeSummarize(m)
+			return nil
+		}
+		if isRecalled(ctx) {
+			breaker.Release()
+			return nil
+		}
+
+		class := classifyError(err)
+		log.Printf("Failed to chat with %s (%s): %v", p.Name, class, err)
+		if class == classFatal {
+			// 服务商能正常响应，是请求本身的问题
+			breaker.Success()
+			return err
+		}
+		breaker.Failure()
+	}
+
+	return fmt.Errorf("all providers failed")
+}
+
+// 按照服务商的策略重试，只有可重试的错误才会在同一个服务商重试
+func (c Chatter) chatWithProvider(ctx context.Context, p providerconfig.ProviderConfig, m messageenvelope.MessageEnvelope, systemPrompt, history []chatcontext.Message, toolNames []string) error {
+	truncated := p.TruncateContext(systemPrompt, history)
+	if len(truncated) < len(history) {
+		log.Printf("Truncate context for %s from %d to %d messages", p.Name, len(history), len(truncated))
+	}
+	messages := append(append([]chatcontext.Message{}, systemPrompt...), truncated...)
+
+	for attempt := 0; ; attempt++ {
+		err := c.askProvider(ctx, p, m, messages, toolNames)
+		if isKeyError(err) && p.KeyPool().HasAvailable() {
+			// 出错的 key 已经进入冷却，换下一个 key 立即重试，不算在重试次数里
+			log.Printf("Retry %s with another key: %v", p.Name, err)
+			attempt--
+			continue
+		}
+		if err == nil || classifyError(err) != classRetryable || attempt >= p.Failover.MaxRetries {
+			return err
+		}
+
+		backoff := p.Failover.Backoff(attempt + 1)
+		var statusErr StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > backoff {
+			// 不能为一个服务商占住 worker 太久，直接换下一个
+			if max := p.Failover.MaxBackoff(); statusErr.RetryAfter > max {
+				log.Printf("Give up retrying %s: Retry-After %s exceeds %s", p.Name, statusErr.RetryAfter, max)
+				return err
+			}
+			backoff = statusErr.RetryAfter
+		}
+		log.Printf("Retry %s in %s (%d/%d): %v", p.Name, backoff, attempt+1, p.Failover.MaxRetries, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// toolNames 为 nil 时可以使用全部工具
+func (c Chatter) askProvider(ctx context.Context, p providerconfig.ProviderConfig, m messageenvelope.MessageEnvelope, messages []chatcontext.Message, toolNames []string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.Failover.Timeout())
+	defer cancel()
+
+	// 工具调用会往后追加消息，不能影响重试
+	messages = append([]chatcontext.Message{}, messages...)
+	if p.Vision {
+		messages = c.resolveImages(p, messages)
+	}
+
+	var tools []tool.Definition
+	if p.FunctionCalling {
+		tools = c.Tools.Definitions(toolNames)
+	}
+
+	// 多轮工具调用的用量加在一起
+	var total *chatcontext.Usage
+	for round := 0; ; round++ {
+		toolChoice := ""
+		if round >= c.MaxToolRounds {
+			// 最后一轮不再允许调用工具，让模型直接回答；工具定义仍然要带上，
+			// 否则这次回答中已经调用过的工具会被当作不支持工具而去掉
+			toolChoice = toolChoiceNone
+		}
+
+		splitter := newStreamSplitter(p.Reasoning)
+		message, usage, err := c.doPost(ctx, messages, &p, tools, toolChoice, func(reasoning, content string) {
+			for {
+				piece, ok := splitter.Next(content)
+				if !ok {
+					return
+				}
+				index := splitter.Count() - 1
+				if index == 0 {
+					m.Reasoning = strings.TrimSpace(reasoning)
+				}
+				c.sendStreamPart(m, p.Name, piece, index, nil)
+			}
+		})
+		total = addUsage(total, usage)
+		if splitter.HasSent() {
+			// 已经发出去一部分了，不能再换别的模型重来
+			content := ""
+			if message != nil {
+				content = message.Content
+			}
+			m.Usage = priceUsage(p, total)
+			if isRecalled(ctx) {
+				c.cancelStream(m, splitter.Count())
+				// 已经生成的部分也要计入用量
+				c.recordUsage(p, m, messages, content)
+				return nil
+			}
+			if err != nil {
+				log.Printf("Stream from %s interrupted: %v", p.Name, err)
+			}
+			index := splitter.Count()
+			c.sendStreamPart(m, p.Name, splitter.Rest(content), index, &content)
+			c.recordUsage(p, m, messages, content)
+			return nil
+		}
+		if err != nil {
+			return err
+		} else if message == nil {
+			return ErrEmptyMessage
+		}
+
+		if len(message.ToolCalls) != 0 && len(tools) != 0 && toolChoice != toolChoiceNone {
+			toolMessages := c.callTools(ctx, *message)
+			messages = append(messages, toolMessages...)
+			m.ToolMessages = append(m.ToolMessages, toolMessages...)
+			continue
+		}
+
+		content := strings.TrimSpace(message.Content)
+		if len(content) == 0 {
+			return ErrEmptyMessage
+		}
+
+		m.Text = content
+		m.Reasoning = strings.TrimSpace(message.ReasoningContent)
+		m.ModelName = p.Name
+		m.Usage = priceUsage(p, total)
+		c.ToSendMessageCh <- m
+		c.recordUsage(p, m, messages, content)
+
+		return nil
+	}
+}
+
+// 收到图片时就下载到缓存，之后原始 URL 过期也能找回
+func (c Chatter) cacheImages(images []chatcontext.Image) []chatcontext.Image {
+	if c.Images == nil || len(images) == 0 {
+		return images
+	}
+	cached := make([]chatcontext.Image, 0, len(images))
+	for _, image := range images {
+		source := image.Url
+		if len(source) == 0 {
+			source = image.File
+		}
+		hash, err := c.Images.Store(c.ctx, source)
+		if err != nil {
+			log.Printf("Failed to cache image %s: %v", util.TruncateLogStr(source), err)
+		}
+		image.Hash = hash
+		cached = append(cached, image)
+	}
+	return cached
+}
+
+// 把图片换成请求中使用的 URL，找不到的图片换成文字占位符
+func (c Chatter) resolveImages(p providerconfig.ProviderConfig, messages []chatcontext.Message) []chatcontext.Message {
+	for i, message := range messages {
+		if len(message.Images) == 0 {
+			continue
+		}
+		images := make([]chatcontext.Image, 0, len(message.Images))
+		expired := 0
+		for _, image := range message.Images {
+			isHttp := strings.HasPrefix(image.Url, "http://") || strings.HasPrefix(image.Url, "https://")
+			// 只有最新消息中的 URL 一定还没过期
+			if p.ImageUrl && isHttp && i == len(messages)-1 {
+				images = append(images, image)
+				continue
+			}
+			if c.Images != nil && len(image.Hash) != 0 {
+				dataUrl, err := c.Images.DataUrl(image.Hash)
+				if err == nil {
+					image.Url = dataUrl
+					images = append(images, image)
+					continue
+				}
+				log.Printf("Failed to load cached image: %v", err)
+			}
+			if isHttp && i == len(messages)-1 {
+				images = append(images, image)
+				continue
+			}
+			expired++
+		}
+		message.Images = images
+		if expired != 0 {
+			message.Content = strings.TrimSpace(message.Content + strings.Repeat("[图片已过期]", expired))
+		}
+		messages[i] = message
+	}
+	return messages
+}
+
+// 依次执行模型要求的工具调用，返回带有调用的助手消息和每个调用的结果
+func (c Chatter) callTools(ctx context.Context, message chatcontext.Message) []chatcontext.Message {
+	assistant := chatcontext.Message{
+		Role:      "assistant",
+		Content:   message.Content,
+		ToolCalls: make([]chatcontext.ToolCall, 0, len(message.ToolCalls)),
+	}
+	for _, call := range message.ToolCalls {
+		call.Index = nil
+		if len(call.Type) == 0 {
+			call.Type = "function"
+		}
+		assistant.ToolCalls = append(assistant.ToolCalls, call)
+	}
+
+	toolMessages := []chatcontext.Message{assistant}
+	for _, call := range assistant.ToolCalls {
+		toolMessages = append(toolMessages, c.Tools.Call(ctx, call))
 	}
+	return toolMessages
+}
 
-	content := strings.TrimSpace(message.Content)
-	if len(content) == 0 {
-		return fmt.Errorf("empty message")
+// 把指定的提供商放到最前面，其余的仍然用来兜底
+func (c Chatter) preferProvider(providers []providerconfig.ProviderConfig, name string) []providerconfig.ProviderConfig {
+	var preferred []providerconfig.ProviderConfig
+	for _, p := range c.Providers {
+		if p.Name == name {
+			preferred = append(preferred, p)
+			break
+		}
 	}
+	if len(preferred) == 0 {
+		log.Printf("Preferred provider %s does not exist", name)
+		return providers
+	}
+	for _, p := range providers {
+		if p.Name != name {
+			preferred = append(preferred, p)
+		}
+	}
+	return preferred
+}
 
-	m.Text = content
-	m.ModelName = p.Name
+// full 不为空时表示这是流式回复的最后一段
+func (c Chatter) sendStreamPart(m messageenvelope.MessageEnvelope, modelName, text string, index int, full *string) {
+	if index > 0 {
+		m.Reasoning = ""
+	}
+	m.Text = text
+	m.ModelName = modelName
+	m.Stream = &messageenvelope.StreamPart{
+		Index: index,
+		Final: full != nil,
+	}
+	if full != nil {
+		m.Stream.Full = strings.TrimSpace(*full)
+	}
 	c.ToSendMessageCh <- m
+}
 
-	return nil
+// 让 sender 清理已经发出的部分
+func (c Chatter) cancelStream(m messageenvelope.MessageEnvelope, index int) {
+	m.Text = ""
+	m.Stream = &messageenvelope.StreamPart{
+		Index:     index,
+		Cancelled: true,
+	}
+	c.ToSendMessageCh <- m
 }
 
-func (c *Chatter) execCmd(m messageenvelope.MessageEnvelope) {
-	output := c.CmdAdaptor.Exec(m.UserId, m.Text)
+func (c *Chatter) execCmd(ctx context.Context, m messageenvelope.MessageEnvelope) {
+	// /model <name> <question> 其实是一次提问
+	if model, question, ok := c.CmdAdaptor.ParseModelQuestion(m.Text); ok {
+		m.Category = onebot.CategoryChat
+		m.Text = question
+		m.PinnedModel = model
+		if err := c.chatWithLlm(ctx, m); err != nil {
+			log.Printf("Failed to chat with LLM: %v", err)
+		}
+		return
+	}
+
+	output := c.CmdAdaptor.Exec(m.UserId, m.GroupId, m.Text)
 	m.Text = output
 	c.ToSendMessageCh <- m
 }
@@ -204,18 +665,16 @@ func (c *Chatter) extractShare(m messageenvelope.MessageEnvelope) {
 	c.ToSendMessageCh <- m
 }
 
-func (c *Chatter) doChat(m messageenvelope.MessageEnvelope) {
+func (c *Chatter) doChat(ctx context.Context, m messageenvelope.MessageEnvelope) {
 	if m.Category == onebot.CategoryCmd {
-		c.execCmd(m)
+		c.execCmd(ctx, m)
 	} else if m.Category == onebot.CategoryShare {
 		c.extractShare(m)
+	} else if m.Category == onebot.CategoryPoke {
+		c.handleNotice(m)
 	} else if m.Category == onebot.CategoryChat {
-		for _, p := range c.Providers {
-			if err := c.chatWithLlm(p, m); err != nil {
-				log.Printf("Failed to chat with LLM: %v", err)
-			} else {
-				break
-			}
+		if err := c.chatWithLlm(ctx, m); err != nil {
+			log.Printf("Failed to chat with LLM: %v", err)
 		}
 	}
 }
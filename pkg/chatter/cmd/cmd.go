@@ -5,17 +5,30 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vaaandark/qabot/pkg/chatter/whitelist"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/quota"
+	"github.com/vaaandark/qabot/pkg/usage"
 )
 
 type Cmd struct {
 	WhitelistAdaptor whitelist.Whitelist
+	Providers        []providerconfig.ProviderConfig
+	Preferences      preference.Store
+	Quota            *quota.Store
+	Usage            *usage.Store
 }
 
-func NewCmd(whitelistAdaptor whitelist.Whitelist) Cmd {
+func NewCmd(whitelistAdaptor whitelist.Whitelist, providers []providerconfig.ProviderConfig, preferences preference.Store, quota *quota.Store, usage *usage.Store) Cmd {
 	return Cmd{
 		WhitelistAdaptor: whitelistAdaptor,
+		Providers:        providers,
+		Preferences:      preferences,
+		Quota:            quota,
+		Usage:            usage,
 	}
 }
 
@@ -48,8 +61,36 @@ func helpStr() string {
 	return "Non-admin cmd:\n" +
 		"    /help(/h)\n" +
 		"    /check-health(/ch)\n" +
+		"    /model\n" +
+		"    /tts\n" +
+		"    /usage\n" +
 		"Admin cmd:\n" +
-		"    /whitelist(/wl)"
+		"    /whitelist(/wl)\n" +
+		"    /keys\n" +
+		"    /quota"
+}
+
+func (ca Cmd) cmdKeys(userId int64, _ []string) (string, error) {
+	if !ca.IsAdmin(userId) {
+		return fmt.Sprintf("You(%d) are not administrator.", userId), nil
+	}
+
+	var sb strings.Builder
+	for _, p := range ca.Providers {
+		if openUntil := p.Breaker().OpenUntil(); openUntil != nil {
+			sb.WriteString(fmt.Sprintf("%s (circuit open, retry in %s):\n", p.Name, time.Until(*openUntil).Round(time.Second)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%s:\n", p.Name))
+		}
+		for _, ks := range p.KeyPool().Stats() {
+			status := "ok"
+			if !ks.Healthy {
+				status = fmt.Sprintf("cooldown %s", time.Until(ks.CooldownUntil).Round(time.Second))
+			}
+			sb.WriteString(fmt.Sprintf("    %s success=%d failure=%d %s\n", ks.Key, ks.Success, ks.Failure, status))
+		}
+	}
+	return strings.TrimSpace(sb.String()), nil
 }
 
 func (ca *Cmd) cmdWhitelist(userId int64, cmds []string) (string, error) {
@@ -104,7 +145,7 @@ func (ca *Cmd) cmdWhitelist(userId int64, cmds []string) (string, error) {
 	}
 }
 
-func (ca *Cmd) Exec(userId int64, text string) (output string) {
+func (ca *Cmd) Exec(userId int64, groupId *int64, text string) (output string) {
 	cmds := strings.Split(text, " ")
 	if len(cmds) == 0 {
 		output = "Empty cmd"
@@ -120,6 +161,32 @@ func (ca *Cmd) Exec(userId int64, text string) (output string) {
 			log.Printf("Failed to exec whitelist: %v", err)
 		}
 		output = cmdOutput
+	case "model":
+		cmdOutput, err := ca.cmdModel(userId, cmds)
+		if err != nil {
+			log.Printf("Failed to exec model: %v", err)
+		}
+		output = cmdOutput
+	case "tts":
+		cmdOutput, err := ca.cmdTts(userId, groupId, cmds)
+		if err != nil {
+			log.Printf("Failed to exec tts: %v", err)
+		}
+		output = cmdOutput
+	case "usage":
+		cmdOutput, err := ca.cmdUsage(userId, groupId, cmds)
+		if err != nil {
+			log.Printf("Failed to exec usage: %v", err)
+		}
+		output = cmdOutput
+	case "keys":
+		output, _ = ca.cmdKeys(userId, cmds)
+	case "quota":
+		cmdOutput, err := ca.cmdQuota(userId, cmds)
+		if err != nil {
+			log.Printf("Failed to exec quota: %v", err)
+		}
+		output = cmdOutput
 	case "h", "help":
 		output, _ = ca.cmdHelp(userId, cmds)
 	case "ch", "check-health":
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+// 按序号或名字匹配提供商，名字里可能有空格，取最长的匹配，返回剩下的文本
+func (ca Cmd) MatchProvider(args string) (*providerconfig.ProviderConfig, string) {
+	args = strings.TrimSpace(args)
+
+	first, rest, _ := strings.Cut(args, " ")
+	if n, err := strconv.Atoi(first); err == nil && n >= 1 && n <= len(ca.Providers) {
+		return &ca.Providers[n-1], strings.TrimSpace(rest)
+	}
+
+	var matched *providerconfig.ProviderConfig
+	for i, p := range ca.Providers {
+		name := p.Name
+		if len(name) > len(args) || !strings.EqualFold(args[:len(name)], name) {
+			continue
+		}
+		if len(name) < len(args) && !unicode.IsSpace(rune(args[len(name)])) {
+			continue
+		}
+		if matched == nil || len(name) > len(matched.Name) {
+			matched = &ca.Providers[i]
+		}
+	}
+	if matched == nil {
+		return nil, args
+	}
+	return matched, strings.TrimSpace(args[len(matched.Name):])
+}
+
+// 解析 /model <name> <question>，只对这一次提问生效
+func (ca Cmd) ParseModelQuestion(text string) (model string, question string, ok bool) {
+	name, args, _ := strings.Cut(text, " ")
+	if name != "model" {
+		return "", "", false
+	}
+	p, rest := ca.MatchProvider(args)
+	if p == nil || len(rest) == 0 {
+		return "", "", false
+	}
+	return p.Name, rest, true
+}
+
+func (ca Cmd) cmdModel(userId int64, cmds []string) (string, error) {
+	namespacedId := fmt.Sprintf("user/%d", userId)
+	args := strings.TrimSpace(strings.Join(cmds[1:], " "))
+
+	if len(args) == 0 {
+		current, _ := ca.Preferences.Get(preference.KindModel, namespacedId)
+		var sb strings.Builder
+		sb.WriteString("Models:\n")
+		for i, p := range ca.Providers {
+			mark := ""
+			if p.Name == current {
+				mark = " *"
+			}
+			sb.WriteString(fmt.Sprintf("    %d. %s (%s)%s\n", i+1, p.Name, p.Model, mark))
+		}
+		sb.WriteString("Usage:\n" +
+			"    /model <name|index>: use it for your following messages\n" +
+			"    /model <name|index> <question>: use it for this conversation\n" +
+			"    /model reset: back to default")
+		return sb.String(), nil
+	}
+
+	if args == "reset" {
+		if err := ca.Preferences.Delete(preference.KindModel, namespacedId); err != nil {
+			return fmt.Sprintf("%s: failed to reset: %v", cmds[0], err), err
+		}
+		return "Model reset to default", nil
+	}
+
+	p, rest := ca.MatchProvider(args)
+	if p == nil {
+		return fmt.Sprintf("%s: unknown model: %s", cmds[0], args), nil
+	}
+	if len(rest) != 0 {
+		// 带问题的情况由 chatter 处理，走到这里说明出了问题
+		return fmt.Sprintf("%s: unexpected question", cmds[0]), nil
+	}
+	if err := ca.Preferences.Set(preference.KindModel, namespacedId, p.Name); err != nil {
+		return fmt.Sprintf("%s: failed to save: %v", cmds[0], err), err
+	}
+	return fmt.Sprintf("Switched to %s", p.Name), nil
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func formatLimit(used, limit int64) string {
+	if limit <= 0 {
+		return fmt.Sprintf("%d/unlimited", used)
+	}
+	return fmt.Sprintf("%d/%d", used, limit)
+}
+
+func (ca *Cmd) cmdQuota(userId int64, cmds []string) (string, error) {
+	if !ca.IsAdmin(userId) {
+		return fmt.Sprintf("You(%d) are not administrator.", userId), nil
+	}
+
+	if len(cmds) < 4 || (cmds[2] != "user" && cmds[2] != "group") {
+		return "Usage:\n" +
+			"    /quota show user|group <id>: show today's usage\n" +
+			"    /quota reset user|group <id>: reset today's usage and rate limit", nil
+	}
+	if ca.Quota == nil {
+		return fmt.Sprintf("%s: quota is disabled", cmds[0]), nil
+	}
+
+	id, err := strconv.ParseInt(cmds[3], 10, 64)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid id: %s", strings.Join(cmds[:3], " "), cmds[3]), nil
+	}
+	namespacedId := fmt.Sprintf("%s/%d", cmds[2], id)
+
+	switch cmds[1] {
+	case "show":
+		usage, err := ca.Quota.Usage(namespacedId)
+		if err != nil {
+			return fmt.Sprintf("%s: failed to load usage: %v", cmds[0], err), err
+		}
+		limit := ca.WhitelistAdaptor.Limit(namespacedId)
+		rate := "unlimited"
+		if limit.RatePerMinute > 0 {
+			rate = fmt.Sprintf("%g/min, burst %d", limit.RatePerMinute, max(limit.Burst, 1))
+		}
+		return fmt.Sprintf("%s:\n", namespacedId) +
+			fmt.Sprintf("    requests: %s\n", formatLimit(usage.Requests, limit.DailyRequests)) +
+			fmt.Sprintf("    tokens: %s\n", formatLimit(usage.Tokens, limit.DailyTokens)) +
+			fmt.Sprintf("    rate: %s", rate), nil
+	case "reset":
+		if err := ca.Quota.Reset(namespacedId); err != nil {
+			return fmt.Sprintf("%s: failed to reset: %v", cmds[0], err), err
+		}
+		return fmt.Sprintf("Successfully reset quota of %s", namespacedId), nil
+	default:
+		return fmt.Sprintf("%s: unknown subcommand: %s", cmds[0], cmds[1]), nil
+	}
+}
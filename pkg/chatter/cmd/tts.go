@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/speech"
+)
+
+// 在群里设置时对整个群生效，私聊中只对自己生效
+func (ca Cmd) cmdTts(userId int64, groupId *int64, cmds []string) (string, error) {
+	namespacedId := fmt.Sprintf("user/%d", userId)
+	if groupId != nil {
+		namespacedId = fmt.Sprintf("group/%d", *groupId)
+	}
+
+	if len(cmds) < 2 {
+		current, ok := ca.Preferences.Get(preference.KindTTS, namespacedId)
+		if !ok {
+			current = speech.TTSOff
+		}
+		return fmt.Sprintf("TTS: %s\n", current) +
+			"Usage:\n" +
+			"    /tts on: answer with both text and voice\n" +
+			"    /tts only: answer with voice only\n" +
+			"    /tts off: answer with text only", nil
+	}
+
+	mode := strings.ToLower(cmds[1])
+	switch mode {
+	case speech.TTSOn, speech.TTSOnly:
+		if err := ca.Preferences.Set(preference.KindTTS, namespacedId, mode); err != nil {
+			return fmt.Sprintf("%s: failed to save: %v", cmds[0], err), err
+		}
+	case speech.TTSOff:
+		if err := ca.Preferences.Delete(preference.KindTTS, namespacedId); err != nil {
+			return fmt.Sprintf("%s: failed to reset: %v", cmds[0], err), err
+		}
+	default:
+		return fmt.Sprintf("%s: unknown mode: %s", cmds[0], cmds[1]), nil
+	}
+	return fmt.Sprintf("TTS %s for %s", mode, namespacedId), nil
+}
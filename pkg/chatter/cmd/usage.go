@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/usage"
+)
+
+const defaultUsageDays = 7
+
+func formatTotals(totals usage.Totals) string {
+	s := fmt.Sprintf("requests=%d prompt=%d completion=%d", totals.Requests, totals.PromptTokens, totals.CompletionTokens)
+	if totals.ReasoningTokens != 0 {
+		s += fmt.Sprintf(" reasoning=%d", totals.ReasoningTokens)
+	}
+	if totals.Cost != 0 {
+		s += fmt.Sprintf(" cost=%.4f", totals.Cost)
+	}
+	return s
+}
+
+func sumOf(entries []usage.Entry, id string, day string) usage.Totals {
+	totals := usage.Totals{}
+	for _, entry := range entries {
+		if entry.Id == id && (len(day) == 0 || entry.Day == day) {
+			totals = totals.Add(entry.Totals)
+		}
+	}
+	return totals
+}
+
+// 普通用户只能看自己和所在的群，管理员可以看所有提供商、群和用户
+func (ca Cmd) cmdUsage(userId int64, groupId *int64, cmds []string) (string, error) {
+	if ca.Usage == nil {
+		return fmt.Sprintf("%s: usage is disabled", cmds[0]), nil
+	}
+
+	all := len(cmds) >= 2 && cmds[1] == "all"
+	if all && !ca.IsAdmin(userId) {
+		return fmt.Sprintf("You(%d) are not administrator.", userId), nil
+	}
+
+	days := defaultUsageDays
+	if all {
+		days = 1
+	}
+	if arg := cmds[len(cmds)-1]; len(cmds) >= 2 && arg != "all" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return "Usage:\n" +
+				fmt.Sprintf("    /usage [days]: show usage of you and this group, %d days by default\n", defaultUsageDays) +
+				"    /usage all [days]: show usage of all providers, groups and users, today by default", nil
+		}
+		days = n
+	}
+
+	entries, err := ca.Usage.Load(days)
+	if err != nil {
+		return fmt.Sprintf("%s: failed to load usage: %v", cmds[0], err), err
+	}
+
+	var sb strings.Builder
+	if all {
+		sb.WriteString(fmt.Sprintf("Usage in %d day(s):\n", days))
+		for _, entry := range usage.SumById(entries) {
+			sb.WriteString(fmt.Sprintf("    %s: %s\n", entry.Id, formatTotals(entry.Totals)))
+		}
+		return strings.TrimSpace(sb.String()), nil
+	}
+
+	ids := []string{fmt.Sprintf("user/%d", userId)}
+	if groupId != nil {
+		ids = append(ids, fmt.Sprintf("group/%d", *groupId))
+	}
+	today := time.Now().Format("2006-01-02")
+	for _, id := range ids {
+		sb.WriteString(fmt.Sprintf("%s:\n", id))
+		sb.WriteString(fmt.Sprintf("    today: %s\n", formatTotals(sumOf(entries, id, today))))
+		sb.WriteString(fmt.Sprintf("    %d day(s): %s\n", days, formatTotals(sumOf(entries, id, ""))))
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
@@ -1,23 +1,181 @@
 package chatter
 
-import "github.com/vaaandark/qabot/pkg/chatcontext"
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
 
 type CompletionRequest struct {
-	Model    string                `json:"model"`
-	Messages []chatcontext.Message `json:"messages"`
-	Stream   bool                  `json:"stream"`
+	Model    string           `json:"model"`
+	Messages []RequestMessage `json:"messages"`
+	Stream   bool             `json:"stream"`
+	// 让流式输出在最后一块中带上 usage
+	StreamOptions *StreamOptions    `json:"stream_options,omitempty"`
+	Tools         []tool.Definition `json:"tools,omitempty"`
+	// 为 none 时带着工具定义但不允许调用
+	ToolChoice string `json:"tool_choice,omitempty"`
+	providerconfig.GenerationParams
+	ExtraBody map[string]interface{} `json:"-"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
-func CompletionRequestFromContext(model string, messages []chatcontext.Message) CompletionRequest {
+const toolChoiceNone = "none"
+
+func CompletionRequestFromContext(provider *providerconfig.ProviderConfig, messages []chatcontext.Message, tools []tool.Definition, toolChoice string) CompletionRequest {
+	if len(tools) == 0 {
+		// 不支持工具或者没有开启工具时，服务商看到 tool_calls 和 tool 消息会返回 400
+		messages = withoutToolMessages(messages)
+		toolChoice = ""
+	}
+	var streamOptions *StreamOptions
+	if provider.Stream {
+		streamOptions = &StreamOptions{IncludeUsage: true}
+	}
 	return CompletionRequest{
-		Model:    model,
-		Messages: messages,
-		Stream:   false,
+		Model:            provider.Model,
+		Messages:         requestMessages(messages, provider.Vision),
+		Stream:           provider.Stream,
+		StreamOptions:    streamOptions,
+		Tools:            tools,
+		ToolChoice:       toolChoice,
+		GenerationParams: provider.Params,
+		ExtraBody:        provider.ExtraBody,
+	}
+}
+
+// 请求中的消息，带图片时 Content 是 OpenAI 风格的 content 数组
+type RequestMessage struct {
+	Role             string                 `json:"role"`
+	Content          interface{}            `json:"content"`
+	ReasoningContent string                 `json:"reasoning_content,omitempty"`
+	ToolCalls        []chatcontext.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallId       string                 `json:"tool_call_id,omitempty"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageUrl *ImageUrl `json:"image_url,omitempty"`
+}
+
+type ImageUrl struct {
+	Url string `json:"url"`
+}
+
+// 去掉调用工具的助手消息和工具的结果，随后的回答中已经包含了需要的信息
+func withoutToolMessages(messages []chatcontext.Message) []chatcontext.Message {
+	result := make([]chatcontext.Message, 0, len(messages))
+	for _, message := range messages {
+		if message.Role == "tool" || len(message.ToolCalls) != 0 {
+			continue
+		}
+		result = append(result, message)
+	}
+	return result
+}
+
+func requestMessages(messages []chatcontext.Message, vision bool) []RequestMessage {
+	result := make([]RequestMessage, 0, len(messages))
+	for _, message := range messages {
+		if message.Voice {
+			// 让模型知道内容可能有识别错误
+			message.Content = "[语音转写] " + message.Content
+		}
+		rm := RequestMessage{
+			Role:             message.Role,
+			Content:          message.Content,
+			ReasoningContent: message.ReasoningContent,
+			ToolCalls:        message.ToolCalls,
+			ToolCallId:       message.ToolCallId,
+		}
+		if len(message.Images) != 0 {
+			if vision {
+				rm.Content = contentParts(message)
+			} else {
+				// 不支持图片的模型至少知道用户发了图片
+				rm.Content = strings.TrimSpace(message.Content + strings.Repeat("[图片]", len(message.Images)))
+			}
+		}
+		result = append(result, rm)
+	}
+	return result
+}
+
+func contentParts(message chatcontext.Message) []ContentPart {
+	parts := []ContentPart{}
+	if len(message.Content) != 0 {
+		parts = append(parts, ContentPart{
+			Type: "text",
+			Text: message.Content,
+		})
+	}
+	for _, image := range message.Images {
+		url := image.Url
+		if len(url) == 0 {
+			url = image.File
+		}
+		parts = append(parts, ContentPart{
+			Type:     "image_url",
+			ImageUrl: &ImageUrl{Url: url},
+		})
 	}
+	return parts
+}
+
+func (cr CompletionRequest) MarshalJSON() ([]byte, error) {
+	type plain CompletionRequest
+	b, err := json.Marshal(plain(cr))
+	if err != nil || len(cr.ExtraBody) == 0 {
+		return b, err
+	}
+
+	body := make(map[string]interface{})
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+	for k, v := range cr.ExtraBody {
+		// 不允许覆盖 qabot 自己管理的字段
+		if k == "model" || k == "messages" || k == "stream" || k == "stream_options" || k == "tools" || k == "tool_choice" {
+			continue
+		}
+		body[k] = v
+	}
+	return json.Marshal(body)
 }
 
 type CompletionResponse struct {
-	Choices []Choice `json:"choices"`
+	Choices []Choice       `json:"choices"`
+	Usage   *ResponseUsage `json:"usage,omitempty"`
+}
+
+// OpenAI 风格的 usage，思考的 token 数在 completion_tokens_details 中
+type ResponseUsage struct {
+	PromptTokens            int64 `json:"prompt_tokens"`
+	CompletionTokens        int64 `json:"completion_tokens"`
+	CompletionTokensDetails *struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details,omitempty"`
+}
+
+func (ru *ResponseUsage) GetUsage() *chatcontext.Usage {
+	if ru == nil {
+		return nil
+	}
+	usage := &chatcontext.Usage{
+		PromptTokens:     ru.PromptTokens,
+		CompletionTokens: ru.CompletionTokens,
+	}
+	if ru.CompletionTokensDetails != nil {
+		usage.ReasoningTokens = ru.CompletionTokensDetails.ReasoningTokens
+	}
+	return usage
 }
 
 func (cr CompletionResponse) GetMessage() *chatcontext.Message {
@@ -31,3 +189,22 @@ type Choice struct {
 	Index   int                 `json:"index"`
 	Message chatcontext.Message `json:"message"`
 }
+
+type CompletionChunk struct {
+	Choices []ChunkChoice `json:"choices"`
+	// 通常只在最后一块中出现，这时 choices 为空
+	Usage *ResponseUsage `json:"usage,omitempty"`
+}
+
+func (cc CompletionChunk) GetDelta() *chatcontext.Message {
+	if len(cc.Choices) == 0 {
+		return nil
+	}
+	return &cc.Choices[0].Delta
+}
+
+type ChunkChoice struct {
+	Index        int                 `json:"index"`
+	Delta        chatcontext.Message `json:"delta"`
+	FinishReason *string             `json:"finish_reason,omitempty"`
+}
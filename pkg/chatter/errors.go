@@ -0,0 +1,90 @@
+package chatter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/keypool"
+)
+
+const maxErrorBodyLen = 512
+
+var ErrEmptyMessage = errors.New("empty message")
+
+// 服务商返回了非 2xx 的状态码
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (se StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", se.StatusCode, se.Body)
+}
+
+type errorClass int
+
+const (
+	// 超时、网络错误、限流和服务端错误，可以在同一个服务商重试
+	classRetryable errorClass = iota
+	// 服务商本身不可用或者回答为空，直接换下一个服务商
+	classNextProvider
+	// 请求本身有问题，换哪个服务商都没用
+	classFatal
+)
+
+func (ec errorClass) String() string {
+	switch ec {
+	case classRetryable:
+		return "retryable"
+	case classNextProvider:
+		return "next-provider"
+	default:
+		return "fatal"
+	}
+}
+
+// key 本身的问题，换一个 key 也许就好了
+func isKeyError(err error) bool {
+	var statusErr StatusError
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden)
+}
+
+func classifyError(err error) errorClass {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout ||
+			statusErr.StatusCode >= 500:
+			return classRetryable
+		case statusErr.StatusCode == http.StatusUnauthorized ||
+			statusErr.StatusCode == http.StatusForbidden ||
+			statusErr.StatusCode == http.StatusNotFound:
+			// 多半是这个服务商的 key 或者模型配置有问题
+			return classNextProvider
+		default:
+			// 400、413、422 这类请求本身的错误，不能拿着同一个请求把所有服务商都试一遍
+			return classFatal
+		}
+	}
+
+	if errors.Is(err, ErrEmptyMessage) || errors.Is(err, keypool.ErrNoAvailableKey) {
+		return classNextProvider
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return classRetryable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return classRetryable
+	}
+
+	return classNextProvider
+}
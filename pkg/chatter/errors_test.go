@@ -0,0 +1,215 @@
+package chatter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/keypool"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want errorClass
+	}{
+		{StatusError{StatusCode: http.StatusTooManyRequests}, classRetryable},
+		{StatusError{StatusCode: http.StatusInternalServerError}, classRetryable},
+		{StatusError{StatusCode: http.StatusBadGateway}, classRetryable},
+		{StatusError{StatusCode: http.StatusRequestTimeout}, classRetryable},
+		{StatusError{StatusCode: http.StatusBadRequest}, classFatal},
+		{StatusError{StatusCode: http.StatusRequestEntityTooLarge}, classFatal},
+		{StatusError{StatusCode: http.StatusUnprocessableEntity}, classFatal},
+		{StatusError{StatusCode: http.StatusTeapot}, classFatal},
+		{StatusError{StatusCode: http.StatusUnauthorized}, classNextProvider},
+		{StatusError{StatusCode: http.StatusForbidden}, classNextProvider},
+		{StatusError{StatusCode: http.StatusNotFound}, classNextProvider},
+		{fmt.Errorf("wrapped: %w", StatusError{StatusCode: http.StatusBadRequest}), classFatal},
+		{ErrEmptyMessage, classNextProvider},
+		{keypool.ErrNoAvailableKey, classNextProvider},
+		{context.DeadlineExceeded, classRetryable},
+		{timeoutError{}, classRetryable},
+		{fmt.Errorf("something else"), classNextProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestChatContext(t *testing.T) *chatcontext.ChatContext {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	prompt := filepath.Join(dir, "prompt.json")
+	if err := os.WriteFile(prompt, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chatContext, err := chatcontext.NewChatContext(db, prompt, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chatContext
+}
+
+// 请求本身的错误直接失败，服务商那边的错误才换下一个服务商
+func TestFailover(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantAnswer bool
+		// 第一个服务商出错后是否应该进入冷却
+		wantOpen bool
+	}{
+		{"bad request", http.StatusBadRequest, false, false},
+		{"too large", http.StatusRequestEntityTooLarge, false, false},
+		{"unprocessable", http.StatusUnprocessableEntity, false, false},
+		{"server error", http.StatusServiceUnavailable, true, true},
+		{"rate limited", http.StatusTooManyRequests, true, true},
+		{"unauthorized", http.StatusUnauthorized, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failed atomic.Int32
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				failed.Add(1)
+				http.Error(w, `{"error":"failed"}`, tt.status)
+			}))
+			defer failing.Close()
+			fp := &fakeProvider{t: t, responses: []string{answerResponse}}
+			answering := httptest.NewServer(fp)
+			defer answering.Close()
+
+			first := newTestProvider(t, fmt.Sprintf(`{"name":"first","url":%q,"keys":["k1"],"failover":{"failure_threshold":1}}`, failing.URL))
+			second := newTestProvider(t, fmt.Sprintf(`{"name":"second","url":%q,"keys":["k2"]}`, answering.URL))
+
+			c := newToolChatter(t, 5)
+			c.ChatContext = newTestChatContext(t)
+			c.Providers = []providerconfig.ProviderConfig{first, second}
+			m := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 1, Text: "q"}
+			err := c.chatWithLlm(context.Background(), m)
+
+			if tt.wantAnswer {
+				if err != nil {
+					t.Fatalf("chatWithLlm: %v", err)
+				}
+				sent := <-c.ToSendMessageCh
+				if sent.Text != "done" || sent.ModelName != "second" {
+					t.Errorf("answer = %q from %s, want done from second", sent.Text, sent.ModelName)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("chatWithLlm succeeded, want the request error")
+				}
+				fp.mu.Lock()
+				if n := len(fp.requests); n != 0 {
+					t.Errorf("second provider got %d requests, want 0", n)
+				}
+				fp.mu.Unlock()
+				if !first.KeyPool().HasAvailable() {
+					t.Errorf("request error put the key into cooldown")
+				}
+			}
+			if n := failed.Load(); n != 1 {
+				t.Errorf("first provider got %d requests, want 1", n)
+			}
+			if open := !first.Breaker().Allow(); open != tt.wantOpen {
+				t.Errorf("circuit breaker open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+// 撤回取消了熔断后的试探请求，服务商之后还要能继续使用
+func TestRecallReleasesProbe(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读完请求体之后服务器才能发现客户端断开
+		io.ReadAll(r.Body)
+		arrived <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer provider.Close()
+
+	p := newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"],"failover":{"failure_threshold":1,"cooldown_seconds":1}}`, provider.URL))
+	p.Breaker().Failure()
+	time.Sleep(1100 * time.Millisecond)
+
+	c := newToolChatter(t, 5)
+	c.ChatContext = newTestChatContext(t)
+	c.Providers = []providerconfig.ProviderConfig{p}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go func() {
+		<-arrived
+		cancel(errRecalled)
+	}()
+	m := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 1, Text: "q"}
+	if err := c.chatWithLlm(ctx, m); err != nil {
+		t.Fatalf("chatWithLlm: %v", err)
+	}
+
+	if !p.Breaker().Allow() {
+		t.Errorf("provider is blocked after its probe was recalled")
+	}
+}
+
+// 服务商要求等待的时间超过退避上限时，不在它那里等，直接换下一个服务商
+func TestLongRetryAfterFailsOver(t *testing.T) {
+	var limited atomic.Int32
+	limiting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, `{"error":"rate limited"}`, http.StatusTooManyRequests)
+	}))
+	defer limiting.Close()
+	fp := &fakeProvider{t: t, responses: []string{answerResponse}}
+	answering := httptest.NewServer(fp)
+	defer answering.Close()
+
+	first := newTestProvider(t, fmt.Sprintf(`{"name":"first","url":%q,"keys":["k1"],"failover":{"max_retries":3,"max_backoff_ms":1000}}`, limiting.URL))
+	second := newTestProvider(t, fmt.Sprintf(`{"name":"second","url":%q,"keys":["k2"]}`, answering.URL))
+
+	c := newToolChatter(t, 5)
+	c.ChatContext = newTestChatContext(t)
+	c.Providers = []providerconfig.ProviderConfig{first, second}
+	m := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 1, Text: "q"}
+	start := time.Now()
+	if err := c.chatWithLlm(context.Background(), m); err != nil {
+		t.Fatalf("chatWithLlm: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s, Retry-After was not capped", elapsed)
+	}
+
+	sent := <-c.ToSendMessageCh
+	if sent.ModelName != "second" {
+		t.Errorf("answered by %s, want second", sent.ModelName)
+	}
+	if n := limited.Load(); n != 1 {
+		t.Errorf("first provider got %d requests, want 1", n)
+	}
+}
@@ -0,0 +1,142 @@
+package chatter
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vaaandark/qabot/pkg/onebot"
+)
+
+const (
+	// 合并转发可以嵌套，太深的不再展开
+	maxForwardDepth = 3
+	// 展开后的总字数上限，超出的部分截断
+	maxForwardChars = 8000
+)
+
+type forwardWriter struct {
+	oneBot *onebot.Client
+	sb     strings.Builder
+	chars  int
+	full   bool
+}
+
+// 逐行写入，超出字数上限后丢弃后面的内容
+func (w *forwardWriter) writeLine(prefix, line string) {
+	if w.full {
+		return
+	}
+	if n := utf8.RuneCountInString(line); w.chars+n > maxForwardChars {
+		line = string([]rune(line)[:maxForwardChars-w.chars]) + "……（已截断）"
+		w.full = true
+	}
+	w.chars += utf8.RuneCountInString(line)
+	w.sb.WriteString(prefix)
+	w.sb.WriteString(line)
+	w.sb.WriteString("\n")
+}
+
+func (w *forwardWriter) write(id string, depth int) {
+	prefix := strings.Repeat("> ", depth)
+	nodes, err := w.oneBot.GetForwardMsg(id)
+	if err != nil {
+		w.writeLine(prefix, fmt.Sprintf("[合并转发获取失败：%v]", err))
+		return
+	}
+
+	for _, node := range nodes {
+		nickname := node.Sender.Nickname
+		if len(nickname) == 0 {
+			nickname = fmt.Sprintf("%d", node.Sender.UserId)
+		}
+
+		text := ""
+		nested := []string{}
+		for _, s := range node.Segments() {
+			switch s := s.(type) {
+			case onebot.Forward:
+				text += "[合并转发]"
+				nested = append(nested, s.Id)
+			default:
+				text += segmentText(s)
+			}
+		}
+		// 多行消息只在第一行写昵称
+		for i, line := range strings.Split(strings.TrimSpace(text), "\n") {
+			if i == 0 {
+				w.writeLine(prefix, nickname+": "+line)
+			} else {
+				w.writeLine(prefix, "  "+line)
+			}
+		}
+
+		for _, nestedId := range nested {
+			if depth >= maxForwardDepth {
+				w.writeLine(prefix+"> ", "[嵌套过深，未展开]")
+				continue
+			}
+			w.write(nestedId, depth+1)
+		}
+		if w.full {
+			return
+		}
+	}
+}
+
+// 非文本的消息段用占位符表示
+func segmentText(s onebot.Segment) string {
+	switch s := s.(type) {
+	case onebot.Text:
+		return s.Text
+	case onebot.At:
+		return "@" + s.Qq + " "
+	case onebot.Reply:
+		return ""
+	case onebot.Image:
+		return "[图片]"
+	case onebot.Face:
+		return "[表情]"
+	case onebot.Record:
+		return "[语音]"
+	case onebot.Video:
+		return "[视频]"
+	case onebot.File:
+		return fmt.Sprintf("[文件 %s]", s.Name)
+	case onebot.Markdown:
+		return s.Content
+	default:
+		return fmt.Sprintf("[%s]", s.SegmentType())
+	}
+}
+
+// 被回复的消息中的合并转发，群里的合并转发不能同时 at bot，只能回复它再 at bot
+func (c Chatter) repliedForwards(replyTo int32) []onebot.Forward {
+	if c.OneBot == nil {
+		return nil
+	}
+	message, err := c.OneBot.GetMsg(replyTo)
+	if err != nil {
+		log.Printf("Failed to get replied message %d: %v", replyTo, err)
+		return nil
+	}
+	return message.Forwards()
+}
+
+// 用 get_forward_msg 取出合并转发的内容，展开成引用块，每条消息一行“昵称: 内容”
+func (c Chatter) flattenForwards(forwards []onebot.Forward) (string, error) {
+	if c.OneBot == nil {
+		return "", fmt.Errorf("onebot api is not available")
+	}
+
+	w := &forwardWriter{oneBot: c.OneBot}
+	for _, forward := range forwards {
+		w.writeLine("", "[合并转发]")
+		w.write(forward.Id, 1)
+		if w.full {
+			break
+		}
+	}
+	return strings.TrimSuffix(w.sb.String(), "\n"), nil
+}
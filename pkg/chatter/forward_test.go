@@ -0,0 +1,169 @@
+package chatter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/receiver"
+	"github.com/vaaandark/qabot/pkg/workqueue"
+)
+
+// 消息 77 是一条合并转发，78 是别人发的普通消息
+type fakeOneBot struct {
+	mu      sync.Mutex
+	actions []string
+}
+
+func (fo *fakeOneBot) Call(action string, params interface{}) (json.RawMessage, error) {
+	fo.mu.Lock()
+	fo.actions = append(fo.actions, action)
+	fo.mu.Unlock()
+
+	switch action {
+	case "get_msg":
+		switch params.(map[string]int32)["message_id"] {
+		case 77:
+			return json.RawMessage(`{"message":[{"type":"forward","data":{"id":"fw1"}}]}`), nil
+		case 78:
+			return json.RawMessage(`{"message":[{"type":"text","data":{"text":"just chatting"}}]}`), nil
+		}
+		return nil, fmt.Errorf("message not found")
+	case "send_private_msg", "send_group_msg":
+		return json.RawMessage(`{"message_id":1}`), nil
+	case "get_forward_msg":
+		return json.RawMessage(`{"messages":[
+			{"sender":{"user_id":5,"nickname":"Alice"},"message":[{"type":"text","data":{"text":"I am right"}}]},
+			{"sender":{"user_id":6,"nickname":"Bob"},"message":"No, I am right[CQ:face,id=1]"}
+		]}`), nil
+	}
+	return nil, fmt.Errorf("unexpected action %s", action)
+}
+
+const (
+	selfId        = 999
+	forwardQuoted = "[合并转发]\n> Alice: I am right\n> Bob: No, I am right[表情]"
+)
+
+func TestForwardPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		want    string
+		ignored bool
+	}{
+		{
+			name:  "private forward",
+			event: `{"post_type":"message","message_type":"private","self_id":999,"message_id":1,"user_id":1,"message":[{"type":"forward","data":{"id":"fw1"}}]}`,
+			want:  forwardQuoted,
+		},
+		{
+			name:  "group reply to forward with at",
+			event: `{"post_type":"message","message_type":"group","self_id":999,"message_id":2,"user_id":1,"group_id":100,"message":[{"type":"reply","data":{"id":"77"}},{"type":"at","data":{"qq":"999"}},{"type":"text","data":{"text":" who is right?"}}]}`,
+			want:  forwardQuoted + "\n\nwho is right?",
+		},
+		{
+			name:    "group reply to forward without at",
+			event:   `{"post_type":"message","message_type":"group","self_id":999,"message_id":3,"user_id":1,"group_id":100,"message":[{"type":"reply","data":{"id":"77"}},{"type":"text","data":{"text":"who is right?"}}]}`,
+			ignored: true,
+		},
+		{
+			// at bot 回复别人的普通消息和以前一样不回答
+			name:    "group reply to plain message with at",
+			event:   `{"post_type":"message","message_type":"group","self_id":999,"message_id":5,"user_id":1,"group_id":100,"message":[{"type":"reply","data":{"id":"78"}},{"type":"at","data":{"qq":"999"}},{"type":"text","data":{"text":" is this right?"}}]}`,
+			ignored: true,
+		},
+		{
+			name:    "group reply to unknown message with at",
+			event:   `{"post_type":"message","message_type":"group","self_id":999,"message_id":6,"user_id":1,"group_id":100,"message":[{"type":"reply","data":{"id":"79"}},{"type":"at","data":{"qq":"999"}},{"type":"text","data":{"text":" is this right?"}}]}`,
+			ignored: true,
+		},
+		{
+			name:    "group forward without at",
+			event:   `{"post_type":"message","message_type":"group","self_id":999,"message_id":4,"user_id":1,"group_id":100,"message":[{"type":"forward","data":{"id":"fw1"}}]}`,
+			ignored: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := &fakeProvider{t: t, responses: []string{answerResponse}}
+			server := httptest.NewServer(fp)
+			defer server.Close()
+
+			dir := t.TempDir()
+			whitelistPath := filepath.Join(dir, "whitelist.json")
+			if err := os.WriteFile(whitelistPath, []byte(`{"user_ids":[1],"group_ids":[100]}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			queue, err := workqueue.NewQueue(db, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receivedCh := make(chan messageenvelope.MessageEnvelope, 10)
+			toSendCh := make(chan messageenvelope.MessageEnvelope, 10)
+			intake, err := receiver.NewIntake(receivedCh, receiver.DropNewest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			providers := []providerconfig.ProviderConfig{
+				newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"]}`, server.URL)),
+			}
+			c, err := NewChatter(context.Background(), receivedCh, toSendCh, whitelistPath, newTestChatContext(t), providers, nil, preference.NewStore(db), nil, nil, tool.NewRegistry(), 5, nil, onebot.NewClient(&fakeOneBot{}), nil, queue, nil, nil, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			go c.Run(stopCh)
+
+			if err := receiver.NewReceiver(intake, "").HandleEvent([]byte(tt.event)); err != nil {
+				t.Fatal(err)
+			}
+
+			// worker 刚启动时可能会先收到排队的提示
+			var sent messageenvelope.MessageEnvelope
+			for sent.Category != onebot.CategoryChat {
+				select {
+				case sent = <-toSendCh:
+				case <-time.After(300 * time.Millisecond):
+					if !tt.ignored {
+						t.Fatal("no answer")
+					}
+					return
+				}
+			}
+			if tt.ignored {
+				t.Fatalf("unexpected answer %+v", sent)
+			}
+			if sent.Text != "done" {
+				t.Errorf("answer = %q", sent.Text)
+			}
+
+			fp.mu.Lock()
+			defer fp.mu.Unlock()
+			messages := fp.requests[0]["messages"].([]interface{})
+			question := messages[len(messages)-1].(map[string]interface{})["content"].(string)
+			if question != tt.want {
+				t.Errorf("question = %q, want %q", question, tt.want)
+			}
+		})
+	}
+}
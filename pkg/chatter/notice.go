@@ -0,0 +1,209 @@
+package chatter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+const (
+	handlerPoke    = "poke"
+	handlerWelcome = "welcome"
+	handlerRequest = "request"
+
+	defaultPokeReply      = "别戳啦！"
+	defaultPokePrompt     = "有人在聊天软件里戳了戳你，请用一句简短俏皮的话回应，不要超过 30 个字。"
+	defaultWelcomeMessage = "欢迎新朋友！有问题可以 at 我。"
+)
+
+type PokeConfig struct {
+	// 随机选一条作为回复
+	Replies []string `json:"replies,omitempty"`
+	// 不为空时用这个提供商生成回复，失败时使用 replies
+	Provider string `json:"provider,omitempty"`
+	Prompt   string `json:"prompt,omitempty"`
+}
+
+type WelcomeConfig struct {
+	// 发送时会先 at 新成员
+	Message string `json:"message,omitempty"`
+}
+
+type NoticeConfig struct {
+	Poke    PokeConfig    `json:"poke"`
+	Welcome WelcomeConfig `json:"welcome"`
+	// 默认启用的处理器：poke、welcome、request
+	Enabled []string `json:"enabled"`
+	// 按群覆盖默认启用的处理器，键是 group/<群号>
+	Groups map[string][]string `json:"groups,omitempty"`
+}
+
+// poke.provider 必须是 providers 中的提供商
+func LoadNoticeConfigFromFile(path string, providers []providerconfig.ProviderConfig) (*NoticeConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &NoticeConfig{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+
+	handlers := [][]string{config.Enabled}
+	for _, enabled := range config.Groups {
+		handlers = append(handlers, enabled)
+	}
+	for _, enabled := range handlers {
+		for _, handler := range enabled {
+			if handler != handlerPoke && handler != handlerWelcome && handler != handlerRequest {
+				return nil, fmt.Errorf("unknown notice handler %s", handler)
+			}
+		}
+	}
+
+	if len(config.Poke.Provider) != 0 {
+		found := false
+		for _, p := range providers {
+			if p.Name == config.Poke.Provider {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown poke provider %s", config.Poke.Provider)
+		}
+	}
+
+	if len(config.Poke.Replies) == 0 {
+		config.Poke.Replies = []string{defaultPokeReply}
+	}
+	if len(config.Poke.Prompt) == 0 {
+		config.Poke.Prompt = defaultPokePrompt
+	}
+	if len(config.Welcome.Message) == 0 {
+		config.Welcome.Message = defaultWelcomeMessage
+	}
+	return config, nil
+}
+
+// 用提供商生成戳一戳的回复时要花钱，需要和提问一样排队并计入额度
+func (nc *NoticeConfig) generatesPoke() bool {
+	return nc != nil && len(nc.Poke.Provider) != 0
+}
+
+// 私聊和没有单独配置的群使用默认设置
+func (nc *NoticeConfig) IsEnabled(handler string, groupId *int64) bool {
+	if nc == nil {
+		return false
+	}
+	enabled := nc.Enabled
+	if groupId != nil {
+		if groupEnabled, exist := nc.Groups[fmt.Sprintf("group/%d", *groupId)]; exist {
+			enabled = groupEnabled
+		}
+	}
+	for _, h := range enabled {
+		if h == handler {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Chatter) handleNotice(m messageenvelope.MessageEnvelope) {
+	if c.OneBot == nil {
+		return
+	}
+
+	var err error
+	switch m.Category {
+	case onebot.CategoryPoke:
+		if c.isWhitelisted(m) && c.Notice.IsEnabled(handlerPoke, m.GroupId) {
+			err = c.replyPoke(m)
+		}
+	case onebot.CategoryJoin:
+		if c.isWhitelisted(m) && c.Notice.IsEnabled(handlerWelcome, m.GroupId) {
+			err = c.sendNotice(m, c.Notice.Welcome.Message)
+		}
+	case onebot.CategoryFriendRequest:
+		if c.Notice.IsEnabled(handlerRequest, nil) {
+			err = c.approveRequest(m)
+		}
+	case onebot.CategoryGroupInvite:
+		if c.Notice.IsEnabled(handlerRequest, m.GroupId) {
+			err = c.approveRequest(m)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to handle %s notice from %s: %v", m.Category, m.GetNamespacedGroupOrUserID(), err)
+	}
+}
+
+func (c Chatter) isWhitelisted(m messageenvelope.MessageEnvelope) bool {
+	if m.IsInGroup() {
+		return c.WhitelistAdaptor.HasGroup(*m.GroupId)
+	}
+	return c.WhitelistAdaptor.HasUser(m.UserId)
+}
+
+func (c Chatter) replyPoke(m messageenvelope.MessageEnvelope) error {
+	config := c.Notice.Poke
+	reply := config.Replies[rand.Intn(len(config.Replies))]
+	if len(config.Provider) != 0 {
+		// 超出额度时不回复，免得被戳一戳刷屏
+		charge, ok := c.allowQuota(m)
+		if !ok {
+			return nil
+		}
+		generated, err := c.complete(config.Provider, []chatcontext.Message{
+			{Role: "system", Content: config.Prompt},
+			{Role: "user", Content: "（戳了戳你）"},
+		}, &m)
+		if err != nil {
+			log.Printf("Failed to generate poke reply with %s: %v", config.Provider, err)
+			c.refundQuota(m, charge)
+		} else {
+			reply = generated
+		}
+	}
+	return c.sendNotice(m, reply)
+}
+
+// 群里 at 触发通知的人，私聊直接发送
+func (c Chatter) sendNotice(m messageenvelope.MessageEnvelope, text string) error {
+	if m.IsInGroup() {
+		at := strconv.FormatInt(m.UserId, 10)
+		_, err := c.OneBot.SendMessage("send_group_msg", onebot.NewGroupMessage("", *m.GroupId, "", text, &at, nil))
+		return err
+	}
+	_, err := c.OneBot.SendMessage("send_private_msg", onebot.NewPrivateMessage("", m.UserId, "", text, nil))
+	return err
+}
+
+// 只同意白名单中的用户和群，其他请求留给管理员处理
+func (c Chatter) approveRequest(m messageenvelope.MessageEnvelope) error {
+	if m.Category == onebot.CategoryFriendRequest {
+		if !c.WhitelistAdaptor.HasUser(m.UserId) {
+			log.Printf("Ignore friend request from user/%d: not in whitelist", m.UserId)
+			return nil
+		}
+		log.Printf("Approve friend request from user/%d: %s", m.UserId, m.Text)
+		return c.OneBot.SetFriendAddRequest(m.Flag, true)
+	}
+
+	if m.GroupId == nil || !c.WhitelistAdaptor.HasGroup(*m.GroupId) {
+		log.Printf("Ignore group invite to %s from user/%d: not in whitelist", m.GetNamespacedGroupOrUserID(), m.UserId)
+		return nil
+	}
+	log.Printf("Approve group invite to group/%d from user/%d", *m.GroupId, m.UserId)
+	return c.OneBot.SetGroupAddRequest(m.Flag, "invite", true)
+}
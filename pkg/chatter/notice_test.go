@@ -0,0 +1,225 @@
+package chatter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
+	"github.com/vaaandark/qabot/pkg/chatter/whitelist"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/quota"
+	"github.com/vaaandark/qabot/pkg/usage"
+	"github.com/vaaandark/qabot/pkg/workqueue"
+)
+
+func TestLoadNoticeConfigValidatesPokeProvider(t *testing.T) {
+	providers := []providerconfig.ProviderConfig{{Name: "p"}}
+	tests := []struct {
+		config  string
+		wantErr bool
+	}{
+		{`{"enabled":["poke"]}`, false},
+		{`{"poke":{"provider":"p"},"enabled":["poke"]}`, false},
+		{`{"poke":{"provider":"missing"},"enabled":["poke"]}`, true},
+		{`{"enabled":["unknown"]}`, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "notice-config.json")
+		if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadNoticeConfigFromFile(path, providers)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func (fo *fakeOneBot) count(action string) int {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	n := 0
+	for _, a := range fo.actions {
+		if a == action {
+			n++
+		}
+	}
+	return n
+}
+
+func newQuotaWhitelist(t *testing.T, config string) *whitelist.Whitelist {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wa, err := whitelist.NewWhitelist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wa
+}
+
+// 生成的戳一戳回复和提问一样计入额度和用量，生成失败时退回次数并使用固定的回复
+func TestPokeReplyChargesQuota(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int64
+		wantReplies  int
+	}{
+		// 额度只有一次，后面的戳一戳不回复
+		{"generated", http.StatusOK, 1, 1},
+		// 每次都退回次数，所以每次都用固定的回复
+		{"generation failed", http.StatusBadRequest, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var generated atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				generated.Add(1)
+				if tt.status != http.StatusOK {
+					http.Error(w, "rejected", tt.status)
+					return
+				}
+				fmt.Fprint(w, answerResponse)
+			}))
+			defer server.Close()
+			db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			fo := &fakeOneBot{}
+			c := newToolChatter(t, 5)
+			c.WhitelistAdaptor = *newQuotaWhitelist(t, `{"user_ids":[1],"quotas":{"default":{"daily_requests":1}}}`)
+			c.Quota = quota.NewStore(db)
+			c.Usage = usage.NewStore(db)
+			c.OneBot = onebot.NewClient(fo)
+			c.Providers = []providerconfig.ProviderConfig{
+				newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"]}`, server.URL)),
+			}
+			c.Notice = &NoticeConfig{
+				Poke:    PokeConfig{Replies: []string{defaultPokeReply}, Provider: "p", Prompt: defaultPokePrompt},
+				Enabled: []string{handlerPoke},
+			}
+
+			m := messageenvelope.MessageEnvelope{UserId: 1, Category: onebot.CategoryPoke}
+			for i := 0; i < 3; i++ {
+				c.handleNotice(m)
+			}
+
+			if n := fo.count("send_private_msg"); n != tt.wantReplies {
+				t.Errorf("sent %d replies, want %d", n, tt.wantReplies)
+			}
+			quotaUsage, err := c.Quota.Usage(m.GetNamespacedUserID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quotaUsage.Requests != tt.wantRequests {
+				t.Errorf("quota requests = %d, want %d", quotaUsage.Requests, tt.wantRequests)
+			}
+			entries, err := c.Usage.Load(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var userRequests int64
+			for _, entry := range entries {
+				if entry.Id == m.GetNamespacedUserID() {
+					userRequests += entry.Requests
+				}
+			}
+			if userRequests != tt.wantRequests {
+				t.Errorf("usage requests of user = %d, want %d", userRequests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// 连续的戳一戳进入工作队列，同时生成回复的数量不超过 worker 数
+func TestPokeRepliesAreQueued(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, answerResponse)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	whitelistPath := filepath.Join(dir, "whitelist.json")
+	if err := os.WriteFile(whitelistPath, []byte(`{"user_ids":[1,2,3,4,5]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	queue, err := workqueue.NewQueue(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receivedCh := make(chan messageenvelope.MessageEnvelope, 10)
+	toSendCh := make(chan messageenvelope.MessageEnvelope, 10)
+	providers := []providerconfig.ProviderConfig{
+		newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"]}`, server.URL)),
+	}
+	notice := &NoticeConfig{
+		Poke:    PokeConfig{Replies: []string{defaultPokeReply}, Provider: "p", Prompt: defaultPokePrompt},
+		Enabled: []string{handlerPoke},
+	}
+	fo := &fakeOneBot{}
+	c, err := NewChatter(context.Background(), receivedCh, toSendCh, whitelistPath, newTestChatContext(t), providers, nil, preference.NewStore(db), nil, notice, tool.NewRegistry(), 5, nil, onebot.NewClient(fo), nil, queue, nil, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	for userId := int64(1); userId <= 5; userId++ {
+		receivedCh <- messageenvelope.MessageEnvelope{UserId: userId, Category: onebot.CategoryPoke}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fo.count("send_private_msg") < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d replies, want 5", fo.count("send_private_msg"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != 1 {
+		t.Errorf("%d poke replies generated at the same time, want 1", maxInFlight)
+	}
+	select {
+	case m := <-toSendCh:
+		t.Errorf("unexpected status reply %q", m.Text)
+	default:
+	}
+}
@@ -0,0 +1,81 @@
+package chatter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/workqueue"
+)
+
+// 放进队列，需要排队时告诉用户前面还有几个人
+func (c Chatter) enqueue(m messageenvelope.MessageEnvelope) {
+	_, done := c.startGeneration(m)
+	waiting, err := c.Queue.Push(m)
+	// 戳一戳不回复排队的提示，否则连续戳会刷屏
+	quiet := m.Category == onebot.CategoryPoke
+	if err != nil {
+		done()
+		if errors.Is(err, workqueue.ErrFull) {
+			log.Printf("Reject message %d from %s: queue is full", m.MessageId, m.GetNamespacedGroupOrUserID())
+			if !quiet {
+				c.replyStatus(m, "现在太忙了，请稍后再试")
+			}
+		} else {
+			log.Printf("Failed to enqueue message %d from %s: %v", m.MessageId, m.GetNamespacedGroupOrUserID(), err)
+		}
+		return
+	}
+	if waiting > 0 && !quiet {
+		log.Printf("Queue message %d from %s at #%d", m.MessageId, m.GetNamespacedGroupOrUserID(), waiting)
+		c.replyStatus(m, fmt.Sprintf("现在有点忙，你排在第 %d 位，请稍候", waiting))
+	}
+}
+
+func (c Chatter) work() {
+	for {
+		task, ok := c.Queue.Pop()
+		if !ok {
+			return
+		}
+		m := task.Message
+		ctx, done := c.startGeneration(m)
+		// 排队时被撤回了
+		if !isRecalled(ctx) {
+			c.doChat(ctx, m)
+		}
+		done()
+		c.Queue.Done(task)
+	}
+}
+
+// 最多积压这么多条提示，再多就丢掉
+const statusBuffer = 64
+
+// 当作命令的输出回复，不写入上下文。Run 里也会调用，所以不能阻塞
+func (c Chatter) replyStatus(m messageenvelope.MessageEnvelope, text string) {
+	m.Category = onebot.CategoryCmd
+	m.Text = text
+	select {
+	case c.statusCh <- m:
+	default:
+		log.Printf("Drop status reply to %s: %s", m.GetNamespacedGroupOrUserID(), text)
+	}
+}
+
+func (c Chatter) forwardStatus(stopCh <-chan struct{}) {
+	for {
+		select {
+		case m := <-c.statusCh:
+			select {
+			case c.ToSendMessageCh <- m:
+			case <-stopCh:
+				return
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package chatter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+)
+
+// 没有人发送时提示也不能阻塞，积压满了就丢掉
+func TestReplyStatusDoesNotBlock(t *testing.T) {
+	c := Chatter{
+		ToSendMessageCh: make(chan messageenvelope.MessageEnvelope),
+		statusCh:        make(chan messageenvelope.MessageEnvelope, statusBuffer),
+	}
+	m := messageenvelope.MessageEnvelope{UserId: 1}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < statusBuffer+10; i++ {
+			c.replyStatus(m, "busy")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("replyStatus blocked")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.forwardStatus(stopCh)
+	for i := 0; i < statusBuffer; i++ {
+		select {
+		case sent := <-c.ToSendMessageCh:
+			if sent.Text != "busy" || sent.Category != onebot.CategoryCmd {
+				t.Fatalf("sent = %+v", sent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d status replies, want %d", i, statusBuffer)
+		}
+	}
+	select {
+	case sent := <-c.ToSendMessageCh:
+		t.Errorf("unexpected reply %+v", sent)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,84 @@
+package chatter
+
+import (
+	"errors"
+	"log"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/quota"
+)
+
+func (c Chatter) quotaSubjects(m messageenvelope.MessageEnvelope) []quota.Subject {
+	subjects := []quota.Subject{{
+		Id:    m.GetNamespacedUserID(),
+		Limit: c.WhitelistAdaptor.Limit(m.GetNamespacedUserID()),
+	}}
+	if m.IsInGroup() {
+		subjects = append(subjects, quota.Subject{
+			Id:    m.GetNamespacedGroupOrUserID(),
+			Limit: c.WhitelistAdaptor.Limit(m.GetNamespacedGroupOrUserID()),
+		})
+	}
+	return subjects
+}
+
+// 超过限额时返回 false，并且礼貌地提醒一次；占用了次数时返回占用记录，退还时要用
+func (c Chatter) allowQuota(m messageenvelope.MessageEnvelope) (*quota.Charge, bool) {
+	if c.Quota == nil {
+		return nil, true
+	}
+
+	charge, subject, err := c.Quota.Allow(c.quotaSubjects(m)...)
+	if err == nil {
+		return charge, true
+	}
+	if subject == nil {
+		// 数据库出错时不影响回答
+		log.Printf("Failed to check quota for %s: %v", m.GetNamespacedUserID(), err)
+		return nil, true
+	}
+
+	log.Printf("Reject message %d from %s: %s %v", m.MessageId, m.GetNamespacedUserID(), subject.Id, err)
+	if !c.Quota.ShouldNotify(*subject, err) {
+		return nil, false
+	}
+	text := "今天的提问次数已经用完了，明天再来吧"
+	if errors.Is(err, quota.ErrRateLimited) {
+		text = "提问太频繁了，请稍后再试"
+	} else if errors.Is(err, quota.ErrDailyTokens) {
+		text = "今天的额度已经用完了，明天再来吧"
+	}
+	if m.IsInGroup() && subject.Id == m.GetNamespacedGroupOrUserID() {
+		text = "本群" + text
+	}
+	c.replyStatus(m, text)
+	return nil, false
+}
+
+// 转写失败、所有服务商都失败或者回答之前被撤回时不占用次数，退还到占用的那一天
+func (c Chatter) refundQuota(m messageenvelope.MessageEnvelope, charge *quota.Charge) {
+	if c.Quota == nil || charge == nil {
+		return
+	}
+	if err := c.Quota.Refund(*charge); err != nil {
+		log.Printf("Failed to refund quota of %s: %v", m.GetNamespacedUserID(), err)
+	}
+}
+
+// 服务商没有返回用量时按估算的 token 数计入额度，提示词和上下文也算在内
+func (c Chatter) recordTokens(m messageenvelope.MessageEnvelope, messages []chatcontext.Message, answer string) {
+	if c.Quota == nil {
+		return
+	}
+
+	tokens := int64(chatcontext.EstimateMessagesTokens(messages) + chatcontext.EstimateTokens(answer))
+	if m.Usage != nil {
+		tokens = m.Usage.TotalTokens()
+	}
+	for _, subject := range c.quotaSubjects(m) {
+		if err := c.Quota.AddTokens(subject.Id, tokens); err != nil {
+			log.Printf("Failed to record tokens for %s: %v", subject.Id, err)
+		}
+	}
+}
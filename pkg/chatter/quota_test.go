@@ -0,0 +1,74 @@
+package chatter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/chatter/whitelist"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/quota"
+)
+
+func TestQuotaChargedOnlyWhenAnswered(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int64
+	}{
+		{"answered", http.StatusOK, 1},
+		{"all providers failed", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != http.StatusOK {
+					http.Error(w, "rejected", tt.status)
+					return
+				}
+				fmt.Fprint(w, answerResponse)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			whitelistPath := filepath.Join(dir, "whitelist.json")
+			if err := os.WriteFile(whitelistPath, []byte(`{"user_ids":[1],"quotas":{"default":{"daily_requests":10}}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wa, err := whitelist.NewWhitelist(whitelistPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := leveldb.OpenFile(filepath.Join(dir, "quota"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			c := newToolChatter(t, 5)
+			c.ChatContext = newTestChatContext(t)
+			c.WhitelistAdaptor = *wa
+			c.Quota = quota.NewStore(db)
+			c.Providers = []providerconfig.ProviderConfig{
+				newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"]}`, server.URL)),
+			}
+			m := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 1, Text: "q", Category: onebot.CategoryChat}
+			c.chatWithLlm(context.Background(), m)
+
+			usage, err := c.Quota.Usage(m.GetNamespacedUserID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", usage.Requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package chatter
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+)
+
+var errRecalled = errors.New("message is recalled")
+
+func generationKey(m messageenvelope.MessageEnvelope) string {
+	return string(chatcontext.NewContextNodeKey(&m.UserId, m.GroupId, m.MessageId).Key())
+}
+
+type generation struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// 消息从入队到处理完都可以取消，消息被撤回时用来停止生成。
+// 入队时和开始处理时都会调用，后一次拿到的是同一个 context
+func (c Chatter) startGeneration(m messageenvelope.MessageEnvelope) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	g := &generation{ctx: ctx, cancel: cancel}
+	key := generationKey(m)
+	if actual, loaded := c.generating.LoadOrStore(key, g); loaded {
+		cancel(nil)
+		g = actual.(*generation)
+	}
+	return g.ctx, func() {
+		c.generating.Delete(key)
+		g.cancel(nil)
+	}
+}
+
+func isRecalled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRecalled)
+}
+
+func (c Chatter) recall(m messageenvelope.MessageEnvelope) {
+	key := generationKey(m)
+	if c.Queue.Remove(m.GetNamespacedGroupOrUserID(), m.MessageId) {
+		// 还没开始处理，不会有 worker 来清理
+		log.Printf("Remove recalled message %d from %s from queue", m.MessageId, m.GetNamespacedGroupOrUserID())
+		if g, ok := c.generating.LoadAndDelete(key); ok {
+			g.(*generation).cancel(errRecalled)
+		}
+	} else if g, ok := c.generating.Load(key); ok {
+		log.Printf("Stop answering recalled message %d from %s", m.MessageId, m.GetNamespacedGroupOrUserID())
+		g.(*generation).cancel(errRecalled)
+	}
+
+	if c.ChatContext == nil {
+		return
+	}
+	if err := c.ChatContext.SetRecalled(&m.UserId, m.GroupId, m.MessageId); err != nil {
+		log.Printf("Failed to mark message %d as recalled: %v", m.MessageId, err)
+	}
+}
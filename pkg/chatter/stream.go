@@ -0,0 +1,188 @@
+package chatter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+)
+
+const (
+	thinkEndLabel = "</think>"
+	codeFence     = "```"
+	// 每段至少这么长才发送，避免一句一条刷屏
+	minStreamPieceLen = 200
+	maxSseLineLen     = 1024 * 1024
+)
+
+// 读取 OpenAI 风格的 SSE 流，每收到一段增量就回调一次，结束后返回拼接好的完整消息和用量
+func readStream(body io.Reader, onDelta func(reasoning, content string)) (*chatcontext.Message, *chatcontext.Usage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSseLineLen)
+
+	message := chatcontext.Message{Role: "assistant"}
+	var reasoning, content strings.Builder
+	toolCalls := []chatcontext.ToolCall{}
+	var usage *chatcontext.Usage
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		chunk := CompletionChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal stream chunk: %w", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.GetUsage()
+		}
+		delta := chunk.GetDelta()
+		if delta == nil {
+			continue
+		}
+		if len(delta.Role) != 0 {
+			message.Role = delta.Role
+		}
+		for _, call := range delta.ToolCalls {
+			toolCalls = mergeToolCallDelta(toolCalls, call)
+		}
+		if len(delta.ReasoningContent) != 0 {
+			reasoning.WriteString(delta.ReasoningContent)
+		}
+		if len(delta.Content) != 0 {
+			content.WriteString(delta.Content)
+			onDelta(reasoning.String(), content.String())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, usage, err
+	}
+
+	message.ReasoningContent = reasoning.String()
+	message.Content = content.String()
+	if len(toolCalls) != 0 {
+		message.ToolCalls = toolCalls
+	}
+	return &message, usage, nil
+}
+
+// 工具调用在流里按 index 分成很多段，参数需要拼起来
+func mergeToolCallDelta(toolCalls []chatcontext.ToolCall, delta chatcontext.ToolCall) []chatcontext.ToolCall {
+	index := len(toolCalls)
+	if delta.Index != nil {
+		index = *delta.Index
+	} else if len(delta.Id) == 0 && index > 0 {
+		// 没有 index 也没有 id，只能当作上一个调用的后续
+		index--
+	}
+	for len(toolCalls) <= index {
+		toolCalls = append(toolCalls, chatcontext.ToolCall{})
+	}
+
+	call := &toolCalls[index]
+	if len(delta.Id) != 0 {
+		call.Id = delta.Id
+	}
+	if len(delta.Type) != 0 {
+		call.Type = delta.Type
+	}
+	if len(call.Function.Name) == 0 {
+		call.Function.Name = delta.Function.Name
+	}
+	call.Function.Arguments += delta.Function.Arguments
+	return toolCalls
+}
+
+// 把流式输出按段落切开，只有完整的段落才会被发出去
+type streamSplitter struct {
+	// 提示词里追加了 <think>，输出里只会有 </think>
+	reasoning bool
+	sent      int
+	count     int
+	think     string
+}
+
+func newStreamSplitter(reasoning bool) *streamSplitter {
+	return &streamSplitter{reasoning: reasoning}
+}
+
+func (ss *streamSplitter) splitAnswer(content string) (think string, answer string, ok bool) {
+	if before, after, found := strings.Cut(content, thinkEndLabel); found {
+		return strings.TrimPrefix(strings.TrimSpace(before), "<think>"), after, true
+	}
+	// 思考还没结束
+	if ss.reasoning || strings.HasPrefix(strings.TrimSpace(content), "<think>") {
+		return "", "", false
+	}
+	return "", content, true
+}
+
+// 返回可以发送的下一段，第一段会带上思考过程
+func (ss *streamSplitter) Next(content string) (string, bool) {
+	think, answer, ok := ss.splitAnswer(content)
+	if !ok {
+		return "", false
+	}
+	ss.think = think
+
+	pending := answer[ss.sent:]
+	end := -1
+	for idx := strings.LastIndex(pending, "\n\n"); idx > 0; idx = strings.LastIndex(pending[:idx], "\n\n") {
+		// 不在代码块中间断开
+		if strings.Count(answer[:ss.sent+idx], codeFence)%2 == 0 {
+			end = idx
+			break
+		}
+	}
+	if end < minStreamPieceLen {
+		return "", false
+	}
+
+	piece := strings.TrimSpace(pending[:end])
+	ss.sent += end
+	if len(piece) == 0 {
+		return "", false
+	}
+	return ss.withThink(piece), true
+}
+
+// 流结束后剩下还没发出去的部分
+func (ss *streamSplitter) Rest(content string) string {
+	_, answer, ok := ss.splitAnswer(content)
+	if !ok {
+		// 没等到 </think>，整体当作回答
+		answer = content
+	}
+	if ss.sent > len(answer) {
+		return ""
+	}
+	rest := strings.TrimSpace(answer[ss.sent:])
+	if len(rest) == 0 {
+		return ""
+	}
+	return ss.withThink(rest)
+}
+
+func (ss *streamSplitter) withThink(piece string) string {
+	defer func() { ss.count++ }()
+	if ss.count == 0 && len(ss.think) != 0 {
+		return ss.think + thinkEndLabel + piece
+	}
+	return piece
+}
+
+func (ss *streamSplitter) HasSent() bool {
+	return ss.count > 0
+}
+
+func (ss *streamSplitter) Count() int {
+	return ss.count
+}
@@ -0,0 +1,113 @@
+package chatter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStreamSplitter(t *testing.T) {
+	long := strings.Repeat("a", minStreamPieceLen)
+	code := "```\n" + long + "\n\nstill code\n```"
+	tests := []struct {
+		name      string
+		reasoning bool
+		// 依次收到的完整内容，最后一个是流结束时的内容
+		contents []string
+		want     []string
+	}{
+		{
+			name:     "short answer",
+			contents: []string{"hello", "hello\n\nworld"},
+			want:     []string{"hello\n\nworld"},
+		},
+		{
+			name:     "split at paragraphs",
+			contents: []string{long + "\n\nb", long + "\n\nb\n\n" + long + "\n\nc"},
+			want:     []string{long, "b\n\n" + long, "c"},
+		},
+		{
+			name:     "piece too short",
+			contents: []string{"a\n\nb", "a\n\nb\n\nc"},
+			want:     []string{"a\n\nb\n\nc"},
+		},
+		{
+			name:     "not inside code block",
+			contents: []string{code, code + "\n\nafter"},
+			want:     []string{code, "after"},
+		},
+		{
+			name:      "wait for end of thinking",
+			reasoning: true,
+			contents:  []string{long + "\n\nthinking", long + "\n\nthinking</think>" + long + "\n\nrest"},
+			want:      []string{long + "\n\nthinking</think>" + long, "rest"},
+		},
+		{
+			name:      "thinking never ends",
+			reasoning: true,
+			contents:  []string{long + "\n\nthinking"},
+			want:      []string{long + "\n\nthinking"},
+		},
+		{
+			name:     "think tag in content",
+			contents: []string{"<think>hmm", "<think>hmm</think>\n\nanswer"},
+			want:     []string{"hmm</think>answer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := newStreamSplitter(tt.reasoning)
+			got := []string{}
+			for _, content := range tt.contents {
+				for {
+					piece, ok := ss.Next(content)
+					if !ok {
+						break
+					}
+					got = append(got, piece)
+				}
+			}
+			if rest := ss.Rest(tt.contents[len(tt.contents)-1]); len(rest) != 0 {
+				got = append(got, rest)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("pieces = %q, want %q", got, tt.want)
+			}
+			if ss.Count() != len(tt.want) {
+				t.Errorf("count = %d, want %d", ss.Count(), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"choices":[{"delta":{"role":"assistant","reasoning_content":"think"}}]}`,
+		`: keep-alive`,
+		`data: {"choices":[{"delta":{"content":"hel"}}]}`,
+		`data: {"choices":[{"delta":{"content":"lo"}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"echo","arguments":"{\"x\""}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]}}]}`,
+		`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":5}}`,
+		`data: [DONE]`,
+	}, "\n\n")
+
+	deltas := []string{}
+	message, usage, err := readStream(strings.NewReader(body), func(reasoning, content string) {
+		deltas = append(deltas, reasoning+"|"+content)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"think|hel", "think|hello"}; !equalStrings(deltas, want) {
+		t.Errorf("deltas = %q, want %q", deltas, want)
+	}
+	if message.Content != "hello" || message.ReasoningContent != "think" {
+		t.Errorf("message = %+v", message)
+	}
+	if len(message.ToolCalls) != 1 || message.ToolCalls[0].Function.Arguments != `{"x":1}` || message.ToolCalls[0].Function.Name != "echo" {
+		t.Errorf("tool calls = %+v", message.ToolCalls)
+	}
+	if usage == nil || usage.PromptTokens != 3 || usage.CompletionTokens != 5 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
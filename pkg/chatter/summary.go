@@ -0,0 +1,171 @@
+package chatter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+const (
+	defaultSummaryKeepLatest = 6
+	defaultSummaryPrompt     = "你是一个对话摘要助手。请把下面的对话压缩成一段简洁的摘要，" +
+		"保留关键事实、结论、未解决的问题以及用户的偏好，不要添加对话中没有的内容，不超过 500 字。"
+)
+
+type SummaryConfig struct {
+	// 用来生成摘要的提供商名字，最好是便宜快速的模型
+	Provider string `json:"provider"`
+	// 回复链上（上次摘要之后）的消息超过这么多条就生成新摘要
+	Threshold int `json:"threshold"`
+	// 最近的这么多条消息不参与摘要，原样保留
+	KeepLatest int    `json:"keep_latest,omitempty"`
+	Prompt     string `json:"prompt,omitempty"`
+}
+
+func LoadSummaryConfigFromFile(path string) (*SummaryConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &SummaryConfig{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	if config.Threshold <= 0 {
+		return nil, fmt.Errorf("summary threshold must be positive")
+	}
+	if config.KeepLatest <= 0 {
+		config.KeepLatest = defaultSummaryKeepLatest
+	}
+	if config.KeepLatest >= config.Threshold {
+		return nil, fmt.Errorf("summary keep_latest must be less than threshold")
+	}
+	if len(config.Prompt) == 0 {
+		config.Prompt = defaultSummaryPrompt
+	}
+	return config, nil
+}
+
+func roleName(role string) string {
+	switch role {
+	case "user":
+		return "用户"
+	case "assistant":
+		return "助手"
+	default:
+		return role
+	}
+}
+
+// 回复链太长时把较早的消息连同上一次的摘要一起压缩成新的摘要，挂在最后一条被压缩的消息上
+func (c Chatter) maybeSummarize(m messageenvelope.MessageEnvelope) {
+	if c.Summary == nil || c.ChatContext == nil {
+		return
+	}
+
+	nodes, previous, err := c.ChatContext.LoadContextNodes(&m.UserId, m.GroupId, m.MessageId)
+	if err != nil {
+		log.Printf("Failed to load context nodes for summary: %v", err)
+		return
+	}
+	if len(nodes) <= c.Summary.Threshold {
+		return
+	}
+
+	// 保证剩下的消息从用户的提问开始
+	end := len(nodes) - c.Summary.KeepLatest
+	for end > 0 && nodes[end].Message.Role != "user" {
+		end--
+	}
+	if end <= 0 {
+		return
+	}
+	boundary := nodes[end-1]
+
+	key := string(chatcontext.NewContextNodeKey(&m.UserId, m.GroupId, boundary.MessageId).Key())
+	if _, loaded := c.summarizing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	defer c.summarizing.Delete(key)
+
+	var sb strings.Builder
+	if previous != nil {
+		sb.WriteString(fmt.Sprintf("之前的摘要：\n%s\n\n", previous.Summary))
+	}
+	sb.WriteString("对话：\n")
+	for _, node := range nodes[:end] {
+		sb.WriteString(fmt.Sprintf("%s：%s\n", roleName(node.Message.Role), node.Message.Content))
+	}
+
+	summary, err := c.summarize(sb.String())
+	if err != nil {
+		log.Printf("Failed to summarize %s: %v", key, err)
+		return
+	}
+	if err := c.ChatContext.SetSummary(&m.UserId, m.GroupId, boundary.MessageId, summary); err != nil {
+		log.Printf("Failed to save summary %s: %v", key, err)
+		return
+	}
+	log.Printf("Summarized %d messages of %s", end, key)
+}
+
+func (c Chatter) summarize(text string) (string, error) {
+	return c.complete(c.Summary.Provider, []chatcontext.Message{
+		{Role: "system", Content: c.Summary.Prompt},
+		{Role: "user", Content: text},
+	}, nil)
+}
+
+// 用指定的提供商做一次不带上下文的非流式请求，只返回回答部分。
+// asker 不为 nil 时用量计入触发请求的用户和群，否则只计入提供商
+func (c Chatter) complete(providerName string, messages []chatcontext.Message, asker *messageenvelope.MessageEnvelope) (string, error) {
+	var provider *providerconfig.ProviderConfig
+	for i := range c.Providers {
+		if c.Providers[i].Name == providerName {
+			provider = &c.Providers[i]
+			break
+		}
+	}
+	if provider == nil {
+		return "", fmt.Errorf("provider %s does not exist", providerName)
+	}
+
+	p := *provider
+	p.Stream = false
+
+	ctx, cancel := context.WithTimeout(c.ctx, p.Failover.Timeout())
+	defer cancel()
+
+	message, usage, err := c.doPost(ctx, messages, &p, nil, "", func(string, string) {})
+	if asker != nil && err == nil && message != nil {
+		m := *asker
+		m.Usage = priceUsage(p, usage)
+		c.recordUsage(p, m, messages, message.Content)
+	} else {
+		// 摘要不是某个用户的提问，只计入提供商
+		c.recordProviderUsage(p, usage)
+	}
+	if err != nil {
+		return "", err
+	} else if message == nil {
+		return "", ErrEmptyMessage
+	}
+
+	content := message.Content
+	if _, after, found := strings.Cut(content, thinkEndLabel); found {
+		content = after
+	}
+	content = strings.TrimSpace(content)
+	if len(content) == 0 {
+		return "", ErrEmptyMessage
+	}
+	return content, nil
+}
@@ -0,0 +1,117 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var currentTimeParameters = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"timezone": {
+			"type": "string",
+			"description": "IANA 时区名，例如 Asia/Shanghai、America/New_York，不填使用默认时区"
+		}
+	}
+}`)
+
+var weekdays = []string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"}
+
+func NewCurrentTimeTool(defaultLocation *time.Location) Tool {
+	return Tool{
+		Name:        "current_time",
+		Description: "获取当前的日期、时间和星期。回答任何和今天、现在、日期、星期、倒计时有关的问题前都应该调用它。",
+		Parameters:  currentTimeParameters,
+		Handler: func(_ context.Context, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Timezone string `json:"timezone"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", err
+			}
+			location := defaultLocation
+			if len(args.Timezone) != 0 {
+				l, err := time.LoadLocation(args.Timezone)
+				if err != nil {
+					return "", fmt.Errorf("unknown timezone %s", args.Timezone)
+				}
+				location = l
+			}
+			now := time.Now().In(location)
+			return fmt.Sprintf("%s %s（%s）", now.Format("2006-01-02 15:04:05 -07:00"), weekdays[now.Weekday()], location.String()), nil
+		},
+	}
+}
+
+type BuiltinConfig struct {
+	// 启用的内置工具，为空时全部启用
+	Enabled  []string `json:"enabled,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+	// 1 单位该货币值多少 currency_base，例如 {"USD": 7.2}
+	CurrencyRates map[string]float64 `json:"currency_rates,omitempty"`
+	CurrencyBase  string             `json:"currency_base,omitempty"`
+	RatesUpdated  string             `json:"rates_updated,omitempty"`
+}
+
+func LoadBuiltinConfigFromFile(path string) (*BuiltinConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &BuiltinConfig{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func RegisterBuiltins(r *Registry, config BuiltinConfig) error {
+	location := time.Local
+	if len(config.Timezone) != 0 {
+		l, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return err
+		}
+		location = l
+	}
+
+	rates := make(map[string]float64)
+	for code, rate := range config.CurrencyRates {
+		rates[strings.ToUpper(code)] = rate
+	}
+	base := strings.ToUpper(config.CurrencyBase)
+	if len(base) == 0 {
+		base = "CNY"
+	}
+
+	builtins := []Tool{
+		NewCurrentTimeTool(location),
+		NewCalculatorTool(),
+		UnitConverter{
+			CurrencyRates: rates,
+			CurrencyBase:  base,
+			RatesUpdated:  config.RatesUpdated,
+		}.Tool(),
+	}
+
+	enabled := make(map[string]struct{})
+	for _, name := range config.Enabled {
+		enabled[name] = struct{}{}
+	}
+	for _, t := range builtins {
+		if len(enabled) != 0 {
+			if _, exist := enabled[t.Name]; !exist {
+				continue
+			}
+		}
+		if err := r.Register(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxExpressionLen = 1000
+	// 避免 2^99999999 这种算不完的表达式
+	maxExponent   = 10000
+	maxResultBits = 1 << 20
+	// 非整数结果显示的小数位数
+	decimalDigits = 20
+)
+
+var calculatorParameters = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"expression": {
+			"type": "string",
+			"description": "算术表达式，支持 + - * / % ^（整数次幂）和括号，例如 (1.5 + 2) * 3 ^ 2 / 7"
+		}
+	},
+	"required": ["expression"]
+}`)
+
+func NewCalculatorTool() Tool {
+	return Tool{
+		Name:        "calculator",
+		Description: "精确计算算术表达式（有理数运算，没有浮点误差）。需要做任何数学计算时都应该调用它，而不是自己心算。",
+		Parameters:  calculatorParameters,
+		Handler: func(_ context.Context, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Expression string `json:"expression"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", err
+			}
+			result, err := Evaluate(args.Expression)
+			if err != nil {
+				return "", err
+			}
+			return FormatRat(result), nil
+		},
+	}
+}
+
+// 整数直接输出，其他的输出分数和小数
+func FormatRat(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	decimal := strings.TrimRight(r.FloatString(decimalDigits), "0")
+	return fmt.Sprintf("%s ≈ %s", r.String(), decimal)
+}
+
+func Evaluate(expression string) (*big.Rat, error) {
+	if len(expression) > maxExpressionLen {
+		return nil, fmt.Errorf("expression is too long")
+	}
+	p := &exprParser{input: []rune(expression)}
+	result, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at %d", string(p.input[p.pos]), p.pos)
+	}
+	return result, nil
+}
+
+// 递归下降解析：expr = term {(+|-) term}，term = factor {(*|/|%) factor}，
+// factor = unary [^ factor]，unary = [-|+] unary | primary
+type exprParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() rune {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	switch r := p.input[p.pos]; r {
+	// 模型偶尔会用全角或数学符号
+	case '×':
+		return '*'
+	case '÷':
+		return '/'
+	case '（':
+		return '('
+	case '）':
+		return ')'
+	case '−':
+		return '-'
+	default:
+		return r
+	}
+}
+
+func (p *exprParser) parseExpr() (*big.Rat, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if op == '+' {
+			left = new(big.Rat).Add(left, right)
+		} else {
+			left = new(big.Rat).Sub(left, right)
+		}
+	}
+}
+
+func (p *exprParser) parseTerm() (*big.Rat, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case '*':
+			left = new(big.Rat).Mul(left, right)
+		case '/':
+			if right.Sign() == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			left = new(big.Rat).Quo(left, right)
+		case '%':
+			if !left.IsInt() || !right.IsInt() {
+				return nil, fmt.Errorf("modulo requires integers")
+			}
+			if right.Sign() == 0 {
+				return nil, fmt.Errorf("modulo by zero")
+			}
+			left = new(big.Rat).SetInt(new(big.Int).Rem(left.Num(), right.Num()))
+		}
+	}
+}
+
+func (p *exprParser) parseFactor() (*big.Rat, error) {
+	base, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	// 右结合
+	exponent, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	return pow(base, exponent)
+}
+
+func pow(base, exponent *big.Rat) (*big.Rat, error) {
+	if !exponent.IsInt() {
+		return nil, fmt.Errorf("only integer exponents are supported")
+	}
+	e := exponent.Num()
+	if e.CmpAbs(big.NewInt(maxExponent)) > 0 {
+		return nil, fmt.Errorf("exponent is too large")
+	}
+	n := e.Int64()
+	if n < 0 {
+		if base.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		base = new(big.Rat).Inv(base)
+		n = -n
+	}
+	if int64(base.Num().BitLen()+base.Denom().BitLen())*n > maxResultBits {
+		return nil, fmt.Errorf("result is too large")
+	}
+	num := new(big.Int).Exp(base.Num(), big.NewInt(n), nil)
+	denom := new(big.Int).Exp(base.Denom(), big.NewInt(n), nil)
+	return new(big.Rat).SetFrac(num, denom), nil
+}
+
+func (p *exprParser) parseUnary() (*big.Rat, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Rat).Neg(v), nil
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	default:
+		return p.parsePrimary()
+	}
+}
+
+func (p *exprParser) parsePrimary() (*big.Rat, error) {
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.' || p.input[p.pos] == '_' || p.input[p.pos] == ',') {
+		p.pos++
+	}
+	// 科学计数法
+	if p.pos < len(p.input) && p.pos > start && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		p.pos++
+		expStart := p.pos
+		if p.pos < len(p.input) && (p.input[p.pos] == '+' || p.input[p.pos] == '-') {
+			p.pos++
+		}
+		for p.pos < len(p.input) && unicode.IsDigit(p.input[p.pos]) {
+			p.pos++
+		}
+		if e, err := strconv.Atoi(string(p.input[expStart:p.pos])); err != nil || e > maxExponent || e < -maxExponent {
+			return nil, fmt.Errorf("invalid exponent in number")
+		}
+	}
+	if start == p.pos {
+		if p.pos >= len(p.input) {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at %d", string(p.input[p.pos]), p.pos)
+	}
+
+	literal, err := stripSeparators(string(p.input[start:p.pos]))
+	if err != nil {
+		return nil, err
+	}
+	v, ok := new(big.Rat).SetString(literal)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", literal)
+	}
+	return v, nil
+}
+
+// 去掉数字里的分隔符。逗号只能用作千分位（1,000,000），否则 1,5 这种
+// 小数逗号会被悄悄当成 15；下划线只能出现在两个数字之间
+func stripSeparators(literal string) (string, error) {
+	mantissa, exponent := literal, ""
+	if i := strings.IndexAny(literal, "eE"); i >= 0 {
+		mantissa, exponent = literal[:i], literal[i:]
+	}
+	integer, fraction, hasPoint := strings.Cut(mantissa, ".")
+	if strings.Contains(fraction, ",") {
+		return "", fmt.Errorf("invalid number %q: comma in fractional part", literal)
+	}
+	if strings.Contains(integer, ",") {
+		groups := strings.Split(integer, ",")
+		for i, group := range groups {
+			digits := len(strings.ReplaceAll(group, "_", ""))
+			if strings.Contains(group, "_") || digits == 0 || digits > 3 || (i > 0 && digits != 3) {
+				return "", fmt.Errorf("invalid number %q: commas must group digits by thousands", literal)
+			}
+		}
+		integer = strings.Join(groups, "")
+	}
+	for _, part := range []string{integer, fraction} {
+		if strings.HasPrefix(part, "_") || strings.HasSuffix(part, "_") || strings.Contains(part, "__") {
+			return "", fmt.Errorf("invalid number %q: underscore must separate digits", literal)
+		}
+	}
+	mantissa = strings.ReplaceAll(integer, "_", "")
+	if hasPoint {
+		mantissa += "." + strings.ReplaceAll(fraction, "_", "")
+	}
+	return mantissa + exponent, nil
+}
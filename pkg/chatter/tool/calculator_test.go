@@ -0,0 +1,87 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1.5 + 2) * 3 ^ 2 / 7", "9/2 ≈ 4.5"},
+		{"2 ^ 3 ^ 2", "512"},
+		{"-2 ^ 2", "4"},
+		{"2 ^ -2", "1/4 ≈ 0.25"},
+		{"7 % 3", "1"},
+		{"0.1 + 0.2", "3/10 ≈ 0.3"},
+		{"1 / 3", "1/3 ≈ 0.33333333333333333333"},
+		{"3 × 4 ÷ 2 − 1", "5"},
+		{"（1 + 1）* 2", "4"},
+		{"1.5e3 + 1", "1501"},
+		{"1,000 + 1", "1001"},
+		{"1,234,567.5 * 2", "2469135"},
+		{"1_000_000 / 1_000", "1000"},
+		{"12,345", "12345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			result, err := Evaluate(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := FormatRat(result); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 / 0",
+		"1 % 0",
+		"1.5 % 1",
+		"2 ^ 0.5",
+		"2 ^ 100000",
+		"1e99999",
+		"abc",
+		// 小数逗号不能被当成千分位
+		"1,5",
+		"1,50",
+		"1,0000",
+		",100",
+		"100,",
+		"1,,000",
+		"1.000,5",
+		"1,000.000,5",
+		"1_,000",
+		"_1",
+		"1__0",
+		"1_.5",
+	}
+	for _, expression := range tests {
+		t.Run(expression, func(t *testing.T) {
+			if result, err := Evaluate(expression); err == nil {
+				t.Errorf("expected error, got %s", FormatRat(result))
+			}
+		})
+	}
+}
+
+func TestCalculatorTool(t *testing.T) {
+	output, err := NewCalculatorTool().Handler(context.Background(), json.RawMessage(`{"expression":"2 * 21"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "42" {
+		t.Errorf("got %s, want 42", output)
+	}
+}
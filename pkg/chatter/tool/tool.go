@@ -0,0 +1,138 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/util"
+)
+
+// 参数是模型给出的 JSON，返回值原样作为 tool 消息交给模型
+type Handler func(ctx context.Context, arguments json.RawMessage) (string, error)
+
+type Tool struct {
+	Name        string
+	Description string
+	// JSON Schema 描述的参数
+	Parameters json.RawMessage
+	Handler    Handler
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// 请求中 tools 字段的元素
+type Definition struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type Registry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+	names []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tools: make(map[string]Tool),
+	}
+}
+
+func (r *Registry) Register(t Tool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(t.Name) == 0 || t.Handler == nil {
+		return fmt.Errorf("tool must have a name and a handler")
+	}
+	if _, exist := r.tools[t.Name]; exist {
+		return fmt.Errorf("tool %s already registered", t.Name)
+	}
+	r.tools[t.Name] = t
+	r.names = append(r.names, t.Name)
+	return nil
+}
+
+func (r *Registry) Names() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]string{}, r.names...)
+}
+
+// 按注册顺序返回工具定义，allowed 为 nil 时返回全部
+func (r *Registry) Definitions(allowed []string) []Definition {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var allowedMap map[string]struct{}
+	if allowed != nil {
+		allowedMap = make(map[string]struct{})
+		for _, name := range allowed {
+			allowedMap[name] = struct{}{}
+		}
+	}
+
+	definitions := []Definition{}
+	for _, name := range r.names {
+		if allowedMap != nil {
+			if _, exist := allowedMap[name]; !exist {
+				continue
+			}
+		}
+		t := r.tools[name]
+		definitions = append(definitions, Definition{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+// 执行一次工具调用，出错时把错误告诉模型而不是中断对话
+func (r *Registry) Call(ctx context.Context, call chatcontext.ToolCall) chatcontext.Message {
+	result := chatcontext.Message{
+		Role:       "tool",
+		ToolCallId: call.Id,
+	}
+
+	r.mu.RLock()
+	t, exist := r.tools[call.Function.Name]
+	r.mu.RUnlock()
+	if !exist {
+		result.Content = fmt.Sprintf("error: unknown tool %s", call.Function.Name)
+		return result
+	}
+
+	arguments := json.RawMessage(call.Function.Arguments)
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	output, err := t.Handler(ctx, arguments)
+	if err != nil {
+		log.Printf("Failed to call tool %s(%s): %v", t.Name, util.TruncateLogStr(call.Function.Arguments), err)
+		result.Content = fmt.Sprintf("error: %v", err)
+		return result
+	}
+	log.Printf("Call tool %s(%s): %s", t.Name, util.TruncateLogStr(call.Function.Arguments), util.TruncateLogStr(output))
+	result.Content = output
+	return result
+}
@@ -0,0 +1,261 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+type unit struct {
+	category string
+	// 换算成该类别基本单位的倍数
+	factor *big.Rat
+}
+
+func rat(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		panic(fmt.Sprintf("invalid rational %s", s))
+	}
+	return r
+}
+
+// 单位名都用小写，温度单独处理
+var units = func() map[string]unit {
+	table := map[string][]struct {
+		names  []string
+		factor string
+	}{
+		"length": {
+			{[]string{"m", "meter", "meters", "米"}, "1"},
+			{[]string{"km", "kilometer", "kilometers", "公里", "千米"}, "1000"},
+			{[]string{"cm", "centimeter", "centimeters", "厘米"}, "1/100"},
+			{[]string{"mm", "millimeter", "millimeters", "毫米"}, "1/1000"},
+			{[]string{"um", "μm", "micrometer", "微米"}, "1/1000000"},
+			{[]string{"nm", "nanometer", "纳米"}, "1/1000000000"},
+			{[]string{"mi", "mile", "miles", "英里"}, "1609.344"},
+			{[]string{"yd", "yard", "yards", "码"}, "0.9144"},
+			{[]string{"ft", "foot", "feet", "英尺"}, "0.3048"},
+			{[]string{"in", "inch", "inches", "英寸"}, "0.0254"},
+			{[]string{"nmi", "nautical mile", "海里"}, "1852"},
+			{[]string{"里"}, "500"},
+			{[]string{"丈"}, "10/3"},
+			{[]string{"尺"}, "1/3"},
+			{[]string{"寸"}, "1/30"},
+		},
+		"mass": {
+			{[]string{"g", "gram", "grams", "克"}, "1"},
+			{[]string{"kg", "kilogram", "kilograms", "公斤", "千克"}, "1000"},
+			{[]string{"mg", "milligram", "milligrams", "毫克"}, "1/1000"},
+			{[]string{"t", "ton", "tonne", "吨"}, "1000000"},
+			{[]string{"lb", "lbs", "pound", "pounds", "磅"}, "453.59237"},
+			{[]string{"oz", "ounce", "ounces", "盎司"}, "28.349523125"},
+			{[]string{"斤"}, "500"},
+			{[]string{"两"}, "50"},
+		},
+		"volume": {
+			{[]string{"l", "liter", "liters", "litre", "升"}, "1"},
+			{[]string{"ml", "milliliter", "milliliters", "毫升"}, "1/1000"},
+			{[]string{"m3", "m³", "cubic meter", "立方米"}, "1000"},
+			{[]string{"gal", "gallon", "gallons", "加仑"}, "3.785411784"},
+			{[]string{"qt", "quart", "quarts"}, "0.946352946"},
+			{[]string{"pt", "pint", "pints", "品脱"}, "0.473176473"},
+			{[]string{"cup", "cups", "杯"}, "0.2365882365"},
+			{[]string{"floz", "fl oz", "fluid ounce"}, "0.0295735295625"},
+		},
+		"area": {
+			{[]string{"m2", "m²", "square meter", "平方米"}, "1"},
+			{[]string{"km2", "km²", "square kilometer", "平方公里", "平方千米"}, "1000000"},
+			{[]string{"cm2", "cm²", "square centimeter", "平方厘米"}, "1/10000"},
+			{[]string{"ha", "hectare", "公顷"}, "10000"},
+			{[]string{"acre", "acres", "英亩"}, "4046.8564224"},
+			{[]string{"ft2", "ft²", "square foot", "square feet", "平方英尺"}, "0.09290304"},
+			{[]string{"亩"}, "2000/3"},
+		},
+		"time": {
+			{[]string{"s", "sec", "second", "seconds", "秒"}, "1"},
+			{[]string{"ms", "millisecond", "milliseconds", "毫秒"}, "1/1000"},
+			{[]string{"min", "minute", "minutes", "分钟"}, "60"},
+			{[]string{"h", "hr", "hour", "hours", "小时"}, "3600"},
+			{[]string{"d", "day", "days", "天"}, "86400"},
+			{[]string{"week", "weeks", "周", "星期"}, "604800"},
+			{[]string{"year", "years", "年"}, "31536000"},
+		},
+		"data": {
+			{[]string{"b", "byte", "bytes", "字节"}, "1"},
+			{[]string{"bit", "bits", "比特"}, "1/8"},
+			{[]string{"kb"}, "1000"},
+			{[]string{"mb"}, "1000000"},
+			{[]string{"gb"}, "1000000000"},
+			{[]string{"tb"}, "1000000000000"},
+			{[]string{"kib"}, "1024"},
+			{[]string{"mib"}, "1048576"},
+			{[]string{"gib"}, "1073741824"},
+			{[]string{"tib"}, "1099511627776"},
+		},
+		"speed": {
+			{[]string{"m/s", "mps"}, "1"},
+			{[]string{"km/h", "kmh", "kph", "公里每小时"}, "5/18"},
+			{[]string{"mph"}, "0.44704"},
+			{[]string{"knot", "knots", "kn", "节"}, "463/900"},
+		},
+	}
+
+	units := make(map[string]unit)
+	for category, entries := range table {
+		for _, entry := range entries {
+			for _, name := range entry.names {
+				units[name] = unit{category: category, factor: rat(entry.factor)}
+			}
+		}
+	}
+	return units
+}()
+
+var temperatureUnits = map[string]string{
+	"c": "C", "°c": "C", "celsius": "C", "摄氏度": "C",
+	"f": "F", "°f": "F", "fahrenheit": "F", "华氏度": "F",
+	"k": "K", "kelvin": "K", "开尔文": "K",
+}
+
+var unitConvertParameters = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"value": {
+			"type": "string",
+			"description": "要换算的数值，例如 \"3.5\""
+		},
+		"from": {
+			"type": "string",
+			"description": "原单位，例如 km、lb、°F、亩、USD"
+		},
+		"to": {
+			"type": "string",
+			"description": "目标单位，例如 mi、kg、°C、m2、CNY"
+		}
+	},
+	"required": ["value", "from", "to"]
+}`)
+
+type UnitConverter struct {
+	// 货币代码到基准货币的汇率：1 单位该货币值多少基准货币
+	CurrencyRates map[string]float64
+	CurrencyBase  string
+	// 汇率表的更新时间，会告诉模型
+	RatesUpdated string
+}
+
+func (uc UnitConverter) Tool() Tool {
+	description := "精确换算长度、质量、体积、面积、时间、数据大小、速度和温度单位"
+	if len(uc.CurrencyRates) != 0 {
+		currencies := make([]string, 0, len(uc.CurrencyRates))
+		for code := range uc.CurrencyRates {
+			currencies = append(currencies, code)
+		}
+		sort.Strings(currencies)
+		description += fmt.Sprintf("，以及按本地汇率表换算货币（%s）", strings.Join(currencies, "、"))
+	}
+
+	return Tool{
+		Name:        "unit_convert",
+		Description: description,
+		Parameters:  unitConvertParameters,
+		Handler: func(_ context.Context, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Value json.RawMessage `json:"value"`
+				From  string          `json:"from"`
+				To    string          `json:"to"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", err
+			}
+			// 模型有时会传数字而不是字符串
+			value, ok := new(big.Rat).SetString(strings.Trim(string(args.Value), `" `))
+			if !ok {
+				return "", fmt.Errorf("invalid value %s", string(args.Value))
+			}
+			return uc.Convert(value, args.From, args.To)
+		},
+	}
+}
+
+func (uc UnitConverter) Convert(value *big.Rat, from, to string) (string, error) {
+	fromKey := strings.ToLower(strings.TrimSpace(from))
+	toKey := strings.ToLower(strings.TrimSpace(to))
+
+	if fromTemp, ok := temperatureUnits[fromKey]; ok {
+		toTemp, ok := temperatureUnits[toKey]
+		if !ok {
+			return "", fmt.Errorf("cannot convert %s to %s", from, to)
+		}
+		result := fromKelvin(toKelvin(value, fromTemp), toTemp)
+		return fmt.Sprintf("%s %s = %s %s", FormatRat(value), from, FormatRat(result), to), nil
+	}
+
+	if fromUnit, ok := units[fromKey]; ok {
+		toUnit, ok := units[toKey]
+		if !ok || toUnit.category != fromUnit.category {
+			return "", fmt.Errorf("cannot convert %s to %s", from, to)
+		}
+		result := new(big.Rat).Mul(value, fromUnit.factor)
+		result.Quo(result, toUnit.factor)
+		return fmt.Sprintf("%s %s = %s %s", FormatRat(value), from, FormatRat(result), to), nil
+	}
+
+	fromRate, fromOk := uc.lookupRate(from)
+	toRate, toOk := uc.lookupRate(to)
+	if fromOk && toOk {
+		result := new(big.Rat).Mul(value, fromRate)
+		result.Quo(result, toRate)
+		output := fmt.Sprintf("%s %s = %s %s（本地汇率表", FormatRat(value), strings.ToUpper(from), result.FloatString(4), strings.ToUpper(to))
+		if len(uc.RatesUpdated) != 0 {
+			output += "，更新于 " + uc.RatesUpdated
+		}
+		return output + "，仅供参考）", nil
+	}
+
+	return "", fmt.Errorf("unknown unit %s or %s", from, to)
+}
+
+func (uc UnitConverter) lookupRate(code string) (*big.Rat, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == strings.ToUpper(uc.CurrencyBase) {
+		return big.NewRat(1, 1), true
+	}
+	rate, ok := uc.CurrencyRates[code]
+	if !ok || rate <= 0 {
+		return nil, false
+	}
+	return new(big.Rat).SetFloat64(rate), true
+}
+
+func toKelvin(v *big.Rat, unit string) *big.Rat {
+	r := new(big.Rat).Set(v)
+	switch unit {
+	case "C":
+		return r.Add(r, rat("273.15"))
+	case "F":
+		r.Sub(r, big.NewRat(32, 1))
+		r.Mul(r, big.NewRat(5, 9))
+		return r.Add(r, rat("273.15"))
+	default:
+		return r
+	}
+}
+
+func fromKelvin(v *big.Rat, unit string) *big.Rat {
+	r := new(big.Rat).Set(v)
+	switch unit {
+	case "C":
+		return r.Sub(r, rat("273.15"))
+	case "F":
+		r.Sub(r, rat("273.15"))
+		r.Mul(r, big.NewRat(9, 5))
+		return r.Add(r, big.NewRat(32, 1))
+	default:
+		return r
+	}
+}
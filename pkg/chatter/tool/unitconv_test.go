@@ -0,0 +1,89 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	uc := UnitConverter{
+		CurrencyRates: map[string]float64{"USD": 7.25, "JPY": 0.05},
+		CurrencyBase:  "CNY",
+		RatesUpdated:  "2024-01-01",
+	}
+	tests := []struct {
+		value string
+		from  string
+		to    string
+		want  string
+	}{
+		{"1", "km", "m", "1 km = 1000 m"},
+		{"1", "mile", "km", "1 mile = 25146/15625 ≈ 1.609344 km"},
+		{"3", "ft", "in", "3 ft = 36 in"},
+		{"1", "斤", "kg", "1 斤 = 1/2 ≈ 0.5 kg"},
+		{"1", "亩", "m2", "1 亩 = 2000/3 ≈ 666.66666666666666666667 m2"},
+		{"1", "GiB", "MiB", "1 GiB = 1024 MiB"},
+		{"36", "km/h", "m/s", "36 km/h = 10 m/s"},
+		{"100", "°C", "°F", "100 °C = 212 °F"},
+		{"32", "F", "C", "32 F = 0 C"},
+		{"0", "c", "k", "0 c = 5463/20 ≈ 273.15 k"},
+		{"10", "usd", "cny", "10 USD = 72.5000 CNY（本地汇率表，更新于 2024-01-01，仅供参考）"},
+		{"100", "JPY", "USD", "100 JPY = 0.6897 USD（本地汇率表，更新于 2024-01-01，仅供参考）"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value+tt.from+"->"+tt.to, func(t *testing.T) {
+			value, ok := new(big.Rat).SetString(tt.value)
+			if !ok {
+				t.Fatalf("invalid value %s", tt.value)
+			}
+			got, err := uc.Convert(value, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	uc := UnitConverter{CurrencyRates: map[string]float64{"USD": 7.25}, CurrencyBase: "CNY"}
+	tests := []struct{ from, to string }{
+		{"km", "kg"},
+		{"°C", "m"},
+		{"m", "°C"},
+		{"parsec", "m"},
+		{"USD", "EUR"},
+		{"USD", "km"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			if got, err := uc.Convert(big.NewRat(1, 1), tt.from, tt.to); err == nil {
+				t.Errorf("expected error, got %s", got)
+			}
+		})
+	}
+}
+
+func TestUnitConvertTool(t *testing.T) {
+	handler := UnitConverter{}.Tool().Handler
+	for _, arguments := range []string{
+		`{"value":"2.5","from":"kg","to":"g"}`,
+		// 模型有时会传数字而不是字符串
+		`{"value":2.5,"from":"kg","to":"g"}`,
+	} {
+		output, err := handler(context.Background(), json.RawMessage(arguments))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "5/2 ≈ 2.5 kg = 2500 g"; output != want {
+			t.Errorf("%s: got %s, want %s", arguments, output, want)
+		}
+	}
+	if _, err := handler(context.Background(), json.RawMessage(`{"value":"abc","from":"kg","to":"g"}`)); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
@@ -0,0 +1,209 @@
+package chatter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/chatter/tool"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+// 按顺序返回预先准备好的回答，并记下每次请求的内容
+type fakeProvider struct {
+	t         *testing.T
+	mu        sync.Mutex
+	responses []string
+	requests  []map[string]interface{}
+}
+
+func (fp *fakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	request := map[string]interface{}{}
+	if err := json.Unmarshal(b, &request); err != nil {
+		fp.t.Errorf("bad request body: %v", err)
+	}
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.requests = append(fp.requests, request)
+	if len(fp.responses) == 0 {
+		http.Error(w, "no more responses", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fp.responses[0])
+	fp.responses = fp.responses[1:]
+}
+
+func newTestProvider(t *testing.T, config string) providerconfig.ProviderConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provider-config.json")
+	if err := os.WriteFile(path, []byte("["+config+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := providerconfig.LoadProviderConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return providers[0]
+}
+
+func newToolChatter(t *testing.T, maxToolRounds int) Chatter {
+	t.Helper()
+	tools := tool.NewRegistry()
+	err := tools.Register(tool.Tool{
+		Name: "echo",
+		Handler: func(_ context.Context, arguments json.RawMessage) (string, error) {
+			return "echo " + string(arguments), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Chatter{
+		ctx:             context.Background(),
+		ToSendMessageCh: make(chan messageenvelope.MessageEnvelope, 10),
+		Tools:           tools,
+		MaxToolRounds:   maxToolRounds,
+	}
+}
+
+const (
+	toolCallResponse = `{"choices":[{"message":{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"echo","arguments":"{\"x\":1}"}}]}}]}`
+	answerResponse   = `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`
+)
+
+func roles(request map[string]interface{}) []string {
+	result := []string{}
+	messages, _ := request["messages"].([]interface{})
+	for _, message := range messages {
+		m := message.(map[string]interface{})
+		role := m["role"].(string)
+		if _, ok := m["tool_calls"]; ok {
+			role += "+tool_calls"
+		}
+		result = append(result, role)
+	}
+	return result
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAskProviderToolLoop(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxToolRounds int
+		// 第二次请求的 tool_choice
+		wantToolChoice interface{}
+	}{
+		{"tools still allowed", 5, nil},
+		{"last round", 1, toolChoiceNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := &fakeProvider{t: t, responses: []string{toolCallResponse, answerResponse}}
+			server := httptest.NewServer(fp)
+			defer server.Close()
+
+			c := newToolChatter(t, tt.maxToolRounds)
+			p := newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"],"function_calling":true}`, server.URL))
+			m := messageenvelope.MessageEnvelope{UserId: 1}
+			err := c.askProvider(context.Background(), p, m, []chatcontext.Message{{Role: "user", Content: "q"}}, nil)
+			if err != nil {
+				t.Fatalf("askProvider: %v", err)
+			}
+
+			sent := <-c.ToSendMessageCh
+			if sent.Text != "done" {
+				t.Errorf("answer = %q, want done", sent.Text)
+			}
+			if len(sent.ToolMessages) != 2 || sent.ToolMessages[1].Content != `echo {"x":1}` {
+				t.Errorf("tool messages = %+v", sent.ToolMessages)
+			}
+
+			if len(fp.requests) != 2 {
+				t.Fatalf("requests = %d, want 2", len(fp.requests))
+			}
+			second := fp.requests[1]
+			if got, want := roles(second), []string{"user", "assistant+tool_calls", "tool"}; !equalStrings(got, want) {
+				t.Errorf("roles = %v, want %v", got, want)
+			}
+			if _, ok := second["tools"]; !ok {
+				t.Errorf("tools missing in second request")
+			}
+			if second["tool_choice"] != tt.wantToolChoice {
+				t.Errorf("tool_choice = %v, want %v", second["tool_choice"], tt.wantToolChoice)
+			}
+		})
+	}
+}
+
+func TestReplayToolHistory(t *testing.T) {
+	history := []chatcontext.Message{
+		{Role: "user", Content: "1+1?"},
+		{Role: "assistant", ToolCalls: []chatcontext.ToolCall{{Id: "call_1", Type: "function", Function: chatcontext.ToolCallFunction{Name: "echo", Arguments: "{}"}}}},
+		{Role: "tool", ToolCallId: "call_1", Content: "2"},
+		{Role: "assistant", Content: "2"},
+		{Role: "user", Content: "thanks"},
+	}
+	tests := []struct {
+		name      string
+		config    string
+		toolNames []string
+		want      []string
+	}{
+		{
+			name:   "function calling",
+			config: `"function_calling":true`,
+			want:   []string{"user", "assistant+tool_calls", "tool", "assistant", "user"},
+		},
+		{
+			name:   "no function calling",
+			config: `"function_calling":false`,
+			want:   []string{"user", "assistant", "user"},
+		},
+		{
+			name:      "tools disabled by route",
+			config:    `"function_calling":true`,
+			toolNames: []string{},
+			want:      []string{"user", "assistant", "user"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := &fakeProvider{t: t, responses: []string{answerResponse}}
+			server := httptest.NewServer(fp)
+			defer server.Close()
+
+			c := newToolChatter(t, 5)
+			p := newTestProvider(t, fmt.Sprintf(`{"name":"p","url":%q,"keys":["k"],%s}`, server.URL, tt.config))
+			m := messageenvelope.MessageEnvelope{UserId: 1}
+			if err := c.askProvider(context.Background(), p, m, history, tt.toolNames); err != nil {
+				t.Fatalf("askProvider: %v", err)
+			}
+			if got := roles(fp.requests[0]); !equalStrings(got, tt.want) {
+				t.Errorf("roles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
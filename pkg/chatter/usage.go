@@ -0,0 +1,62 @@
+package chatter
+
+import (
+	"log"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+	"github.com/vaaandark/qabot/pkg/usage"
+)
+
+// 服务商没有返回用量时为 nil
+func addUsage(total, u *chatcontext.Usage) *chatcontext.Usage {
+	if u == nil {
+		return total
+	}
+	sum := *u
+	if total != nil {
+		sum = total.Add(*u)
+	}
+	return &sum
+}
+
+// 按提供商的价格算出费用，价格变了以后之前的费用不变
+func priceUsage(p providerconfig.ProviderConfig, u *chatcontext.Usage) *chatcontext.Usage {
+	if u == nil {
+		return nil
+	}
+	priced := *u
+	priced.Cost = p.Cost(priced)
+	return &priced
+}
+
+// 一次回答的用量计入提供商、群和用户，同时计入额度
+func (c Chatter) recordUsage(p providerconfig.ProviderConfig, m messageenvelope.MessageEnvelope, messages []chatcontext.Message, answer string) {
+	c.recordTokens(m, messages, answer)
+	if c.Usage == nil {
+		return
+	}
+
+	// 服务商没有返回用量时只记录次数
+	u := chatcontext.Usage{}
+	if m.Usage != nil {
+		u = *m.Usage
+	}
+	ids := []string{usage.ProviderId(p.Name), m.GetNamespacedUserID()}
+	if m.IsInGroup() {
+		ids = append(ids, m.GetNamespacedGroupOrUserID())
+	}
+	if err := c.Usage.Record(ids, u); err != nil {
+		log.Printf("Failed to record usage of %s: %v", m.GetNamespacedUserID(), err)
+	}
+}
+
+func (c Chatter) recordProviderUsage(p providerconfig.ProviderConfig, u *chatcontext.Usage) {
+	if c.Usage == nil || u == nil {
+		return
+	}
+	if err := c.Usage.Record([]string{usage.ProviderId(p.Name)}, *priceUsage(p, u)); err != nil {
+		log.Printf("Failed to record usage of %s: %v", p.Name, err)
+	}
+}
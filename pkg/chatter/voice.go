@@ -0,0 +1,43 @@
+package chatter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/util"
+)
+
+// 语音文件一般只有几百 KB
+const maxRecordBytes = 20 << 20
+
+// 让 onebot 实现把语音转换成转写后端需要的格式，再转写成文字
+func (c Chatter) transcribe(ctx context.Context, record onebot.Record) (string, error) {
+	if c.Transcriber == nil || c.OneBot == nil {
+		return "", fmt.Errorf("speech to text is not enabled")
+	}
+
+	format := c.Transcriber.Format()
+	file := record.File
+	if len(file) == 0 {
+		file = record.Path
+	}
+	data, err := c.OneBot.GetRecord(file, format)
+	if err != nil {
+		return "", err
+	}
+
+	// 优先用 base64，onebot 实现和 qabot 不在同一台机器上时本地路径读不到
+	source := data.File
+	if len(data.Base64) != 0 {
+		source = "base64://" + data.Base64
+	} else if len(data.Url) != 0 {
+		source = data.Url
+	}
+	audio, err := util.Fetch(ctx, http.DefaultClient, source, maxRecordBytes)
+	if err != nil {
+		return "", err
+	}
+	return c.Transcriber.Transcribe(ctx, audio, format)
+}
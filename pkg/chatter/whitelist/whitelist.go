@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"github.com/vaaandark/qabot/pkg/quota"
 )
 
 type Whitelist struct {
@@ -136,6 +138,17 @@ func (wa *Whitelist) HasUser(userId int64) bool {
 	return wa.whitelistData.hasUser(userId)
 }
 
+// namespacedId 为 user/<QQ 号> 或 group/<群号>，没有单独配置时使用 default
+func (wa *Whitelist) Limit(namespacedId string) quota.Limit {
+	if wa.IsModified() {
+		log.Printf("Whitelist file %s has been modified", wa.FilePath)
+		if err := wa.LoadFile(); err != nil {
+			log.Printf("Failed to load file: %v", err)
+		}
+	}
+	return wa.whitelistData.limit(namespacedId)
+}
+
 func (wa Whitelist) IsAdmin(userId int64) bool {
 	return wa.whitelistData.isAdmin(userId)
 }
@@ -144,6 +157,8 @@ type whitelistData struct {
 	UserIds  []int64 `json:"user_ids"`
 	GroupIds []int64 `json:"group_ids"`
 	Admin    *int64  `json:"admin,omitempty"`
+	// 键为 user/<QQ 号>、group/<群号> 或 default
+	Quotas map[string]quota.Limit `json:"quotas,omitempty"`
 }
 
 func (wd whitelistData) DumpFile(path string) error {
@@ -198,3 +213,10 @@ func (wd *whitelistData) addGroup(groupId int64) {
 func (wd whitelistData) isAdmin(userId int64) bool {
 	return wd.Admin != nil && *wd.Admin == userId
 }
+
+func (wd whitelistData) limit(namespacedId string) quota.Limit {
+	if limit, exist := wd.Quotas[namespacedId]; exist {
+		return limit
+	}
+	return wd.Quotas["default"]
+}
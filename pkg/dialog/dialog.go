@@ -13,9 +13,10 @@ import (
 
 	"github.com/vaaandark/qabot/pkg/chatcontext"
 	"github.com/vaaandark/qabot/pkg/idmap"
+	"github.com/vaaandark/qabot/pkg/usage"
 )
 
-var dialogTreeHtmlTmpl, dialogListHtmlTmpl *template.Template
+var dialogTreeHtmlTmpl, dialogListHtmlTmpl, usageHtmlTmpl *template.Template
 
 func init() {
 	dialogTreeHtmlTmpl = template.Must(template.New("dialogTree").Funcs(template.FuncMap{
@@ -37,6 +38,7 @@ func init() {
 	}).Parse(dialogTreeHtmlTemplate))
 
 	dialogListHtmlTmpl = template.Must(template.New("dialogList").Parse(dialogListHtmlTemplate))
+	usageHtmlTmpl = template.Must(template.New("usage").Parse(usageHtmlTemplate))
 }
 
 type DialogHtmlBuilder struct {
@@ -44,14 +46,16 @@ type DialogHtmlBuilder struct {
 	Auth        *Auth
 	FuzzId      bool
 	IdMap       idmap.IdMap
+	Usage       *usage.Store
 }
 
-func NewDialogHtmlBuilder(chatContext chatcontext.ChatContext, auth *Auth, fuzzId bool, idMap idmap.IdMap) DialogHtmlBuilder {
+func NewDialogHtmlBuilder(chatContext chatcontext.ChatContext, auth *Auth, fuzzId bool, idMap idmap.IdMap, usage *usage.Store) DialogHtmlBuilder {
 	return DialogHtmlBuilder{
 		ChatContext: chatContext,
 		Auth:        auth,
 		FuzzId:      fuzzId,
 		IdMap:       idMap,
+		Usage:       usage,
 	}
 }
 
@@ -171,6 +175,10 @@ func (dhb DialogHtmlBuilder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err := dhb.buildDialogTreeHtml(w, all, user, nil); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to build dialog tree html: %v", err), http.StatusInternalServerError)
 		}
+	} else if splited[1] == "usage" {
+		if err := dhb.buildUsageHtml(w, r, all, user); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to build usage html: %v", err), http.StatusInternalServerError)
+		}
 	} else {
 		if path.Base(splited[1]) == "all" {
 			if err := dhb.buildDialogSingleTreeHtml(w, splited[1], all, user); err != nil {
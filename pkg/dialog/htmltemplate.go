@@ -79,6 +79,29 @@ const dialogTreeHtmlTemplate = `
             line-height: 1.6;
         }
 
+        /* 摘要样式 */
+        .summary {
+            margin: 6px 0 0 115px;
+            padding: 8px 12px;
+            background: #FFF8E1;
+            border-left: 3px solid #FFB300;
+            color: #5D4037;
+            font-size: 0.9em;
+            white-space: pre-wrap;
+        }
+
+        /* 工具调用样式 */
+        .tool-call {
+            margin: 6px 0 0 115px;
+            padding: 6px 12px;
+            background: #ECEFF1;
+            border-left: 3px solid #78909C;
+            color: #37474F;
+            font-family: monospace;
+            font-size: 0.85em;
+            white-space: pre-wrap;
+        }
+
         /* 折叠控制 */
         .toggle {
             cursor: pointer;
@@ -99,6 +122,7 @@ const dialogTreeHtmlTemplate = `
 </head>
 <body>
     <h1>{{.Welcome}}</h1>
+    <a href="/usage">用量统计</a>
     <div class="dialog-container">
         {{range $groupKey, $trees := .IndexedDialogTreesmap}}
         <div class="group">
@@ -112,8 +136,13 @@ const dialogTreeHtmlTemplate = `
                     <div class="role-{{.Role}}">
                         <span class="toggle" onclick="toggleNode(this)">▶</span>
                         <span class="role-tag">{{.Role}}</span>
-                        <span class="content-text">{{.Content}}</span>
+                        <span class="content-text">{{if .Voice}}🎤 {{end}}{{.Content}}</span>
                     </div>
+                    {{range .ToolCalls}}<div class="tool-call">🔧 {{.Name}}({{.Arguments}}) → {{.Result}}</div>{{end}}
+                    {{range .Images}}<div class="tool-call">🖼️ <a href="{{.Url}}" target="_blank">{{if .File}}{{.File}}{{else}}图片{{end}}</a></div>{{end}}
+                    {{range .Images}}<div class="tool-call">🖼️ <a href="{{.Url}}" target="_blank">{{if .File}}{{.File}}{{else}}图片{{end}}</a></div>{{end}}
+        {{if .Summary}}<div class="summary">📝 {{.Summary}}</div>{{end}}
+                    {{with .Usage}}<div class="tool-call">📊 提示词 {{.PromptTokens}} / 回答 {{.CompletionTokens}}{{if .ReasoningTokens}}（思考 {{.ReasoningTokens}}）{{end}} token{{if .Cost}}，费用 {{printf "%.4f" .Cost}}{{end}}</div>{{end}}
                     {{if .Children}}
                     <div class="children">
                         {{template "childNodes" .Children}}
@@ -160,8 +189,12 @@ const dialogTreeHtmlTemplate = `
 			<span class="role-tag">
                 <a href="/{{.Id}}/{{.MessageId}}">{{.Role}}</a>
 			</span>
-            <span class="content-text">{{.Content}}</span>
+            <span class="content-text">{{if .Voice}}🎤 {{end}}{{.Content}}</span>
         </div>
+        {{range .ToolCalls}}<div class="tool-call">🔧 {{.Name}}({{.Arguments}}) → {{.Result}}</div>{{end}}
+        {{range .Images}}<div class="tool-call">🖼️ <a href="{{.Url}}" target="_blank">{{if .File}}{{.File}}{{else}}图片{{end}}</a></div>{{end}}
+        {{if .Summary}}<div class="summary">📝 {{.Summary}}</div>{{end}}
+        {{with .Usage}}<div class="tool-call">📊 提示词 {{.PromptTokens}} / 回答 {{.CompletionTokens}}{{if .ReasoningTokens}}（思考 {{.ReasoningTokens}}）{{end}} token{{if .Cost}}，费用 {{printf "%.4f" .Cost}}{{end}}</div>{{end}}
         {{if .Children}}
         <div class="children">
             {{template "childNodes" .Children}}
@@ -191,6 +224,8 @@ const dialogListHtmlTemplate = `
         .message { margin: 16px 0; }
         .user-message { background: #007bff; color: white; border-radius: 15px 15px 0 15px; padding: 12px 16px; max-width: 70%; margin-left: auto; }
         .assistant-message { background: #e9ecef; color: #212529; border-radius: 15px 15px 15px 0; padding: 12px 16px; max-width: 70%; }
+        .tool-message { background: #ECEFF1; color: #37474F; border-left: 3px solid #78909C; border-radius: 4px; padding: 8px 12px; font-family: monospace; font-size: 0.85em; white-space: pre-wrap; }
+        .system-message { background: #FFF8E1; color: #5D4037; border-left: 3px solid #FFB300; border-radius: 4px; padding: 12px 16px; }
         .role-label { font-size: 0.85em; color: #6c757d; margin-bottom: 4px; }
 
         /* Markdown 元素样式 */
@@ -209,18 +244,31 @@ const dialogListHtmlTemplate = `
 <body>
     <div class="chat-container">
         {{range .}}
+        {{if .ToolCalls}}
+        <div class="message">
+            <div class="role-label">助手调用工具</div>
+            {{range .ToolCalls}}<div class="tool-message">🔧 {{.Function.Name}}({{.Function.Arguments}})</div>{{end}}
+        </div>
+        {{else if eq .Role "tool"}}
+        <div class="message">
+            <div class="role-label">工具结果</div>
+            <div class="tool-message">{{.Content}}</div>
+        </div>
+        {{else}}
         <div class="message">
             <div class="role-label">
-                {{if eq .Role "user"}}你{{else}}助手{{end}}
+                {{if eq .Role "user"}}你{{if .Voice}}（语音）{{end}}{{else if eq .Role "system"}}摘要{{else}}助手{{end}}
             </div>
-            <div class="{{if eq .Role "user"}}user-message{{else}}assistant-message{{end}}">
+            <div class="{{if eq .Role "user"}}user-message{{else if eq .Role "system"}}system-message{{else}}assistant-message{{end}}">
                 <!-- 原始 Markdown 内容存放在隐藏的 pre 标签中 -->
                 <pre class="raw-markdown" style="display: none;">{{.Content}}</pre>
                 <!-- 渲染后的内容显示在这里 -->
                 <div class="message-content"></div>
+                {{range .Images}}<div class="tool-message">🖼️ <a href="{{.Url}}" target="_blank">图片</a></div>{{end}}
             </div>
         </div>
         {{end}}
+        {{end}}
     </div>
 
     <script>
@@ -270,3 +318,41 @@ const dialogListHtmlTemplate = `
 </body>
 </html>
 `
+
+const usageHtmlTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>用量统计</title>
+    <style>
+        body { font-family: -apple-system, sans-serif; background: #f8f9fa; }
+        .usage-container { max-width: 1000px; margin: 20px auto; background: white; border-radius: 12px; box-shadow: 0 2px 12px rgba(0,0,0,0.1); padding: 24px; }
+        h2 { font-size: 1.1em; color: #2b2d42; margin-top: 28px; }
+        table { width: 100%; border-collapse: collapse; font-size: 0.9em; }
+        th, td { padding: 8px 12px; border-bottom: 1px solid #dee2e6; text-align: right; }
+        th:first-child, td:first-child { text-align: left; }
+        th { background: #f8f9fa; color: #495057; font-weight: 600; }
+        .days a { margin-right: 12px; color: #007bff; text-decoration: none; }
+    </style>
+</head>
+<body>
+    <div class="usage-container">
+        <h1>最近 {{.Days}} 天的用量</h1>
+        <div class="days"><a href="?days=1">今天</a><a href="?days=7">7 天</a><a href="?days=30">30 天</a><a href="?days=365">一年</a><a href="/">返回</a></div>
+        {{if .Daily}}<h2>每天</h2>{{template "usageTable" .Daily}}{{end}}
+        {{if .Providers}}<h2>提供商</h2>{{template "usageTable" .Providers}}{{end}}
+        {{if .Groups}}<h2>群</h2>{{template "usageTable" .Groups}}{{end}}
+        {{if .Users}}<h2>用户</h2>{{template "usageTable" .Users}}{{end}}
+    </div>
+</body>
+</html>
+
+{{define "usageTable"}}
+<table>
+    <tr><th></th><th>请求</th><th>提示词 token</th><th>回答 token</th><th>思考 token</th><th>费用</th></tr>
+    {{range .}}
+    <tr><td>{{.Name}}</td><td>{{.Requests}}</td><td>{{.PromptTokens}}</td><td>{{.CompletionTokens}}</td><td>{{.ReasoningTokens}}</td><td>{{printf "%.4f" .Cost}}</td></tr>
+    {{end}}
+</table>
+{{end}}
+`
@@ -0,0 +1,81 @@
+package dialog
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/usage"
+)
+
+const defaultUsageDays = 30
+
+type UsageRow struct {
+	Name string
+	usage.Totals
+}
+
+type UsagePage struct {
+	Days      int
+	Daily     []UsageRow
+	Providers []UsageRow
+	Groups    []UsageRow
+	Users     []UsageRow
+}
+
+// 管理员可以看到所有用量，其他用户只能看到 allowed 中的群和用户
+func (dhb DialogHtmlBuilder) buildUsageHtml(w http.ResponseWriter, r *http.Request, all bool, user *User) error {
+	if user == nil {
+		return fmt.Errorf("User is not found")
+	}
+	if dhb.Usage == nil {
+		return fmt.Errorf("usage is disabled")
+	}
+
+	days := defaultUsageDays
+	if s := r.URL.Query().Get("days"); len(s) != 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad days: %s", s)
+		}
+		days = n
+	}
+
+	entries, err := dhb.Usage.Load(days)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]struct{})
+	for _, a := range user.Allowed {
+		allowed[a] = struct{}{}
+	}
+
+	page := UsagePage{Days: days}
+	if all {
+		for _, entry := range usage.SumByDay(entries) {
+			page.Daily = append(page.Daily, UsageRow{Name: entry.Day, Totals: entry.Totals})
+		}
+	}
+	for _, entry := range usage.SumById(entries) {
+		if entry.Kind() == "provider" {
+			if all {
+				page.Providers = append(page.Providers, UsageRow{Name: strings.TrimPrefix(entry.Id, "provider/"), Totals: entry.Totals})
+			}
+			continue
+		}
+		if _, exist := allowed[entry.Id]; !all && !exist {
+			continue
+		}
+		row := UsageRow{Name: chatcontext.DisplayId(entry.Id, dhb.FuzzId, dhb.IdMap), Totals: entry.Totals}
+		if entry.Kind() == "group" {
+			page.Groups = append(page.Groups, row)
+		} else {
+			page.Users = append(page.Users, row)
+		}
+	}
+
+	return usageHtmlTmpl.Execute(w, page)
+}
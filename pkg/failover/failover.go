@@ -0,0 +1,133 @@
+package failover
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultTimeout        = 5 * time.Minute
+	defaultCooldown       = time.Minute
+)
+
+// 每个服务商的重试和熔断策略，未设置的字段使用默认值
+type Policy struct {
+	// 同一个服务商最多重试几次，不包括第一次请求
+	MaxRetries       int `json:"max_retries,omitempty"`
+	InitialBackoffMs int `json:"initial_backoff_ms,omitempty"`
+	MaxBackoffMs     int `json:"max_backoff_ms,omitempty"`
+	// 单次请求（包括读完整个流）的超时时间
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// 连续失败这么多次后熔断，为 0 时不熔断
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	CooldownSeconds  int `json:"cooldown_seconds,omitempty"`
+}
+
+func (p Policy) Timeout() time.Duration {
+	if p.TimeoutSeconds <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+func (p Policy) cooldown() time.Duration {
+	if p.CooldownSeconds <= 0 {
+		return defaultCooldown
+	}
+	return time.Duration(p.CooldownSeconds) * time.Second
+}
+
+// 两次重试之间最多等待的时间，服务商给出更长的 Retry-After 时不再等它
+func (p Policy) MaxBackoff() time.Duration {
+	if p.MaxBackoffMs <= 0 {
+		return defaultMaxBackoff
+	}
+	return time.Duration(p.MaxBackoffMs) * time.Millisecond
+}
+
+// 第 attempt 次重试前等待的时间，从 1 开始指数增长
+func (p Policy) Backoff(attempt int) time.Duration {
+	initial := defaultInitialBackoff
+	if p.InitialBackoffMs > 0 {
+		initial = time.Duration(p.InitialBackoffMs) * time.Millisecond
+	}
+	max := p.MaxBackoff()
+
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+type Breaker struct {
+	mu                  sync.Mutex
+	policy              Policy
+	consecutiveFailures int
+	openUntil           time.Time
+	// 冷却结束后只放行一个试探请求
+	probing bool
+}
+
+func NewBreaker(policy Policy) *Breaker {
+	return &Breaker{policy: policy}
+}
+
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.policy.FailureThreshold <= 0 || b.consecutiveFailures < b.policy.FailureThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures++
+	b.probing = false
+	if b.policy.FailureThreshold > 0 && b.consecutiveFailures >= b.policy.FailureThreshold {
+		b.openUntil = time.Now().Add(b.policy.cooldown())
+	}
+}
+
+// 请求被取消时既不算成功也不算失败，但要放掉试探的名额，否则熔断器再也不会放行
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// 熔断中返回恢复时间，否则返回 nil
+func (b *Breaker) OpenUntil() *time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.policy.FailureThreshold <= 0 || b.consecutiveFailures < b.policy.FailureThreshold {
+		return nil
+	}
+	openUntil := b.openUntil
+	return &openUntil
+}
@@ -0,0 +1,117 @@
+package failover
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		attempt int
+		want    time.Duration
+	}{
+		{"default first", Policy{}, 1, defaultInitialBackoff},
+		{"default second", Policy{}, 2, 2 * defaultInitialBackoff},
+		{"default capped", Policy{}, 100, defaultMaxBackoff},
+		{"custom", Policy{InitialBackoffMs: 100, MaxBackoffMs: 1000}, 3, 400 * time.Millisecond},
+		{"custom capped", Policy{InitialBackoffMs: 100, MaxBackoffMs: 1000}, 5, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxBackoff(t *testing.T) {
+	if got := (Policy{}).MaxBackoff(); got != defaultMaxBackoff {
+		t.Errorf("default max backoff = %v", got)
+	}
+	if got := (Policy{MaxBackoffMs: 1500}).MaxBackoff(); got != 1500*time.Millisecond {
+		t.Errorf("max backoff = %v, want 1.5s", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	if got := (Policy{}).Timeout(); got != defaultTimeout {
+		t.Errorf("default timeout = %v", got)
+	}
+	if got := (Policy{TimeoutSeconds: 3}).Timeout(); got != 3*time.Second {
+		t.Errorf("timeout = %v, want 3s", got)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := NewBreaker(Policy{})
+	for i := 0; i < 100; i++ {
+		b.Failure()
+	}
+	if !b.Allow() || b.OpenUntil() != nil {
+		t.Errorf("breaker without threshold opened")
+	}
+}
+
+func TestBreakerOpensAndProbes(t *testing.T) {
+	b := NewBreaker(Policy{FailureThreshold: 2, CooldownSeconds: 60})
+	b.Failure()
+	if !b.Allow() {
+		t.Fatalf("opened below threshold")
+	}
+	b.Failure()
+	if b.Allow() || b.OpenUntil() == nil {
+		t.Fatalf("not opened at threshold")
+	}
+
+	// 冷却结束后只放行一个试探请求
+	b.openUntil = time.Now().Add(-time.Second)
+	if !b.Allow() {
+		t.Fatalf("probe rejected after cooldown")
+	}
+	if b.Allow() {
+		t.Errorf("second probe allowed")
+	}
+
+	// 试探失败重新熔断
+	b.Failure()
+	if b.Allow() {
+		t.Errorf("allowed after failed probe")
+	}
+
+	b.openUntil = time.Now().Add(-time.Second)
+	if !b.Allow() {
+		t.Fatalf("probe rejected after cooldown")
+	}
+	b.Success()
+	if !b.Allow() || !b.Allow() || b.OpenUntil() != nil {
+		t.Errorf("not closed after successful probe")
+	}
+}
+
+func TestBreakerReleaseProbe(t *testing.T) {
+	b := NewBreaker(Policy{FailureThreshold: 1, CooldownSeconds: 60})
+	b.Failure()
+	b.openUntil = time.Now().Add(-time.Second)
+	if !b.Allow() {
+		t.Fatalf("probe rejected after cooldown")
+	}
+
+	// 试探请求被取消，下一个请求可以重新试探，但熔断器仍然是打开的
+	b.Release()
+	if b.OpenUntil() == nil {
+		t.Errorf("cancelled probe closed the breaker")
+	}
+	if !b.Allow() {
+		t.Fatalf("probe rejected after the previous one was cancelled")
+	}
+	if b.Allow() {
+		t.Errorf("second probe allowed")
+	}
+	b.Success()
+	if b.OpenUntil() != nil {
+		t.Errorf("not closed after successful probe")
+	}
+}
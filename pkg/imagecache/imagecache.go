@@ -0,0 +1,196 @@
+package imagecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/util"
+)
+
+const (
+	fetchTimeout = 30 * time.Second
+	// 下载时允许的最大字节数，超过的图片直接放弃
+	maxDownloadBytes = 20 << 20
+)
+
+type Config struct {
+	Dir string
+	// 缓存目录的总大小上限
+	MaxTotalBytes int64
+	// 单张图片归一化后的大小上限
+	MaxImageBytes int64
+	// 最长边超过时缩小
+	MaxDimension int
+	// 超过这么久没有使用的图片会被删除
+	TTL time.Duration
+}
+
+type Cache struct {
+	config Config
+	client *http.Client
+	mu     sync.Mutex
+}
+
+func NewCache(config Config) (*Cache, error) {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		config: config,
+		client: &http.Client{Timeout: fetchTimeout},
+	}, nil
+}
+
+// 下载图片并按内容哈希保存，返回哈希，相同的图片只保存一份
+func (c *Cache) Store(ctx context.Context, source string) (string, error) {
+	raw, err := util.Fetch(ctx, c.client, source, maxDownloadBytes)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if path := c.lookup(hash); len(path) != 0 {
+		c.touch(path)
+		return hash, nil
+	}
+
+	data, ext, err := normalize(raw, c.config.MaxDimension, c.config.MaxImageBytes)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.config.Dir, hash+ext)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return hash, nil
+}
+
+// 返回 data URL，图片不存在（比如已经被清理）时返回错误
+func (c *Cache) DataUrl(hash string) (string, error) {
+	c.mu.Lock()
+	path := c.lookup(hash)
+	if len(path) != 0 {
+		c.touch(path)
+	}
+	c.mu.Unlock()
+
+	if len(path) == 0 {
+		return "", fmt.Errorf("image %s not in cache", hash)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mimeTypes[filepath.Ext(path)], base64.StdEncoding.EncodeToString(data)), nil
+}
+
+func (c *Cache) lookup(hash string) string {
+	// 哈希只含十六进制字符，不会逃出缓存目录
+	if len(hash) != sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return ""
+	}
+	for ext := range mimeTypes {
+		path := filepath.Join(c.config.Dir, hash+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// 用修改时间记录最近一次使用
+func (c *Cache) touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Printf("Failed to touch cached image %s: %v", path, err)
+	}
+}
+
+// 先删除过期的图片，仍然超过总大小时从最久没用的开始删
+func (c *Cache) Evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		log.Printf("Failed to read image cache dir: %v", err)
+		return
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cached{}
+	total := int64(0)
+	now := time.Now()
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(c.config.Dir, entry.Name())
+		if c.config.TTL > 0 && now.Sub(info.ModTime()) > c.config.TTL {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove expired image %s: %v", path, err)
+			}
+			continue
+		}
+		files = append(files, cached{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	if c.config.MaxTotalBytes <= 0 || total <= c.config.MaxTotalBytes {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		if total <= c.config.MaxTotalBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Failed to remove cached image %s: %v", f.path, err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	c.Evict()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Evict()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package imagecache
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+)
+
+const (
+	jpegQuality = 85
+	// 避免解码时分配过大的内存
+	maxPixels = 64 << 20
+)
+
+var mimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// jpeg 和 png 尺寸合适时原样保存，其他能解码的格式或过大的图片缩小后重新编码成 jpeg，
+// 标准库不能解码的 webp 只检查大小
+func normalize(raw []byte, maxDimension int, maxBytes int64) ([]byte, string, error) {
+	mime := http.DetectContentType(raw)
+	ext, ok := extensions[mime]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported image type %s", mime)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		if mime == "image/webp" && (maxBytes <= 0 || int64(len(raw)) <= maxBytes) {
+			return raw, ext, nil
+		}
+		return nil, "", fmt.Errorf("failed to decode image: %v", err)
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, "", fmt.Errorf("image is too large: %dx%d", config.Width, config.Height)
+	}
+
+	fits := maxDimension <= 0 || (config.Width <= maxDimension && config.Height <= maxDimension)
+	small := maxBytes <= 0 || int64(len(raw)) <= maxBytes
+	if fits && small && (format == "jpeg" || format == "png") {
+		return raw, ext, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %v", err)
+	}
+	img = resize(img, maxDimension)
+
+	// jpeg 没有透明通道，先铺上白色背景
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, "", err
+	}
+	if maxBytes > 0 && int64(buf.Len()) > maxBytes {
+		return nil, "", fmt.Errorf("image is still larger than %d bytes after normalization", maxBytes)
+	}
+	return buf.Bytes(), ".jpg", nil
+}
+
+// 按区域平均缩小到最长边不超过 maxDimension
+func resize(src image.Image, maxDimension int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if maxDimension <= 0 || (w <= maxDimension && h <= maxDimension) {
+		return src
+	}
+
+	dw, dh := maxDimension, h*maxDimension/w
+	if h > w {
+		dw, dh = w*maxDimension/h, maxDimension
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,208 @@
+package keypool
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 401/403 基本是 key 失效或者没有权限，冷却时间长一些
+	unauthorizedCooldown = 30 * time.Minute
+	rateLimitedCooldown  = 30 * time.Second
+	failureCooldown      = 10 * time.Second
+	maxCooldown          = time.Hour
+	// 连续失败这么多次才会因为普通错误进入冷却
+	maxConsecutiveFailures = 3
+)
+
+var ErrNoAvailableKey = errors.New("no available key")
+
+type keyState struct {
+	key                 string
+	success             uint64
+	failure             uint64
+	consecutiveFailures int
+	cooldownUntil       time.Time
+	lastError           string
+}
+
+type KeyStats struct {
+	Key           string
+	Success       uint64
+	Failure       uint64
+	Healthy       bool
+	CooldownUntil time.Time
+	LastError     string
+}
+
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*keyState
+	next int
+}
+
+func NewKeyPool(keys []string) *KeyPool {
+	kp := &KeyPool{}
+	for _, key := range keys {
+		kp.keys = append(kp.keys, &keyState{key: key})
+	}
+	return kp
+}
+
+// 轮流返回下一个健康的 key，全部在冷却时返回错误
+func (kp *KeyPool) Next() (string, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	if len(kp.keys) == 0 {
+		return "", fmt.Errorf("%w: no key configured", ErrNoAvailableKey)
+	}
+
+	now := time.Now()
+	for i := 0; i < len(kp.keys); i++ {
+		ks := kp.keys[(kp.next+i)%len(kp.keys)]
+		if now.Before(ks.cooldownUntil) {
+			continue
+		}
+		kp.next = (kp.next + i + 1) % len(kp.keys)
+		return ks.key, nil
+	}
+	return "", fmt.Errorf("%w: all %d keys are cooling down", ErrNoAvailableKey, len(kp.keys))
+}
+
+func (kp *KeyPool) HasAvailable() bool {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	for _, ks := range kp.keys {
+		if !now.Before(ks.cooldownUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+func (kp *KeyPool) lookup(key string) *keyState {
+	for _, ks := range kp.keys {
+		if ks.key == key {
+			return ks
+		}
+	}
+	return nil
+}
+
+func (kp *KeyPool) ReportSuccess(key string) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	if ks := kp.lookup(key); ks != nil {
+		ks.success++
+		ks.consecutiveFailures = 0
+		ks.cooldownUntil = time.Time{}
+	}
+}
+
+// 只有鉴权失败、限流、服务端错误和网络错误可能和 key 有关，400 这类请求本身的错误不算
+func countsAgainstKey(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusUnauthorized ||
+		statusCode == http.StatusForbidden ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= 500
+}
+
+// statusCode 为 0 表示请求没有得到响应，retryAfter 为 0 表示服务商没有给出
+func (kp *KeyPool) ReportFailure(key string, statusCode int, retryAfter time.Duration, err error) {
+	if !countsAgainstKey(statusCode) {
+		return
+	}
+
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	ks := kp.lookup(key)
+	if ks == nil {
+		return
+	}
+	ks.failure++
+	ks.consecutiveFailures++
+	if err != nil {
+		ks.lastError = err.Error()
+	}
+
+	var cooldown time.Duration
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		cooldown = unauthorizedCooldown
+	case statusCode == http.StatusTooManyRequests:
+		cooldown = backoff(rateLimitedCooldown, ks.consecutiveFailures)
+	case ks.consecutiveFailures >= maxConsecutiveFailures:
+		cooldown = backoff(failureCooldown, ks.consecutiveFailures-maxConsecutiveFailures+1)
+	}
+	if retryAfter > cooldown {
+		cooldown = retryAfter
+	}
+	if cooldown > 0 {
+		ks.cooldownUntil = time.Now().Add(cooldown)
+	}
+}
+
+func backoff(base time.Duration, times int) time.Duration {
+	d := base
+	for i := 1; i < times && d < maxCooldown; i++ {
+		d *= 2
+	}
+	if d > maxCooldown {
+		d = maxCooldown
+	}
+	return d
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return "****" + key[len(key)-4:]
+}
+
+func (kp *KeyPool) Stats() []KeyStats {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]KeyStats, 0, len(kp.keys))
+	for _, ks := range kp.keys {
+		stats = append(stats, KeyStats{
+			Key:           maskKey(ks.key),
+			Success:       ks.success,
+			Failure:       ks.failure,
+			Healthy:       !now.Before(ks.cooldownUntil),
+			CooldownUntil: ks.cooldownUntil,
+			LastError:     ks.lastError,
+		})
+	}
+	return stats
+}
+
+// 解析 Retry-After 头，支持秒数和 HTTP 日期两种格式
+func ParseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
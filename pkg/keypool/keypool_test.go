@@ -0,0 +1,141 @@
+package keypool
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNextRotates(t *testing.T) {
+	kp := NewKeyPool([]string{"a", "b", "c"})
+	got := []string{}
+	for i := 0; i < 4; i++ {
+		key, err := kp.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key)
+	}
+	if want := []string{"a", "b", "c", "a"}; !equal(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+
+	if _, err := NewKeyPool(nil).Next(); !errors.Is(err, ErrNoAvailableKey) {
+		t.Errorf("empty pool: err = %v, want ErrNoAvailableKey", err)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReportFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		times      int
+		retryAfter time.Duration
+		wantCool   bool
+	}{
+		{"bad request", http.StatusBadRequest, 10, 0, false},
+		{"payload too large", http.StatusRequestEntityTooLarge, 10, 0, false},
+		{"unprocessable", http.StatusUnprocessableEntity, 10, 0, false},
+		{"not found", http.StatusNotFound, 10, 0, false},
+		{"unauthorized", http.StatusUnauthorized, 1, 0, true},
+		{"forbidden", http.StatusForbidden, 1, 0, true},
+		{"rate limited", http.StatusTooManyRequests, 1, 0, true},
+		{"server error below threshold", http.StatusInternalServerError, maxConsecutiveFailures - 1, 0, false},
+		{"server error", http.StatusInternalServerError, maxConsecutiveFailures, 0, true},
+		{"server error with retry-after", http.StatusServiceUnavailable, 1, time.Minute, true},
+		{"transport error", 0, maxConsecutiveFailures, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp := NewKeyPool([]string{"key"})
+			for i := 0; i < tt.times; i++ {
+				kp.ReportFailure("key", tt.statusCode, tt.retryAfter, errors.New("failed"))
+			}
+			if got := !kp.HasAvailable(); got != tt.wantCool {
+				t.Errorf("cooling down = %v, want %v", got, tt.wantCool)
+			}
+			wantFailures := uint64(0)
+			if countsAgainstKey(tt.statusCode) {
+				wantFailures = uint64(tt.times)
+			}
+			if got := kp.Stats()[0].Failure; got != wantFailures {
+				t.Errorf("failures = %d, want %d", got, wantFailures)
+			}
+		})
+	}
+}
+
+func TestCooldownSkipsKey(t *testing.T) {
+	kp := NewKeyPool([]string{"a", "b"})
+	kp.ReportFailure("a", http.StatusUnauthorized, 0, nil)
+	for i := 0; i < 3; i++ {
+		if key, err := kp.Next(); err != nil || key != "b" {
+			t.Fatalf("Next = %q, %v, want b", key, err)
+		}
+	}
+
+	kp.ReportFailure("b", http.StatusTooManyRequests, 0, nil)
+	if _, err := kp.Next(); !errors.Is(err, ErrNoAvailableKey) {
+		t.Errorf("err = %v, want ErrNoAvailableKey", err)
+	}
+
+	kp.ReportSuccess("a")
+	if key, err := kp.Next(); err != nil || key != "a" {
+		t.Errorf("Next after success = %q, %v, want a", key, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		times int
+		want  time.Duration
+	}{
+		{1, failureCooldown},
+		{2, 2 * failureCooldown},
+		{3, 4 * failureCooldown},
+		{100, maxCooldown},
+	}
+	for _, tt := range tests {
+		if got := backoff(failureCooldown, tt.times); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.times, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{" 30 ", 30 * time.Second},
+		{"0", 0},
+		{"-1", 0},
+		{"soon", 0},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0},
+	}
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.header); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(future); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("ParseRetryAfter(%q) = %v, want about an hour", future, got)
+	}
+}
@@ -5,15 +5,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/vaaandark/qabot/pkg/chatcontext"
 	"github.com/vaaandark/qabot/pkg/onebot"
 )
 
 type MessageEnvelope struct {
-	Nickname   string
-	UserId     int64
-	TargetId   *int64
-	GroupId    *int64
-	Text       string
+	Nickname string
+	UserId   int64
+	TargetId *int64
+	GroupId  *int64
+	Text     string
+	// 用户消息中的图片
+	Images []chatcontext.Image
+	// 语音消息，转写后的文字放在 Text 中
+	Record *onebot.Record
+	// 合并转发，展开后放在 Text 前面
+	Forwards   []onebot.Forward
 	MessageId  int32
 	ReplyTo    *int32
 	IsFromSelf bool
@@ -21,6 +28,27 @@ type MessageEnvelope struct {
 	IsAt       bool
 	Timestamp  time.Time
 	ModelName  string
+	// 用 /model 为这次提问指定的提供商
+	PinnedModel string
+	// 服务商单独返回的思考过程，以合并转发的形式发送
+	Reasoning string
+	Stream    *StreamPart
+	// 得到回答之前调用工具的过程，和回答一起写入上下文
+	ToolMessages []chatcontext.Message
+	// 回答用掉的 token，和回答一起写入上下文
+	Usage *chatcontext.Usage
+	// 同意或拒绝请求时使用
+	Flag string
+}
+
+// 流式回复中的一段，非流式回复时为 nil
+type StreamPart struct {
+	Index int
+	// 最后一段发送完才把完整回复 Full 写入上下文
+	Final bool
+	Full  string
+	// 提问被撤回，回答到此为止，不发送也不写入上下文
+	Cancelled bool
 }
 
 func (m MessageEnvelope) GetGroupOrUserID() int64 {
@@ -37,6 +65,10 @@ func (m MessageEnvelope) GetNamespacedGroupOrUserID() string {
 	}
 }
 
+func (m MessageEnvelope) GetNamespacedUserID() string {
+	return fmt.Sprintf("user/%d", m.UserId)
+}
+
 func FromEvent(event onebot.Event, text *string, replyTo *int32, category onebot.MessageCategory, isAt bool) MessageEnvelope {
 	m := MessageEnvelope{
 		Nickname:   event.Sender.Nickname,
@@ -54,9 +86,32 @@ func FromEvent(event onebot.Event, text *string, replyTo *int32, category onebot
 	if text != nil {
 		m.Text = strings.TrimSpace(*text)
 	}
+	m.Record = event.Record()
+	m.Forwards = event.Message.Forwards()
+	for _, image := range event.Images() {
+		m.Images = append(m.Images, chatcontext.Image{
+			Url:  image.Url,
+			File: image.File,
+		})
+	}
 	return m
 }
 
+// 通知和请求事件，请求的附言放在 Text 中
+func FromNoticeEvent(event onebot.Event, category onebot.MessageCategory) MessageEnvelope {
+	return MessageEnvelope{
+		Nickname:   event.Sender.Nickname,
+		UserId:     event.UserId,
+		GroupId:    event.GroupId,
+		Text:       event.Comment,
+		MessageId:  event.MessageId,
+		IsFromSelf: event.IsFromSelf(),
+		Category:   category,
+		Flag:       event.Flag,
+		Timestamp:  time.Now(),
+	}
+}
+
 func (m MessageEnvelope) IsInGroup() bool {
 	return m.GroupId != nil
 }
@@ -0,0 +1,206 @@
+package onebot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// 调用 onebot 实现的 API，返回响应中的 data
+type Transport interface {
+	Call(action string, params interface{}) (json.RawMessage, error)
+}
+
+type Client struct {
+	Transport Transport
+}
+
+func NewClient(transport Transport) *Client {
+	return &Client{
+		Transport: transport,
+	}
+}
+
+// 每次调用都是一个单独的 HTTP 请求
+type HttpTransport struct {
+	Endpoint string
+	// 不为空时以 Authorization: Bearer 发送
+	AccessToken string
+	client      *http.Client
+}
+
+func NewHttpTransport(endpoint, accessToken string) *HttpTransport {
+	return &HttpTransport{
+		Endpoint:    endpoint,
+		AccessToken: accessToken,
+		client:      &http.Client{},
+	}
+}
+
+type ApiRequest struct {
+	Action string      `json:"action"`
+	Params interface{} `json:"params"`
+	Echo   string      `json:"echo,omitempty"`
+}
+
+type ApiResponse struct {
+	Status  string          `json:"status"`
+	RetCode int32           `json:"retcode"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message,omitempty"`
+	Echo    json.RawMessage `json:"echo,omitempty"`
+}
+
+func (r ApiResponse) Result(action string) (json.RawMessage, error) {
+	if r.Status == "failed" {
+		return nil, fmt.Errorf("%s failed with retcode %d: %s", action, r.RetCode, r.Message)
+	}
+	return r.Data, nil
+}
+
+func (t *HttpTransport) Call(action string, params interface{}) (json.RawMessage, error) {
+	url := fmt.Sprintf("%s/%s", t.Endpoint, action)
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if len(t.AccessToken) != 0 {
+		req.Header.Add("Authorization", "Bearer "+t.AccessToken)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := ApiResponse{}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return nil, err
+	}
+	return response.Result(action)
+}
+
+// 调用 action，把响应中的 data 解析到 data 中，data 为 nil 时忽略
+func (c *Client) Call(action string, params interface{}, data interface{}) error {
+	raw, err := c.Transport.Call(action, params)
+	if err != nil {
+		return err
+	}
+	if data == nil || len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return json.Unmarshal(raw, data)
+}
+
+func (c *Client) SendMessage(action string, message interface{}) (int32, error) {
+	data := SendResponseData{}
+	if err := c.Call(action, message, &data); err != nil {
+		return 0, err
+	}
+	return data.MessageId, nil
+}
+
+type RecordData struct {
+	// onebot 实现所在机器上的路径
+	File   string `json:"file"`
+	Url    string `json:"url,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+// 让 onebot 实现把语音转换成 outFormat（mp3、wav 等）
+func (c *Client) GetRecord(file, outFormat string) (*RecordData, error) {
+	data := &RecordData{}
+	params := map[string]string{
+		"file":       file,
+		"out_format": outFormat,
+	}
+	if err := c.Call("get_record", params, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 合并转发中的一条消息
+type ForwardNode struct {
+	Sender  Sender  `json:"sender"`
+	Message Message `json:"message"`
+	// go-cqhttp 放在 content 中
+	Content Message `json:"content"`
+}
+
+func (n ForwardNode) Segments() Message {
+	if len(n.Message) != 0 {
+		return n.Message
+	}
+	return n.Content
+}
+
+func (c *Client) GetForwardMsg(id string) ([]ForwardNode, error) {
+	data := struct {
+		Messages []ForwardNode `json:"messages"`
+	}{}
+	// napcat 用 message_id，有些实现用 id
+	params := map[string]string{
+		"message_id": id,
+		"id":         id,
+	}
+	if err := c.Call("get_forward_msg", params, &data); err != nil {
+		return nil, err
+	}
+	return data.Messages, nil
+}
+
+// 取出一条消息的内容，用来展开被回复的消息中的合并转发
+func (c *Client) GetMsg(messageId int32) (Message, error) {
+	data := struct {
+		Message Message `json:"message"`
+	}{}
+	params := map[string]int32{
+		"message_id": messageId,
+	}
+	if err := c.Call("get_msg", params, &data); err != nil {
+		return nil, err
+	}
+	return data.Message, nil
+}
+
+// 撤回消息，bot 只能撤回自己两分钟内发送的消息，或者作为管理员撤回群成员的消息
+func (c *Client) DeleteMsg(messageId int32) error {
+	params := map[string]int32{
+		"message_id": messageId,
+	}
+	return c.Call("delete_msg", params, nil)
+}
+
+func (c *Client) SetFriendAddRequest(flag string, approve bool) error {
+	params := map[string]interface{}{
+		"flag":    flag,
+		"approve": approve,
+	}
+	return c.Call("set_friend_add_request", params, nil)
+}
+
+// subType 为 add（加群请求）或 invite（邀请 bot 入群）
+func (c *Client) SetGroupAddRequest(flag, subType string, approve bool) error {
+	params := map[string]interface{}{
+		"flag":     flag,
+		"sub_type": subType,
+		"approve":  approve,
+	}
+	return c.Call("set_group_add_request", params, nil)
+}
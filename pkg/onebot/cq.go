@@ -0,0 +1,119 @@
+package onebot
+
+import (
+	"strings"
+)
+
+// CQ 码的转义：文本中转义 & [ ]，参数值中还要转义逗号
+var (
+	textEscaper   = strings.NewReplacer("&", "&amp;", "[", "&#91;", "]", "&#93;")
+	paramEscaper  = strings.NewReplacer("&", "&amp;", "[", "&#91;", "]", "&#93;", ",", "&#44;")
+	cqUnescaper   = strings.NewReplacer("&#91;", "[", "&#93;", "]", "&#44;", ",", "&amp;", "&")
+	cqCodePrefix  = "[CQ:"
+	cqCodeEndRune = ']'
+)
+
+func EscapeCQText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func EscapeCQParam(s string) string {
+	return paramEscaper.Replace(s)
+}
+
+func UnescapeCQ(s string) string {
+	return cqUnescaper.Replace(s)
+}
+
+// 解析字符串格式的消息，不合法的 CQ 码当作文本
+func ParseCQ(s string) Message {
+	message := Message{}
+	text := strings.Builder{}
+	flushText := func() {
+		if text.Len() != 0 {
+			message = append(message, Text{Text: UnescapeCQ(text.String())})
+			text.Reset()
+		}
+	}
+
+	for len(s) != 0 {
+		start := strings.Index(s, cqCodePrefix)
+		if start < 0 {
+			text.WriteString(s)
+			break
+		}
+		end := strings.IndexRune(s[start:], cqCodeEndRune)
+		if end < 0 {
+			text.WriteString(s)
+			break
+		}
+		end += start
+
+		segment, ok := parseCQCode(s[start+len(cqCodePrefix) : end])
+		if !ok {
+			// 只跳过前缀，后面可能还有合法的 CQ 码
+			text.WriteString(s[:start+len(cqCodePrefix)])
+			s = s[start+len(cqCodePrefix):]
+			continue
+		}
+		text.WriteString(s[:start])
+		flushText()
+		message = append(message, segment)
+		s = s[end+1:]
+	}
+	flushText()
+	return message
+}
+
+// body 形如 image,file=a.jpg,url=https://...
+func parseCQCode(body string) (Segment, bool) {
+	parts := strings.Split(body, ",")
+	segmentType := parts[0]
+	if !isSegmentType(segmentType) {
+		return nil, false
+	}
+	data := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		key, value, found := strings.Cut(part, "=")
+		if !found || len(key) == 0 {
+			return nil, false
+		}
+		data[key] = UnescapeCQ(value)
+	}
+	return NewSegment(segmentType, data), true
+}
+
+// 序列化成字符串格式
+func (m Message) CQString() string {
+	sb := strings.Builder{}
+	for _, s := range m {
+		if t, ok := s.(Text); ok {
+			sb.WriteString(EscapeCQText(t.Text))
+			continue
+		}
+		sb.WriteString(cqCodePrefix)
+		sb.WriteString(s.SegmentType())
+		keys, data := SegmentData(s)
+		for _, key := range keys {
+			sb.WriteString(",")
+			sb.WriteString(key)
+			sb.WriteString("=")
+			sb.WriteString(EscapeCQParam(data[key]))
+		}
+		sb.WriteRune(cqCodeEndRune)
+	}
+	return sb.String()
+}
+
+// 消息段类型只由小写字母、数字和下划线组成
+func isSegmentType(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package onebot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCQ(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Message
+	}{
+		{"plain text", "hello", Message{Text{Text: "hello"}}},
+		{"escaped text", "a &#91;b&#93; &amp;&#44;", Message{Text{Text: "a [b] &,"}}},
+		{"at and text", "[CQ:at,qq=123] hi", Message{At{Qq: "123"}, Text{Text: " hi"}}},
+		{"escaped param", "[CQ:image,file=a.jpg,url=http://x/?a=1&#44;2&amp;b=&#91;c&#93;]",
+			Message{Image{File: "a.jpg", Url: "http://x/?a=1,2&b=[c]"}}},
+		{"param with equals sign", "[CQ:image,url=http://x/?a=b]", Message{Image{Url: "http://x/?a=b"}}},
+		{"unknown segment", "[CQ:mface,emoji_id=1,summary=[x]",
+			Message{Unknown{Type: "mface", Data: map[string]string{"emoji_id": "1", "summary": "[x"}}}},
+		{"unterminated", "[CQ:at,qq=1", Message{Text{Text: "[CQ:at,qq=1"}}},
+		{"empty type", "[CQ:]", Message{Text{Text: "[CQ:]"}}},
+		{"param without value", "[CQ:at,qq]", Message{Text{Text: "[CQ:at,qq]"}}},
+		{"empty key", "[CQ:at,=1]", Message{Text{Text: "[CQ:at,=1]"}}},
+		{"invalid type", "[CQ:a b]", Message{Text{Text: "[CQ:a b]"}}},
+		{"valid code after malformed one", "[CQ:x [CQ:at,qq=1]!",
+			Message{Text{Text: "[CQ:x "}, At{Qq: "1"}, Text{Text: "!"}}},
+		{"adjacent codes", "[CQ:reply,id=5][CQ:face,id=14]", Message{Reply{Id: "5"}, Face{Id: "14"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseCQ(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCQRoundTrip(t *testing.T) {
+	tests := []Message{
+		{Text{Text: "a[b]c&d,e &#91;"}},
+		{Reply{Id: "1"}, At{Qq: "all"}, Text{Text: " hi"}},
+		{Image{File: "a,b.jpg", Url: "http://x/?q=[1]&r=2", SubType: "0"}},
+		{Json{Data: `{"app":"com.tencent","meta":{"a":[1,2]}}`}},
+		{Unknown{Type: "mface", Data: map[string]string{"emoji_id": "1", "summary": "[动画表情]"}}},
+		{Text{Text: "[CQ:at,qq=1]"}},
+	}
+	for _, message := range tests {
+		s := message.CQString()
+		if got := ParseCQ(s); !reflect.DeepEqual(got, message) {
+			t.Errorf("%q: got %#v, want %#v", s, got, message)
+		}
+	}
+}
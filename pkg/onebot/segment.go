@@ -0,0 +1,382 @@
+package onebot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// 消息段，具体类型见下面的结构体，字段的 cq 标签是 data 中的键
+type Segment interface {
+	SegmentType() string
+}
+
+// 数组格式中收到的原始 data，包括结构体中没有的键和不是字符串的值。
+// 再次序列化成 JSON 时以它为基础，字段改过的值会覆盖它，所以不会丢失数据
+type RawData map[string]json.RawMessage
+
+type Text struct {
+	Text string `cq:"text"`
+	RawData
+}
+
+type At struct {
+	// QQ 号，all 表示全体成员
+	Qq string `cq:"qq"`
+	RawData
+}
+
+type Reply struct {
+	Id string `cq:"id"`
+	RawData
+}
+
+type Face struct {
+	Id string `cq:"id"`
+	RawData
+}
+
+type Image struct {
+	File    string `cq:"file"`
+	Url     string `cq:"url"`
+	Summary string `cq:"summary"`
+	SubType string `cq:"sub_type"`
+	RawData
+}
+
+type Record struct {
+	File string `cq:"file"`
+	Url  string `cq:"url"`
+	Path string `cq:"path"`
+	RawData
+}
+
+type Video struct {
+	File string `cq:"file"`
+	Url  string `cq:"url"`
+	RawData
+}
+
+type File struct {
+	File string `cq:"file"`
+	Name string `cq:"name"`
+	Url  string `cq:"url"`
+	Size string `cq:"file_size"`
+	RawData
+}
+
+// 合并转发，内容需要用 get_forward_msg 获取
+type Forward struct {
+	Id string `cq:"id"`
+	RawData
+}
+
+type Json struct {
+	Data string `cq:"data"`
+	RawData
+}
+
+type Xml struct {
+	Data string `cq:"data"`
+	RawData
+}
+
+type Markdown struct {
+	Content string `cq:"content"`
+	RawData
+}
+
+type Poke struct {
+	Type string `cq:"type"`
+	Id   string `cq:"id"`
+	RawData
+}
+
+type Dice struct {
+	Result string `cq:"result"`
+	RawData
+}
+
+type Rps struct {
+	Result string `cq:"result"`
+	RawData
+}
+
+// 不认识的消息段原样保留，不是字符串的值在 Data 中是它们的 JSON 文本
+type Unknown struct {
+	Type string
+	Data map[string]string
+	RawData
+}
+
+func (Text) SegmentType() string     { return "text" }
+func (At) SegmentType() string       { return "at" }
+func (Reply) SegmentType() string    { return "reply" }
+func (Face) SegmentType() string     { return "face" }
+func (Image) SegmentType() string    { return "image" }
+func (Record) SegmentType() string   { return "record" }
+func (Video) SegmentType() string    { return "video" }
+func (File) SegmentType() string     { return "file" }
+func (Forward) SegmentType() string  { return "forward" }
+func (Json) SegmentType() string     { return "json" }
+func (Xml) SegmentType() string      { return "xml" }
+func (Markdown) SegmentType() string { return "markdown" }
+func (Poke) SegmentType() string     { return "poke" }
+func (Dice) SegmentType() string     { return "dice" }
+func (Rps) SegmentType() string      { return "rps" }
+func (u Unknown) SegmentType() string {
+	return u.Type
+}
+
+var segmentTypes = func() map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	for _, s := range []Segment{Text{}, At{}, Reply{}, Face{}, Image{}, Record{}, Video{}, File{}, Forward{}, Json{}, Xml{}, Markdown{}, Poke{}, Dice{}, Rps{}} {
+		types[s.SegmentType()] = reflect.TypeOf(s)
+	}
+	return types
+}()
+
+func NewSegment(segmentType string, data map[string]string) Segment {
+	t, ok := segmentTypes[segmentType]
+	if !ok {
+		return Unknown{Type: segmentType, Data: data}
+	}
+	v := reflect.New(t).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("cq")
+		if len(key) == 0 {
+			continue
+		}
+		if value, ok := data[key]; ok {
+			v.Field(i).SetString(value)
+		}
+	}
+	return v.Interface().(Segment)
+}
+
+func withRawData(s Segment, raw RawData) Segment {
+	v := reflect.New(reflect.TypeOf(s)).Elem()
+	v.Set(reflect.ValueOf(s))
+	v.FieldByName("RawData").Set(reflect.ValueOf(raw))
+	return v.Interface().(Segment)
+}
+
+func rawDataOf(s Segment) RawData {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	if field := v.FieldByName("RawData"); field.IsValid() {
+		return field.Interface().(RawData)
+	}
+	return nil
+}
+
+// 按键排序，序列化的结果是稳定的
+func SegmentData(s Segment) (keys []string, data map[string]string) {
+	data = make(map[string]string)
+	if u, ok := s.(Unknown); ok {
+		for k, v := range u.Data {
+			data[k] = v
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys, data
+	}
+
+	v := reflect.ValueOf(s)
+	t := v.Type()
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("cq")
+		if len(key) == 0 {
+			continue
+		}
+		fields[key] = true
+		value := v.Field(i).String()
+		// text 段的空文本也要保留
+		if len(value) == 0 && t != reflect.TypeOf(Text{}) {
+			continue
+		}
+		data[key] = value
+		keys = append(keys, key)
+	}
+	// 结构体中没有的键也要保留
+	extra := []string{}
+	for key, raw := range rawDataOf(s) {
+		if fields[key] {
+			continue
+		}
+		value, err := dataValueString(raw)
+		if err != nil {
+			continue
+		}
+		data[key] = value
+		extra = append(extra, key)
+	}
+	sort.Strings(extra)
+	return append(keys, extra...), data
+}
+
+type Message []Segment
+
+// 数组格式的消息段
+type rawSegment struct {
+	Type string                     `json:"type"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+// 同时支持数组格式和字符串（CQ 码）格式
+func (m *Message) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || string(b) == "null" {
+		*m = nil
+		return nil
+	}
+	if b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*m = ParseCQ(s)
+		return nil
+	}
+
+	raws := []rawSegment{}
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return err
+	}
+	message := make(Message, 0, len(raws))
+	for _, raw := range raws {
+		data := make(map[string]string, len(raw.Data))
+		rawData := make(RawData, len(raw.Data))
+		for k, v := range raw.Data {
+			value, err := dataValueString(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s segment: %v", raw.Type, err)
+			}
+			data[k] = value
+			rawData[k] = bytes.TrimSpace(v)
+		}
+		message = append(message, withRawData(NewSegment(raw.Type, data), rawData))
+	}
+	*m = message
+	return nil
+}
+
+// onebot 实现给出的值不一定是字符串，统一转换成 CQ 码中的字符串形式
+func dataValueString(v json.RawMessage) (string, error) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 || string(v) == "null" {
+		return "", nil
+	}
+	if v[0] == '"' {
+		var s string
+		err := json.Unmarshal(v, &s)
+		return s, err
+	}
+	if !json.Valid(v) {
+		return "", fmt.Errorf("invalid value %s", string(v))
+	}
+	// 数字、布尔值、对象和数组保留 JSON 文本
+	return string(v), nil
+}
+
+// 从收到的原始 data 出发，值没有被改过的键保留原来的类型
+func (m Message) MarshalJSON() ([]byte, error) {
+	type segment struct {
+		Type string                 `json:"type"`
+		Data map[string]interface{} `json:"data"`
+	}
+	segments := make([]segment, 0, len(m))
+	for _, s := range m {
+		rawData := rawDataOf(s)
+		values := make(map[string]interface{}, len(rawData))
+		for key, raw := range rawData {
+			values[key] = raw
+		}
+		_, data := SegmentData(s)
+		for key, value := range data {
+			if raw, ok := rawData[key]; ok {
+				if original, err := dataValueString(raw); err == nil && original == value {
+					continue
+				}
+			}
+			values[key] = value
+		}
+		segments = append(segments, segment{Type: s.SegmentType(), Data: values})
+	}
+	return json.Marshal(segments)
+}
+
+// 拼接所有 text 段
+func (m Message) PlainText() string {
+	text := ""
+	for _, s := range m {
+		if t, ok := s.(Text); ok {
+			text += t.Text
+		}
+	}
+	return text
+}
+
+func (m Message) IsAt(qq int64) bool {
+	qqStr := strconv.FormatInt(qq, 10)
+	for _, s := range m {
+		if at, ok := s.(At); ok && at.Qq == qqStr {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Message) Reply() *Reply {
+	for _, s := range m {
+		if r, ok := s.(Reply); ok {
+			return &r
+		}
+	}
+	return nil
+}
+
+func (m Message) Images() []Image {
+	images := []Image{}
+	for _, s := range m {
+		if image, ok := s.(Image); ok && (len(image.Url) != 0 || len(image.File) != 0) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// 语音消息中只有一个 record 段
+func (m Message) Record() *Record {
+	for _, s := range m {
+		if r, ok := s.(Record); ok {
+			return &r
+		}
+	}
+	return nil
+}
+
+func (m Message) Json() *Json {
+	for _, s := range m {
+		if j, ok := s.(Json); ok {
+			return &j
+		}
+	}
+	return nil
+}
+
+func (m Message) Forwards() []Forward {
+	forwards := []Forward{}
+	for _, s := range m {
+		if f, ok := s.(Forward); ok && len(f.Id) != 0 {
+			forwards = append(forwards, f)
+		}
+	}
+	return forwards
+}
@@ -0,0 +1,152 @@
+package onebot
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Message
+	}{
+		{"null", `null`, nil},
+		{"cq string", `"[CQ:at,qq=1] hi"`, Message{At{Qq: "1"}, Text{Text: " hi"}}},
+		{"array", `[{"type":"reply","data":{"id":"9"}},{"type":"text","data":{"text":"[x]"}}]`,
+			Message{
+				Reply{Id: "9", RawData: RawData{"id": json.RawMessage(`"9"`)}},
+				Text{Text: "[x]", RawData: RawData{"text": json.RawMessage(`"[x]"`)}},
+			}},
+		{"number in known field", `[{"type":"face","data":{"id":14}}]`,
+			Message{Face{Id: "14", RawData: RawData{"id": json.RawMessage(`14`)}}}},
+		{"null value", `[{"type":"image","data":{"file":"a.jpg","url":null}}]`,
+			Message{Image{File: "a.jpg", RawData: RawData{"file": json.RawMessage(`"a.jpg"`), "url": json.RawMessage(`null`)}}}},
+		{"non-string values in unknown segment",
+			`[{"type":"node","data":{"id":7,"hidden":false,"content":[{"type":"text","data":{"text":"hi"}}]}}]`,
+			Message{Unknown{
+				Type: "node",
+				Data: map[string]string{"id": "7", "hidden": "false", "content": `[{"type":"text","data":{"text":"hi"}}]`},
+				RawData: RawData{
+					"id":      json.RawMessage(`7`),
+					"hidden":  json.RawMessage(`false`),
+					"content": json.RawMessage(`[{"type":"text","data":{"text":"hi"}}]`),
+				},
+			}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Message
+			if err := json.Unmarshal([]byte(tt.input), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// napcat 上报的消息，包含结构体中没有的键和不是字符串的值
+const napcatMessage = `[
+	{"type":"reply","data":{"id":"-2147480001"}},
+	{"type":"at","data":{"qq":"999","name":"qabot"}},
+	{"type":"text","data":{"text":" 看看这张图"}},
+	{"type":"image","data":{"summary":"","file":"3B9F5C0E6A7A1A8E2C1D3F4B5A6C7D8E.jpg","sub_type":0,"url":"https://multimedia.nt.qq.com.cn/download?appid=1407&fileid=EhQxYjNhZGM&rkey=CAQSKAB6JWENi5LM","file_size":"123456"}},
+	{"type":"face","data":{"id":"14","raw":{"faceIndex":14,"faceText":"/微笑","faceType":1},"resultId":null,"chainCount":null}},
+	{"type":"mface","data":{"summary":"[动画表情]","url":"https://gxh.vip.qq.com/club/item/parcel/item/a.gif","emoji_id":"a","emoji_package_id":230,"key":"k"}}
+]`
+
+func jsonValue(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMarshalMessageRoundTrip(t *testing.T) {
+	var message Message
+	if err := json.Unmarshal([]byte(napcatMessage), &message); err != nil {
+		t.Fatal(err)
+	}
+	images := message.Images()
+	if len(images) != 1 || images[0].File != "3B9F5C0E6A7A1A8E2C1D3F4B5A6C7D8E.jpg" || images[0].SubType != "0" {
+		t.Fatalf("images = %+v", images)
+	}
+
+	output, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jsonValue(t, output), jsonValue(t, []byte(napcatMessage)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", output, napcatMessage)
+	}
+
+	// 再解析、序列化一次结果不变
+	var again Message
+	if err := json.Unmarshal(output, &again); err != nil {
+		t.Fatal(err)
+	}
+	if got := again.Images(); len(got) != 1 || got[0].Url != images[0].Url {
+		t.Errorf("images = %+v, want %+v", got, images)
+	}
+	if output2, err := json.Marshal(again); err != nil || string(output2) != string(output) {
+		t.Errorf("got %s, want %s (%v)", output2, output, err)
+	}
+}
+
+func TestMarshalModifiedSegment(t *testing.T) {
+	var message Message
+	if err := json.Unmarshal([]byte(`[{"type":"image","data":{"file":"a.jpg","sub_type":0,"file_size":"1","url":"http://old"}}]`), &message); err != nil {
+		t.Fatal(err)
+	}
+	image := message[0].(Image)
+	image.Url = "http://new"
+	message[0] = image
+
+	output, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"type":"image","data":{"file":"a.jpg","file_size":"1","sub_type":0,"url":"http://new"}}]`
+	if string(output) != want {
+		t.Errorf("got %s, want %s", output, want)
+	}
+}
+
+func TestMarshalBuiltMessage(t *testing.T) {
+	output, err := json.Marshal(Message{Reply{Id: "1"}, Text{Text: ""}, Image{File: "a.jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"type":"reply","data":{"id":"1"}},{"type":"text","data":{"text":""}},{"type":"image","data":{"file":"a.jpg"}}]`
+	if string(output) != want {
+		t.Errorf("got %s, want %s", output, want)
+	}
+}
+
+func TestCQStringKeepsExtraKeys(t *testing.T) {
+	var message Message
+	if err := json.Unmarshal([]byte(`[{"type":"image","data":{"file":"a.jpg","sub_type":0,"file_size":"1"}}]`), &message); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := message.CQString(), "[CQ:image,file=a.jpg,sub_type=0,file_size=1]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestUnmarshalMessageErrors(t *testing.T) {
+	for _, input := range []string{
+		`[{"type":"text","data":{"text":"a"}`,
+		`{"type":"text"}`,
+		`"unterminated`,
+	} {
+		var message Message
+		if err := json.Unmarshal([]byte(input), &message); err == nil {
+			t.Errorf("%s: expected error, got %#v", input, message)
+		}
+	}
+}
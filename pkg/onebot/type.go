@@ -3,7 +3,6 @@ package onebot
 import (
 	"encoding/json"
 	"fmt"
-	"html"
 	"log"
 	"strconv"
 	"strings"
@@ -15,21 +14,36 @@ const (
 	CategoryChat  MessageCategory = "chat"
 	CategoryCmd   MessageCategory = "cmd"
 	CategoryShare MessageCategory = "share"
+	// 撤回通知，MessageId 是被撤回的消息
+	CategoryRecall MessageCategory = "recall"
+	// 戳了戳 bot
+	CategoryPoke MessageCategory = "poke"
+	// 有人加入群
+	CategoryJoin MessageCategory = "join"
+	// 加好友请求和邀请 bot 入群的请求
+	CategoryFriendRequest MessageCategory = "friend_request"
+	CategoryGroupInvite   MessageCategory = "group_invite"
 )
 
 type Event struct {
-	Time        int64          `json:"time"`
-	SelfId      int64          `json:"self_id"`
-	PostType    string         `json:"post_type"`
-	MessageType string         `json:"message_type"`
-	SubType     string         `json:"sub_type"`
-	MessageId   int32          `json:"message_id"`
-	UserId      int64          `json:"user_id"`
-	TargetId    *int64         `json:"target_id,omitempty"`
-	RawMessage  string         `json:"raw_message"`
-	Sender      Sender         `json:"sender"`
-	GroupId     *int64         `json:"group_id,omitempty"`
-	Message     []TypedMessage `json:"message"`
+	Time        int64   `json:"time"`
+	SelfId      int64   `json:"self_id"`
+	PostType    string  `json:"post_type"`
+	MessageType string  `json:"message_type"`
+	SubType     string  `json:"sub_type"`
+	MessageId   int32   `json:"message_id"`
+	UserId      int64   `json:"user_id"`
+	TargetId    *int64  `json:"target_id,omitempty"`
+	RawMessage  string  `json:"raw_message"`
+	Sender      Sender  `json:"sender"`
+	GroupId     *int64  `json:"group_id,omitempty"`
+	Message     Message `json:"message"`
+	NoticeType  string  `json:"notice_type,omitempty"`
+	OperatorId  *int64  `json:"operator_id,omitempty"`
+	RequestType string  `json:"request_type,omitempty"`
+	// 处理请求时需要带上
+	Flag    string `json:"flag,omitempty"`
+	Comment string `json:"comment,omitempty"`
 }
 
 func (e Event) IsFromSelf() bool {
@@ -40,27 +54,49 @@ func (e Event) IsMessage() bool {
 	return e.PostType == "message"
 }
 
-func (e Event) IsAtSelf() bool {
-	for _, m := range e.Message {
-		if m.Type == "at" && m.Data.Qq == strconv.FormatInt(e.SelfId, 10) {
-			return true
+// 决定通知和请求事件是否应该传给 chatter，以及交给哪个处理器
+func (e Event) ProcessNotice() (category MessageCategory, ok bool) {
+	switch e.PostType {
+	case "notice":
+		switch e.NoticeType {
+		case "group_recall", "friend_recall":
+			return CategoryRecall, true
+		case "notify":
+			if e.SubType == "poke" && e.TargetId != nil && *e.TargetId == e.SelfId && !e.IsFromSelf() {
+				return CategoryPoke, true
+			}
+		case "group_increase":
+			// bot 自己入群也会收到
+			if !e.IsFromSelf() {
+				return CategoryJoin, true
+			}
+		}
+	case "request":
+		if e.RequestType == "friend" {
+			return CategoryFriendRequest, true
+		}
+		if e.RequestType == "group" && e.SubType == "invite" {
+			return CategoryGroupInvite, true
 		}
 	}
-	return false
+	return "", false
+}
+
+func (e Event) IsAtSelf() bool {
+	return e.Message.IsAt(e.SelfId)
 }
 
 func (e Event) ReplyTo() *int32 {
-	for _, m := range e.Message {
-		if m.Type == "reply" {
-			n, err := strconv.ParseInt(m.Data.Id, 10, 32)
-			if err != nil {
-				continue
-			}
-			replyTo := int32(n)
-			return &replyTo
-		}
+	reply := e.Message.Reply()
+	if reply == nil {
+		return nil
 	}
-	return nil
+	n, err := strconv.ParseInt(reply.Id, 10, 32)
+	if err != nil {
+		return nil
+	}
+	replyTo := int32(n)
+	return &replyTo
 }
 
 func (e Event) IsInGroup() bool {
@@ -68,13 +104,16 @@ func (e Event) IsInGroup() bool {
 }
 
 func (e Event) CatText() string {
-	text := ""
-	for _, m := range e.Message {
-		if m.Type == "text" {
-			text += m.Data.Text
-		}
-	}
-	return text
+	return e.Message.PlainText()
+}
+
+// 消息中的图片段
+func (e Event) Images() []Image {
+	return e.Message.Images()
+}
+
+func (e Event) Record() *Record {
+	return e.Message.Record()
 }
 
 // 处理消息文本并决定消息是否应该传给 chatter
@@ -93,7 +132,7 @@ func (e Event) ProcessText() (text string, replyTo *int32, shouldBeIgnored bool,
 	} else {
 		if e.IsAtSelf() {
 			shouldBeIgnored = false
-			isAt = false
+			isAt = true
 		}
 
 		if replyTo != nil {
@@ -101,13 +140,10 @@ func (e Event) ProcessText() (text string, replyTo *int32, shouldBeIgnored bool,
 		}
 	}
 
-	if rawMessage := strings.TrimSpace(e.RawMessage); strings.HasPrefix(rawMessage, "[CQ:json") {
+	if share := e.Message.Json(); share != nil {
 		shouldBeIgnored = false
 		category = CategoryShare
 
-		rawMessage = strings.TrimPrefix(rawMessage, "[CQ:json,data=")
-		rawMessage = strings.TrimSuffix(rawMessage, "]")
-		rawMessage = html.UnescapeString(rawMessage)
 		var result struct {
 			Prompt string `json:"prompt"`
 			Meta   struct {
@@ -119,7 +155,7 @@ func (e Event) ProcessText() (text string, replyTo *int32, shouldBeIgnored bool,
 				} `json:"news,omitempty"`
 			} `json:"meta"`
 		}
-		if err := json.Unmarshal([]byte(rawMessage), &result); err == nil {
+		if err := json.Unmarshal([]byte(share.Data), &result); err == nil {
 			text = result.Prompt + "\n"
 			if len(result.Meta.Detail.QQDocURL) != 0 {
 				text += result.Meta.Detail.QQDocURL + "\n"
@@ -149,25 +185,14 @@ type Sender struct {
 	GroupId  *int64 `json:"group_id,omitempty"`
 }
 
-type Data struct {
-	Text string `json:"text,omitempty"`
-	Qq   string `json:"qq,omitempty"`
-	Id   string `json:"id,omitempty"`
-}
-
-type TypedMessage struct {
-	Type string `json:"type,omitempty"`
-	Data Data   `json:"data"`
-}
-
 type PrivateMessage struct {
-	UserId  int64          `json:"user_id"`
-	Message []TypedMessage `json:"message"`
+	UserId  int64   `json:"user_id"`
+	Message Message `json:"message"`
 }
 
 type GroupMessage struct {
-	GroupId int64          `json:"group_id"`
-	Message []TypedMessage `json:"message"`
+	GroupId int64   `json:"group_id"`
+	Message Message `json:"message"`
 }
 
 type GroupForwardMessage struct {
@@ -186,9 +211,9 @@ type ForwardMessage struct {
 }
 
 type ForwardMessageData struct {
-	UserId   int64          `json:"user_id"`
-	Nickname string         `json:"nickname"`
-	Content  []TypedMessage `json:"content"`
+	UserId   int64   `json:"user_id"`
+	Nickname string  `json:"nickname"`
+	Content  Message `json:"content"`
 }
 
 func NewPrivateForwordMessage(userId int64, messageText string) PrivateForwardMessage {
@@ -200,14 +225,7 @@ func NewPrivateForwordMessage(userId int64, messageText string) PrivateForwardMe
 				Data: ForwardMessageData{
 					UserId:   0,
 					Nickname: "QQ用户",
-					Content: []TypedMessage{
-						{
-							Type: "text",
-							Data: Data{
-								Text: messageText,
-							},
-						},
-					},
+					Content:  Message{Text{Text: messageText}},
 				},
 			},
 		},
@@ -223,14 +241,7 @@ func NewGroupForwordMessage(groupId int64, messageText string) GroupForwardMessa
 				Data: ForwardMessageData{
 					UserId:   0,
 					Nickname: "QQ用户",
-					Content: []TypedMessage{
-						{
-							Type: "text",
-							Data: Data{
-								Text: messageText,
-							},
-						},
-					},
+					Content:  Message{Text{Text: messageText}},
 				},
 			},
 		},
@@ -238,32 +249,17 @@ func NewGroupForwordMessage(groupId int64, messageText string) GroupForwardMessa
 }
 
 func NewPrivateMessage(dialogBaseUrl string, userId int64, modelName string, messageText string, replyTo *string) PrivateMessage {
-	message := []TypedMessage{}
+	message := Message{}
 
 	if replyTo != nil {
-		message = append(message, TypedMessage{
-			Type: "reply",
-			Data: Data{
-				Id: *replyTo,
-			},
-		})
+		message = append(message, Reply{Id: *replyTo})
 	}
 
 	if len(modelName) != 0 {
-		message = append(message, TypedMessage{
-			Type: "text",
-			Data: Data{
-				Text: fmt.Sprintf("[%s]\n", modelName),
-			},
-		})
+		message = append(message, Text{Text: fmt.Sprintf("[%s]\n", modelName)})
 	}
 
-	message = append(message, TypedMessage{
-		Type: "text",
-		Data: Data{
-			Text: messageText,
-		},
-	})
+	message = append(message, Text{Text: messageText})
 
 	return PrivateMessage{
 		UserId:  userId,
@@ -272,39 +268,24 @@ func NewPrivateMessage(dialogBaseUrl string, userId int64, modelName string, mes
 }
 
 func NewGroupMessage(dialogBaseUrl string, groupId int64, modelName string, messageText string, at *string, replyTo *string) GroupMessage {
-	message := []TypedMessage{}
+	message := Message{}
 
 	if replyTo != nil {
-		message = append(message, TypedMessage{
-			Type: "reply",
-			Data: Data{
-				Id: *replyTo,
-			},
-		})
+		message = append(message, Reply{Id: *replyTo})
 	}
 
 	if at != nil {
 		message = append(message,
-			TypedMessage{Type: "at", Data: Data{Qq: *at}},
-			TypedMessage{Type: "text", Data: Data{Text: " "}},
+			At{Qq: *at},
+			Text{Text: " "},
 		)
 	}
 
 	if len(modelName) != 0 {
-		message = append(message, TypedMessage{
-			Type: "text",
-			Data: Data{
-				Text: fmt.Sprintf("[%s]\n", modelName),
-			},
-		})
+		message = append(message, Text{Text: fmt.Sprintf("[%s]\n", modelName)})
 	}
 
-	message = append(message, TypedMessage{
-		Type: "text",
-		Data: Data{
-			Text: messageText,
-		},
-	})
+	message = append(message, Text{Text: messageText})
 
 	return GroupMessage{
 		GroupId: groupId,
@@ -312,6 +293,11 @@ func NewGroupMessage(dialogBaseUrl string, groupId int64, modelName string, mess
 	}
 }
 
+// 语音只能单独作为一条消息发送
+func NewRecordMessage(file string) Message {
+	return Message{Record{File: file}}
+}
+
 type SendResponse struct {
 	Status  string           `json:"status"`
 	RetCode int32            `json:"retcode"`
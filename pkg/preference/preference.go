@@ -0,0 +1,52 @@
+package preference
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	KindModel = "model"
+	// 在群或私聊中用语音回答：on、only 或 off
+	KindTTS = "tts"
+)
+
+// 用户或群的偏好设置，和上下文存在同一个数据库中
+type Store struct {
+	db *leveldb.DB
+}
+
+func NewStore(db *leveldb.DB) Store {
+	return Store{db: db}
+}
+
+func key(kind, namespacedId string) []byte {
+	return []byte(fmt.Sprintf("pref/%s/%s", kind, namespacedId))
+}
+
+func (s Store) Get(kind, namespacedId string) (string, bool) {
+	if s.db == nil {
+		return "", false
+	}
+	b, err := s.db.Get(key(kind, namespacedId), nil)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func (s Store) Set(kind, namespacedId, value string) error {
+	if s.db == nil {
+		return errors.New("preference store is not initialized")
+	}
+	return s.db.Put(key(kind, namespacedId), []byte(value), nil)
+}
+
+func (s Store) Delete(kind, namespacedId string) error {
+	if s.db == nil {
+		return errors.New("preference store is not initialized")
+	}
+	return s.db.Delete(key(kind, namespacedId), nil)
+}
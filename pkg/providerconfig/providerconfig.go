@@ -3,18 +3,66 @@ package providerconfig
 import (
 	"encoding/json"
 	"os"
-	"sync/atomic"
+	"sync"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/failover"
+	"github.com/vaaandark/qabot/pkg/keypool"
 )
 
+// 生成参数，未设置的字段不会出现在请求中，由服务商使用默认值
+type GenerationParams struct {
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	MaxTokens        *int            `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	ResponseFormat   json.RawMessage `json:"response_format,omitempty"`
+}
+
+// 每百万 token 的价格，所有提供商应该使用同一种货币
+type Pricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
 type ProviderConfig struct {
-	Name      string   `json:"name"`
-	Url       string   `json:"url"`
-	Model     string   `json:"model,omitempty"`
-	Reasoning bool     `json:"reasoning,omitempty"`
-	Keys      []string `json:"keys"`
-	index     uint64
+	Name      string `json:"name"`
+	Url       string `json:"url"`
+	Model     string `json:"model,omitempty"`
+	Reasoning bool   `json:"reasoning,omitempty"`
+	Stream    bool   `json:"stream,omitempty"`
+	// 是否支持 OpenAI 风格的 function calling
+	FunctionCalling bool `json:"function_calling,omitempty"`
+	// 是否支持图片输入，不支持时图片会被替换成文字占位符
+	Vision bool `json:"vision,omitempty"`
+	// 提供商可以自己下载图片，最新消息中的图片直接发送 URL 而不是 base64
+	ImageUrl bool             `json:"image_url,omitempty"`
+	Keys     []string         `json:"keys"`
+	Params   GenerationParams `json:"params,omitempty"`
+	// 原样合并到请求体中，比如 qwen 的 enable_search
+	ExtraBody map[string]interface{} `json:"extra_body,omitempty"`
+	// 除了 Authorization 以外需要额外加上的请求头
+	Headers  map[string]string `json:"headers,omitempty"`
+	Failover failover.Policy   `json:"failover,omitempty"`
+	// 上下文窗口大小，为 0 时不截断
+	MaxContextTokens int                          `json:"max_context_tokens,omitempty"`
+	Truncation       chatcontext.TruncationPolicy `json:"truncation,omitempty"`
+	// 用来估算费用，不设置时费用为 0
+	Pricing *Pricing `json:"pricing,omitempty"`
+	// 指针在复制 ProviderConfig 时共享，所有副本使用同一个 key 池和熔断器
+	state *providerState
+}
+
+type providerState struct {
+	keyPool *keypool.KeyPool
+	breaker *failover.Breaker
 }
 
+// 保护直接构造的 ProviderConfig 第一次创建 state
+var stateMu sync.Mutex
+
 func LoadProviderConfigFromFile(path string) ([]ProviderConfig, error) {
 	bytes, err := os.ReadFile(path)
 	if err != nil {
@@ -27,10 +75,52 @@ func LoadProviderConfigFromFile(path string) ([]ProviderConfig, error) {
 		return nil, err
 	}
 
+	for i := range config {
+		config[i].Init()
+	}
+
 	return config, nil
 }
 
-func (pc ProviderConfig) NextKey() string {
-	idx := atomic.AddUint64(&pc.index, 1) - 1
-	return pc.Keys[int(idx)%len(pc.Keys)]
+// 创建 key 池和熔断器，之后复制出来的副本共享它们。只会创建一次，
+// 直接构造的 ProviderConfig 在第一次使用时创建，但应该在复制之前调用
+func (pc *ProviderConfig) Init() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if pc.state == nil {
+		pc.state = &providerState{
+			keyPool: keypool.NewKeyPool(pc.Keys),
+			breaker: failover.NewBreaker(pc.Failover),
+		}
+	}
+}
+
+func (pc *ProviderConfig) KeyPool() *keypool.KeyPool {
+	pc.Init()
+	return pc.state.keyPool
+}
+
+func (pc *ProviderConfig) Breaker() *failover.Breaker {
+	pc.Init()
+	return pc.state.breaker
+}
+
+// 按上下文窗口截断历史消息，给回答预留 max_tokens
+func (pc ProviderConfig) TruncateContext(system, history []chatcontext.Message) []chatcontext.Message {
+	if pc.MaxContextTokens <= 0 {
+		return history
+	}
+	maxTokens := pc.MaxContextTokens
+	if pc.Params.MaxTokens != nil {
+		maxTokens -= *pc.Params.MaxTokens
+	}
+	return chatcontext.TruncateMessages(system, history, maxTokens, pc.Truncation)
+}
+
+func (pc ProviderConfig) Cost(usage chatcontext.Usage) float64 {
+	if pc.Pricing == nil {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*pc.Pricing.Prompt + float64(usage.CompletionTokens)*pc.Pricing.Completion) / 1e6
 }
@@ -0,0 +1,92 @@
+package providerconfig
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadSharesPoolsAcrossCopies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider-config.json")
+	config := `[{"name":"a","url":"http://a","keys":["k1","k2"]},{"name":"b","url":"http://b","keys":["k3"]}]`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := LoadProviderConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := providers[0]
+	if copied.KeyPool() != providers[0].KeyPool() {
+		t.Error("copies should share the key pool")
+	}
+	if copied.Breaker() != providers[0].Breaker() {
+		t.Error("copies should share the breaker")
+	}
+	if providers[0].KeyPool() == providers[1].KeyPool() {
+		t.Error("providers should not share a key pool")
+	}
+
+	// 轮换状态保存在共享的池里，通过副本取 key 也会推进
+	first, err := copied.KeyPool().Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := providers[0].KeyPool().Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("expected rotation across copies, got %s twice", first)
+	}
+}
+
+// 直接构造的配置不能 panic，第一次使用时创建一次，之后的副本共享
+func TestLazyInit(t *testing.T) {
+	pc := ProviderConfig{Name: "p", Keys: []string{"k"}}
+	pool := pc.KeyPool()
+	if pool == nil || pc.Breaker() == nil {
+		t.Fatal("key pool or breaker is nil")
+	}
+	if pc.KeyPool() != pool {
+		t.Error("key pool was created again")
+	}
+	copied := pc
+	if copied.KeyPool() != pool {
+		t.Error("copy should share the key pool")
+	}
+	if key, err := pool.Next(); err != nil || key != "k" {
+		t.Errorf("Next() = %q, %v", key, err)
+	}
+
+	var zero ProviderConfig
+	if _, err := zero.KeyPool().Next(); err == nil {
+		t.Error("zero value should have no key")
+	}
+	if !zero.Breaker().Allow() {
+		t.Error("zero value breaker should allow requests")
+	}
+}
+
+func TestConcurrentInit(t *testing.T) {
+	pc := ProviderConfig{Name: "p", Keys: []string{"k"}}
+	var wg sync.WaitGroup
+	breakers := make(chan interface{}, 10)
+	for i := 0; i < cap(breakers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			breakers <- pc.Breaker()
+		}()
+	}
+	wg.Wait()
+	close(breakers)
+	first := <-breakers
+	for b := range breakers {
+		if b != first {
+			t.Fatal("breaker was created more than once")
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrDailyRequests = errors.New("daily request quota exceeded")
+	ErrDailyTokens   = errors.New("daily token quota exceeded")
+)
+
+// 超过频率限制后最多这么久提醒一次
+const rateNotifyInterval = time.Minute
+
+// 用户或群的限额，为 0 的项不限制
+type Limit struct {
+	// 令牌桶：每分钟补充的请求数和桶的容量
+	RatePerMinute float64 `json:"rate_per_minute,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+	DailyRequests int64   `json:"daily_requests,omitempty"`
+	DailyTokens   int64   `json:"daily_tokens,omitempty"`
+}
+
+// 需要检查限额的用户或群
+type Subject struct {
+	// user/<QQ 号> 或 group/<群号>
+	Id    string
+	Limit Limit
+}
+
+// 某一天的用量
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Tokens   int64 `json:"tokens"`
+	// 用完后已经提醒过了
+	Notified bool `json:"notified,omitempty"`
+}
+
+// Allow 占用的请求次数，退还时退到占用的那一天
+type Charge struct {
+	Day string
+	Ids []string
+}
+
+type bucket struct {
+	limit   Limit
+	limiter *rate.Limiter
+}
+
+// 令牌桶在内存中，每天的用量和上下文存在同一个数据库中
+type Store struct {
+	db *leveldb.DB
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// 上次提醒超过频率限制的时间
+	rateNotified map[string]time.Time
+}
+
+func NewStore(db *leveldb.DB) *Store {
+	return &Store{
+		db:           db,
+		buckets:      make(map[string]*bucket),
+		rateNotified: make(map[string]time.Time),
+	}
+}
+
+// 测试时替换，模拟跨过零点
+var now = time.Now
+
+func today() string {
+	return now().Format("2006-01-02")
+}
+
+func key(day, id string) []byte {
+	return []byte(fmt.Sprintf("quota/%s/%s", day, id))
+}
+
+func (s *Store) loadUsage(day, id string) (Usage, error) {
+	usage := Usage{}
+	b, err := s.db.Get(key(day, id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return usage, nil
+	} else if err != nil {
+		return usage, err
+	}
+	err = json.Unmarshal(b, &usage)
+	return usage, err
+}
+
+func (s *Store) saveUsage(day, id string, usage Usage) error {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(key(day, id), b, nil)
+}
+
+// 限额改了以后重新建令牌桶
+func (s *Store) limiter(subject Subject) *rate.Limiter {
+	if subject.Limit.RatePerMinute <= 0 {
+		return nil
+	}
+	b, exist := s.buckets[subject.Id]
+	if !exist || b.limit != subject.Limit {
+		burst := subject.Limit.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		b = &bucket{
+			limit:   subject.Limit,
+			limiter: rate.NewLimiter(rate.Limit(subject.Limit.RatePerMinute/60), burst),
+		}
+		s.buckets[subject.Id] = b
+	}
+	return b.limiter
+}
+
+// 所有对象都没有超过限额时才占用一次请求并返回占用记录，否则返回超过限额的对象
+func (s *Store) Allow(subjects ...Subject) (*Charge, *Subject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := today()
+	usages := make([]Usage, len(subjects))
+	for i, subject := range subjects {
+		usage, err := s.loadUsage(day, subject.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		usages[i] = usage
+
+		limit := subject.Limit
+		if limit.DailyRequests > 0 && usage.Requests >= limit.DailyRequests {
+			return nil, &subjects[i], ErrDailyRequests
+		}
+		if limit.DailyTokens > 0 && usage.Tokens >= limit.DailyTokens {
+			return nil, &subjects[i], ErrDailyTokens
+		}
+		if limiter := s.limiter(subject); limiter != nil && limiter.Tokens() < 1 {
+			return nil, &subjects[i], ErrRateLimited
+		}
+	}
+
+	charge := &Charge{Day: day}
+	for i, subject := range subjects {
+		if limiter := s.limiter(subject); limiter != nil {
+			limiter.Allow()
+		}
+		usages[i].Requests++
+		if err := s.saveUsage(day, subject.Id, usages[i]); err != nil {
+			return nil, nil, err
+		}
+		charge.Ids = append(charge.Ids, subject.Id)
+	}
+	return charge, nil, nil
+}
+
+// 没能回答时退还 Allow 占用的请求次数，令牌桶不退还，频率限制按提问次数计算
+func (s *Store) Refund(charge Charge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range charge.Ids {
+		usage, err := s.loadUsage(charge.Day, id)
+		if err != nil {
+			return err
+		}
+		if usage.Requests == 0 {
+			continue
+		}
+		usage.Requests--
+		if err := s.saveUsage(charge.Day, id, usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 回答完成后记录用掉的 token
+func (s *Store) AddTokens(id string, tokens int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := today()
+	usage, err := s.loadUsage(day, id)
+	if err != nil {
+		return err
+	}
+	usage.Tokens += tokens
+	return s.saveUsage(day, id, usage)
+}
+
+// 每天的额度用完后只提醒一次，超过频率限制时每分钟最多提醒一次
+func (s *Store) ShouldNotify(subject Subject, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errors.Is(err, ErrRateLimited) {
+		if time.Since(s.rateNotified[subject.Id]) < rateNotifyInterval {
+			return false
+		}
+		s.rateNotified[subject.Id] = time.Now()
+		return true
+	}
+
+	day := today()
+	usage, loadErr := s.loadUsage(day, subject.Id)
+	if loadErr != nil || usage.Notified {
+		return false
+	}
+	usage.Notified = true
+	return s.saveUsage(day, subject.Id, usage) == nil
+}
+
+func (s *Store) Usage(id string) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loadUsage(today(), id)
+}
+
+// 清空今天的用量和令牌桶
+func (s *Store) Reset(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buckets, id)
+	delete(s.rateNotified, id)
+	return s.db.Delete(key(today(), id), nil)
+}
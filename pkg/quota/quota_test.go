@@ -0,0 +1,138 @@
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewStore(db)
+}
+
+func TestAllow(t *testing.T) {
+	user := Subject{Id: "user/1", Limit: Limit{DailyRequests: 2}}
+	group := Subject{Id: "group/2", Limit: Limit{DailyTokens: 100}}
+	s := newTestStore(t)
+
+	for i := 0; i < 2; i++ {
+		if _, subject, err := s.Allow(user, group); err != nil {
+			t.Fatalf("Allow #%d: %v %v", i, subject, err)
+		}
+	}
+	_, subject, err := s.Allow(user, group)
+	if !errors.Is(err, ErrDailyRequests) || subject.Id != user.Id {
+		t.Errorf("Allow = %v %v, want user daily request limit", subject, err)
+	}
+	// 被拒绝的请求不计入
+	if usage, _ := s.Usage(group.Id); usage.Requests != 2 {
+		t.Errorf("group requests = %d, want 2", usage.Requests)
+	}
+
+	if err := s.AddTokens(group.Id, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reset(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, subject, err = s.Allow(user, group)
+	if !errors.Is(err, ErrDailyTokens) || subject.Id != group.Id {
+		t.Errorf("Allow = %v %v, want group daily token limit", subject, err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	user := Subject{Id: "user/1", Limit: Limit{DailyRequests: 1}}
+	s := newTestStore(t)
+
+	charge, _, err := s.Allow(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refund(*charge); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Allow(user); err != nil {
+		t.Errorf("Allow after refund: %v", err)
+	}
+
+	// 不会退成负数
+	other := Subject{Id: "user/2"}
+	if err := s.Refund(Charge{Day: today(), Ids: []string{other.Id}}); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := s.Usage(other.Id); usage.Requests != 0 {
+		t.Errorf("requests = %d, want 0", usage.Requests)
+	}
+}
+
+// 零点前占用、零点后退还时退到前一天，不影响新一天的次数
+func TestRefundAfterMidnight(t *testing.T) {
+	user := Subject{Id: "user/1", Limit: Limit{DailyRequests: 1}}
+	s := newTestStore(t)
+	defer func() { now = time.Now }()
+
+	midnight := time.Date(2024, 5, 2, 0, 0, 0, 0, time.Local)
+	now = func() time.Time { return midnight.Add(-time.Second) }
+	charge, _, err := s.Allow(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = func() time.Time { return midnight.Add(time.Second) }
+	if _, _, err := s.Allow(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refund(*charge); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := s.Usage(user.Id); usage.Requests != 1 {
+		t.Errorf("today requests = %d, want 1", usage.Requests)
+	}
+	if usage, _ := s.loadUsage("2024-05-01", user.Id); usage.Requests != 0 {
+		t.Errorf("yesterday requests = %d, want 0", usage.Requests)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	user := Subject{Id: "user/1", Limit: Limit{RatePerMinute: 1, Burst: 2}}
+	s := newTestStore(t)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Allow(user); err != nil {
+			t.Fatalf("Allow #%d: %v", i, err)
+		}
+	}
+	if _, _, err := s.Allow(user); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("err = %v, want ErrRateLimited", err)
+	}
+	if !s.ShouldNotify(user, ErrRateLimited) || s.ShouldNotify(user, ErrRateLimited) {
+		t.Errorf("rate limit should be notified exactly once per minute")
+	}
+
+	// 限额改了以后重新建令牌桶
+	user.Limit.Burst = 3
+	if _, _, err := s.Allow(user); err != nil {
+		t.Errorf("Allow after limit change: %v", err)
+	}
+}
+
+func TestShouldNotifyOncePerDay(t *testing.T) {
+	user := Subject{Id: "user/1", Limit: Limit{DailyRequests: 1}}
+	s := newTestStore(t)
+	if !s.ShouldNotify(user, ErrDailyRequests) {
+		t.Errorf("first notification suppressed")
+	}
+	if s.ShouldNotify(user, ErrDailyRequests) {
+		t.Errorf("notified twice")
+	}
+}
@@ -0,0 +1,114 @@
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+)
+
+type OverflowPolicy string
+
+const (
+	// 缓冲区满时丢弃新收到的事件
+	DropNewest OverflowPolicy = "drop-newest"
+	// 缓冲区满时丢弃最早的事件，给新事件腾出位置
+	DropOldest OverflowPolicy = "drop-oldest"
+
+	// 记住最近这么多条消息用来去重
+	dedupSize = 4096
+)
+
+// 收到的事件先放进有缓冲的 channel，不等 chatter 处理就返回，
+// 这样 onebot 的上报不会因为 chatter 太慢而超时重试
+type Intake struct {
+	ch     chan messageenvelope.MessageEnvelope
+	policy OverflowPolicy
+
+	mu sync.Mutex
+	// 环形缓冲区，记录最近收到的消息
+	seen      map[string]struct{}
+	seenOrder []string
+	next      int
+
+	received   atomic.Int64
+	duplicated atomic.Int64
+	dropped    atomic.Int64
+}
+
+type IntakeStats struct {
+	Depth      int   `json:"depth"`
+	Capacity   int   `json:"capacity"`
+	Received   int64 `json:"received"`
+	Duplicated int64 `json:"duplicated"`
+	Dropped    int64 `json:"dropped"`
+}
+
+func NewIntake(ch chan messageenvelope.MessageEnvelope, policy OverflowPolicy) (*Intake, error) {
+	if policy != DropNewest && policy != DropOldest {
+		return nil, fmt.Errorf("unknown overflow policy %s", policy)
+	}
+	if cap(ch) == 0 {
+		return nil, fmt.Errorf("intake channel must be buffered")
+	}
+	return &Intake{
+		ch:        ch,
+		policy:    policy,
+		seen:      make(map[string]struct{}),
+		seenOrder: make([]string, dedupSize),
+	}, nil
+}
+
+// onebot 实现重试时会重复上报同一条消息
+func (in *Intake) IsDuplicate(selfId int64, messageId int32) bool {
+	key := fmt.Sprintf("%d/%d", selfId, messageId)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if _, exist := in.seen[key]; exist {
+		in.duplicated.Add(1)
+		return true
+	}
+	delete(in.seen, in.seenOrder[in.next])
+	in.seenOrder[in.next] = key
+	in.next = (in.next + 1) % len(in.seenOrder)
+	in.seen[key] = struct{}{}
+	return false
+}
+
+// 不会阻塞，缓冲区满时按照策略丢弃事件
+func (in *Intake) Put(me messageenvelope.MessageEnvelope) {
+	in.received.Add(1)
+	for {
+		select {
+		case in.ch <- me:
+			return
+		default:
+		}
+
+		if in.policy == DropNewest {
+			in.dropped.Add(1)
+			log.Printf("Drop %s message %d from %s: intake is full", me.Category, me.MessageId, me.GetNamespacedGroupOrUserID())
+			return
+		}
+		select {
+		case old := <-in.ch:
+			in.dropped.Add(1)
+			log.Printf("Drop %s message %d from %s: intake is full", old.Category, old.MessageId, old.GetNamespacedGroupOrUserID())
+		default:
+		}
+	}
+}
+
+func (in *Intake) Stats() IntakeStats {
+	return IntakeStats{
+		Depth:      len(in.ch),
+		Capacity:   cap(in.ch),
+		Received:   in.received.Load(),
+		Duplicated: in.duplicated.Load(),
+		Dropped:    in.dropped.Load(),
+	}
+}
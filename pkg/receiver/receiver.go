@@ -1,10 +1,14 @@
 package receiver
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/vaaandark/qabot/pkg/messageenvelope"
 	"github.com/vaaandark/qabot/pkg/onebot"
@@ -12,15 +16,40 @@ import (
 )
 
 type Receiver struct {
-	ReceivedMessageCh chan messageenvelope.MessageEnvelope
+	Intake *Intake
+	// 不为空时校验 HTTP 上报的 X-Signature
+	Secret string
 }
 
-func NewReceiver(receivedMessageCh chan messageenvelope.MessageEnvelope) Receiver {
+func NewReceiver(intake *Intake, secret string) Receiver {
 	return Receiver{
-		ReceivedMessageCh: receivedMessageCh,
+		Intake: intake,
+		Secret: secret,
 	}
 }
 
+// onebot 11 规定签名是 X-Signature: sha1=<以 secret 为密钥对请求体做 HMAC-SHA1 的十六进制>，
+// 没有签名返回 401，签名不对返回 403
+func (receiver Receiver) verifySignature(r *http.Request, body []byte) int {
+	if len(receiver.Secret) == 0 {
+		return http.StatusOK
+	}
+	signature := r.Header.Get("X-Signature")
+	if len(signature) == 0 {
+		return http.StatusUnauthorized
+	}
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha1="))
+	if err != nil {
+		return http.StatusForbidden
+	}
+	mac := hmac.New(sha1.New, []byte(receiver.Secret))
+	mac.Write(body)
+	if !hmac.Equal(received, mac.Sum(nil)) {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
 func (receiver Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -30,19 +59,40 @@ func (receiver Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	event := onebot.Event{}
-	err = json.Unmarshal(bodyBytes, &event)
-	if err != nil {
+	if status := receiver.verifySignature(r, bodyBytes); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		log.Printf("Reject event from %s with %d: signature %q", r.RemoteAddr, status, r.Header.Get("X-Signature"))
+		return
+	}
+
+	if err := receiver.HandleEvent(bodyBytes); err != nil {
 		http.Error(w, "failed to unmarshal event", http.StatusInternalServerError)
 		log.Printf("Failed to unmarshal event: %v", err)
 		return
 	}
+}
+
+// HTTP 上报和 WebSocket 收到的事件都在这里处理，不会阻塞
+func (receiver Receiver) HandleEvent(bodyBytes []byte) error {
+	event := onebot.Event{}
+	if err := json.Unmarshal(bodyBytes, &event); err != nil {
+		return err
+	}
 
 	if event.IsMessage() {
+		if receiver.Intake.IsDuplicate(event.SelfId, event.MessageId) {
+			log.Printf("Ignore duplicated message %d", event.MessageId)
+			return nil
+		}
 		if text, replyTo, shouldBeIgnored, category, isAt := event.ProcessText(); !shouldBeIgnored {
 			me := messageenvelope.FromEvent(event, &text, replyTo, category, isAt)
 			log.Printf("Receive message from %s: %s", me.GetNamespacedGroupOrUserID(), util.TruncateLogStr(me.Text))
-			receiver.ReceivedMessageCh <- me
+			receiver.Intake.Put(me)
 		}
+	} else if category, ok := event.ProcessNotice(); ok {
+		me := messageenvelope.FromNoticeEvent(event, category)
+		log.Printf("Receive %s notice from %s (user %d)", category, me.GetNamespacedGroupOrUserID(), me.UserId)
+		receiver.Intake.Put(me)
 	}
+	return nil
 }
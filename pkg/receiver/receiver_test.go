@@ -0,0 +1,62 @@
+package receiver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignature(t *testing.T) {
+	const body = `{"post_type":"message","message_type":"private","self_id":999,"message_id":1,"user_id":1,"message":"hello"}`
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		want      int
+	}{
+		{"no secret", "", "", http.StatusOK},
+		{"no secret ignores signature", "", "sha1=00", http.StatusOK},
+		{"valid", "s3cret", sign("s3cret", body), http.StatusOK},
+		{"valid without prefix", "s3cret", strings.TrimPrefix(sign("s3cret", body), "sha1="), http.StatusOK},
+		{"missing", "s3cret", "", http.StatusUnauthorized},
+		{"wrong secret", "s3cret", sign("other", body), http.StatusForbidden},
+		{"wrong body", "s3cret", sign("s3cret", body+" "), http.StatusForbidden},
+		{"not hex", "s3cret", "sha1=xyz", http.StatusForbidden},
+		{"truncated", "s3cret", sign("s3cret", body)[:20], http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan messageenvelope.MessageEnvelope, 1)
+			intake, err := NewIntake(ch, DropNewest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			if len(tt.signature) != 0 {
+				r.Header.Set("X-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			NewReceiver(intake, tt.secret).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			// 被拒绝的事件不能进入队列
+			if accepted := len(ch) == 1; accepted != (tt.want == http.StatusOK) {
+				t.Errorf("accepted %v with status %d", accepted, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package receiver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/websocket"
+)
+
+const apiCallTimeout = 30 * time.Second
+
+var ErrNoConnection = errors.New("no onebot websocket connection")
+
+// onebot 11 反向 WebSocket 服务端，onebot 实现主动连上来，事件和 API 调用共用连接，
+// API 调用用 echo 对应响应
+type ReverseWSServer struct {
+	Receiver Receiver
+	// 不为空时要求连接带上 Authorization: Bearer <token> 或 access_token 参数
+	AccessToken string
+
+	mu sync.Mutex
+	// 最近一个可以调用 API 的连接（Universal 或 API）
+	apiConn *websocket.Conn
+	pending map[string]chan onebot.ApiResponse
+	seq     uint64
+}
+
+func NewReverseWSServer(receiver Receiver, accessToken string) *ReverseWSServer {
+	return &ReverseWSServer{
+		Receiver:    receiver,
+		AccessToken: accessToken,
+		pending:     make(map[string]chan onebot.ApiResponse),
+	}
+}
+
+// 没有 token 返回 401，token 不对返回 403
+func (s *ReverseWSServer) verifyToken(r *http.Request) int {
+	if len(s.AccessToken) == 0 {
+		return http.StatusOK
+	}
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); len(auth) != 0 {
+		token = strings.TrimPrefix(strings.TrimPrefix(auth, "Bearer "), "Token ")
+	}
+	if len(token) == 0 {
+		return http.StatusUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AccessToken)) != 1 {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+func (s *ReverseWSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status := s.verifyToken(r); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		log.Printf("Reject websocket connection from %s: %s", r.RemoteAddr, http.StatusText(status))
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// 没有 X-Client-Role 时当作 Universal
+	role := r.Header.Get("X-Client-Role")
+	if role != "Event" {
+		s.mu.Lock()
+		if s.apiConn != nil {
+			// 旧连接上的调用改用新连接也收不到响应了
+			s.failPending()
+		}
+		s.apiConn = conn
+		s.mu.Unlock()
+	}
+	log.Printf("OneBot websocket connected from %s (role=%s, self_id=%s)", conn.RemoteAddr(), role, r.Header.Get("X-Self-ID"))
+
+	defer s.disconnect(conn)
+
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, websocket.ErrClosed) {
+				log.Printf("Failed to read from onebot websocket: %v", err)
+			}
+			return
+		}
+		s.dispatch(payload)
+	}
+}
+
+func (s *ReverseWSServer) disconnect(conn *websocket.Conn) {
+	log.Printf("OneBot websocket disconnected from %s", conn.RemoteAddr())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.apiConn != conn {
+		return
+	}
+	s.apiConn = nil
+	s.failPending()
+}
+
+// 连接断了或者被替换了，响应不会再来，调用时要持有 s.mu
+func (s *ReverseWSServer) failPending() {
+	for echo, ch := range s.pending {
+		close(ch)
+		delete(s.pending, echo)
+	}
+}
+
+func (s *ReverseWSServer) dispatch(payload []byte) {
+	var header struct {
+		PostType string          `json:"post_type"`
+		Echo     json.RawMessage `json:"echo"`
+	}
+	if err := json.Unmarshal(payload, &header); err != nil {
+		log.Printf("Failed to unmarshal websocket message: %v", err)
+		return
+	}
+
+	if len(header.PostType) != 0 {
+		// 事件只是放进 Intake，不会阻塞，按收到的顺序处理
+		if err := s.Receiver.HandleEvent(payload); err != nil {
+			log.Printf("Failed to unmarshal event: %v", err)
+		}
+		return
+	}
+
+	if len(header.Echo) == 0 {
+		return
+	}
+	response := onebot.ApiResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		log.Printf("Failed to unmarshal api response: %v", err)
+		return
+	}
+	echo := string(header.Echo)
+	var echoStr string
+	if err := json.Unmarshal(header.Echo, &echoStr); err == nil {
+		echo = echoStr
+	}
+
+	s.mu.Lock()
+	ch, ok := s.pending[echo]
+	delete(s.pending, echo)
+	s.mu.Unlock()
+	if ok {
+		ch <- response
+	}
+}
+
+func (s *ReverseWSServer) Call(action string, params interface{}) (json.RawMessage, error) {
+	s.mu.Lock()
+	conn := s.apiConn
+	if conn == nil {
+		s.mu.Unlock()
+		return nil, ErrNoConnection
+	}
+	s.seq++
+	echo := strconv.FormatUint(s.seq, 10)
+	ch := make(chan onebot.ApiResponse, 1)
+	s.pending[echo] = ch
+	s.mu.Unlock()
+
+	cleanup := func() {
+		s.mu.Lock()
+		delete(s.pending, echo)
+		s.mu.Unlock()
+	}
+
+	b, err := json.Marshal(onebot.ApiRequest{
+		Action: action,
+		Params: params,
+		Echo:   echo,
+	})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.OpText, b); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	timer := time.NewTimer(apiCallTimeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, ErrNoConnection
+		}
+		return response.Result(action)
+	case <-timer.C:
+		cleanup()
+		return nil, fmt.Errorf("%s timed out after %s", action, apiCallTimeout)
+	}
+}
@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/websocket"
+)
+
+// 只够测试用的 websocket 客户端
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, server *httptest.Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: qabot\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	return &testClient{conn: conn, reader: reader}
+}
+
+func (tc *testClient) write(t *testing.T, payload []byte) {
+	t.Helper()
+	if len(payload) > 125 {
+		t.Fatalf("payload too long for test client")
+	}
+	frame := []byte{0x80 | websocket.OpText, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	frame = append(frame, payload...)
+	if _, err := tc.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tc *testClient) read(t *testing.T) []byte {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(tc.reader, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(tc.reader, ext); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(tc.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func newTestServer(t *testing.T) (*ReverseWSServer, *httptest.Server) {
+	t.Helper()
+	intake, err := NewIntake(make(chan messageenvelope.MessageEnvelope, 10), DropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewReverseWSServer(NewReceiver(intake, ""), "")
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func waitForApiConn(t *testing.T, s *ReverseWSServer) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		conn := s.apiConn
+		s.mu.Unlock()
+		if conn != nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("api connection is not ready")
+}
+
+type callResult struct {
+	data json.RawMessage
+	err  error
+}
+
+func call(s *ReverseWSServer, action string) <-chan callResult {
+	result := make(chan callResult, 1)
+	go func() {
+		data, err := s.Call(action, nil)
+		result <- callResult{data, err}
+	}()
+	return result
+}
+
+func TestCall(t *testing.T) {
+	s, server := newTestServer(t)
+	client := dial(t, server)
+	waitForApiConn(t, s)
+
+	result := call(s, "get_status")
+	request := struct {
+		Action string `json:"action"`
+		Echo   string `json:"echo"`
+	}{}
+	if err := json.Unmarshal(client.read(t), &request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Action != "get_status" {
+		t.Errorf("action = %s", request.Action)
+	}
+	client.write(t, []byte(`{"status":"ok","retcode":0,"data":{"online":true},"echo":"`+request.Echo+`"}`))
+
+	r := <-result
+	if r.err != nil || string(r.data) != `{"online":true}` {
+		t.Errorf("Call = %s, %v", r.data, r.err)
+	}
+}
+
+func TestCallFailsWhenConnectionGoesAway(t *testing.T) {
+	tests := []struct {
+		name string
+		// 收到请求以后旧连接发生的事
+		after func(t *testing.T, old *testClient, server *httptest.Server)
+	}{
+		{"replaced", func(t *testing.T, old *testClient, server *httptest.Server) { dial(t, server) }},
+		{"closed", func(t *testing.T, old *testClient, server *httptest.Server) { old.conn.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, server := newTestServer(t)
+			old := dial(t, server)
+			waitForApiConn(t, s)
+
+			result := call(s, "get_status")
+			old.read(t)
+			tt.after(t, old, server)
+
+			select {
+			case r := <-result:
+				if !errors.Is(r.err, ErrNoConnection) {
+					t.Errorf("err = %v, want ErrNoConnection", r.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("in-flight call was not failed")
+			}
+		})
+	}
+}
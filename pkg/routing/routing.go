@@ -0,0 +1,115 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/providerconfig"
+)
+
+type Rule struct {
+	// 形如 group/123 或 user/456
+	Ids []string `json:"ids"`
+	// 按顺序尝试的提供商名字，为空时使用全部提供商的默认顺序
+	Providers []string `json:"providers,omitempty"`
+	// 覆盖第一个提供商的模型
+	Model string `json:"model,omitempty"`
+	// 替换默认的群聊或私聊提示词
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// 允许使用的工具，不设置时可以使用全部工具，空列表表示禁用工具
+	Tools []string `json:"tools"`
+}
+
+type Router struct {
+	rules map[string]Rule
+}
+
+func LoadRouterFromFile(path string) (*Router, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{}
+	if err := json.Unmarshal(bytes, &rules); err != nil {
+		return nil, err
+	}
+
+	router := &Router{rules: make(map[string]Rule)}
+	for _, rule := range rules {
+		for _, id := range rule.Ids {
+			if _, exist := router.rules[id]; exist {
+				return nil, fmt.Errorf("duplicate routing rule for %s", id)
+			}
+			router.rules[id] = rule
+		}
+	}
+	return router, nil
+}
+
+// 按顺序查找，返回第一个匹配的规则
+func (r *Router) Lookup(namespacedIds ...string) *Rule {
+	if r == nil {
+		return nil
+	}
+	for _, id := range namespacedIds {
+		if rule, exist := r.rules[id]; exist {
+			return &rule
+		}
+	}
+	return nil
+}
+
+// 检查规则里的提供商是否都存在
+func (r *Router) Validate(providers []providerconfig.ProviderConfig) error {
+	if r == nil {
+		return nil
+	}
+	names := make(map[string]struct{})
+	for _, p := range providers {
+		names[p.Name] = struct{}{}
+	}
+	for id, rule := range r.rules {
+		for _, name := range rule.Providers {
+			if _, exist := names[name]; !exist {
+				return fmt.Errorf("unknown provider %s in routing rule for %s", name, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (rule Rule) SelectProviders(providers []providerconfig.ProviderConfig) []providerconfig.ProviderConfig {
+	selected := []providerconfig.ProviderConfig{}
+	if len(rule.Providers) == 0 {
+		selected = append(selected, providers...)
+	} else {
+		for _, name := range rule.Providers {
+			for _, p := range providers {
+				if p.Name == name {
+					selected = append(selected, p)
+					break
+				}
+			}
+		}
+	}
+
+	if len(rule.Model) != 0 && len(selected) > 0 {
+		selected[0].Model = rule.Model
+	}
+	return selected
+}
+
+func (rule Rule) BuildSystemPrompt() []chatcontext.Message {
+	if len(rule.SystemPrompt) == 0 {
+		return nil
+	}
+	return []chatcontext.Message{
+		{
+			Role:    "system",
+			Content: rule.SystemPrompt,
+		},
+	}
+}
@@ -1,12 +1,8 @@
 package sender
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -14,26 +10,40 @@ import (
 	"github.com/vaaandark/qabot/pkg/chatcontext"
 	"github.com/vaaandark/qabot/pkg/messageenvelope"
 	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/speech"
 	"github.com/vaaandark/qabot/pkg/util"
 )
 
 type Sender struct {
 	ToSendMessageCh chan messageenvelope.MessageEnvelope
 	ChatContext     chatcontext.ChatContext
-	Endpoint        string
+	OneBot          *onebot.Client
 	DialogEndpoint  string
+	Preferences     preference.Store
+	// 为 nil 时不支持语音回答
+	Synthesizer speech.Synthesizer
+	// 流式回复已发送的各段的 message id，最后一段写入上下文，其他的作为它的别名
+	streamMessageIds map[string][]int32
+	// 生成语音比较慢，交给单独的 goroutine，不耽误发送其他消息
+	voiceCh chan voiceTask
 }
 
-func NewSender(toSendMessageCh chan messageenvelope.MessageEnvelope, chatContext chatcontext.ChatContext, endpoint, dialogEndpoint string) Sender {
+func NewSender(toSendMessageCh chan messageenvelope.MessageEnvelope, chatContext chatcontext.ChatContext, oneBot *onebot.Client, dialogEndpoint string, preferences preference.Store, synthesizer speech.Synthesizer) Sender {
 	return Sender{
-		ToSendMessageCh: toSendMessageCh,
-		ChatContext:     chatContext,
-		Endpoint:        endpoint,
-		DialogEndpoint:  dialogEndpoint,
+		ToSendMessageCh:  toSendMessageCh,
+		ChatContext:      chatContext,
+		OneBot:           oneBot,
+		DialogEndpoint:   dialogEndpoint,
+		Preferences:      preferences,
+		Synthesizer:      synthesizer,
+		streamMessageIds: make(map[string][]int32),
+		voiceCh:          make(chan voiceTask, voiceQueueSize),
 	}
 }
 
 func (s Sender) Run(stopCh <-chan struct{}) {
+	go s.runVoice(stopCh)
 	for {
 		select {
 		case m, ok := <-s.ToSendMessageCh:
@@ -48,45 +58,20 @@ func (s Sender) Run(stopCh <-chan struct{}) {
 }
 
 func (s Sender) doPost(path string, body interface{}) (int32, error) {
-	url := fmt.Sprintf("%s/%s", s.Endpoint, path)
-
-	b, err := json.Marshal(body)
-	if err != nil {
-		return 0, err
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
-
-	if err != nil {
-		return 0, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	res, err := client.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer res.Body.Close()
-
-	b, err = io.ReadAll(res.Body)
-	if err != nil {
-		return 0, err
-	}
-
-	response := onebot.SendResponse{}
-	if err := json.Unmarshal(b, &response); err != nil {
-		return 0, err
-	}
-
-	return response.Data.MessageId, nil
+	return s.OneBot.SendMessage(path, body)
 }
 
-func (s Sender) recordSent(messageId int32, m messageenvelope.MessageEnvelope) error {
-	return s.ChatContext.AddContextNode(m.TargetId, m.GroupId, messageId, &m.MessageId, chatcontext.Message{
+func (s Sender) recordSent(messageId int32, aliases []int32, m messageenvelope.MessageEnvelope) error {
+	value := chatcontext.NewContextNodeValue(&m.MessageId, chatcontext.Message{
 		Role:    "assistant",
 		Content: m.Text,
 	}, m.Timestamp)
+	value.ToolMessages = m.ToolMessages
+	value.Usage = m.Usage
+	if err := s.ChatContext.AddContextNodeValue(m.TargetId, m.GroupId, messageId, value); err != nil {
+		return err
+	}
+	return s.ChatContext.AddAliases(m.TargetId, m.GroupId, messageId, aliases)
 }
 
 func splitThinkAndAnswer(text string) (string, string) {
@@ -101,48 +86,152 @@ func splitThinkAndAnswer(text string) (string, string) {
 	return before, after
 }
 
-func (s Sender) doSend(m messageenvelope.MessageEnvelope) {
-	var messageId int32
-	var err error
+func streamKey(m messageenvelope.MessageEnvelope) string {
+	return fmt.Sprintf("%s/%d", m.GetNamespacedGroupOrUserID(), m.MessageId)
+}
+
+// 思考过程以合并转发的形式发送
+func (s Sender) sendThink(m messageenvelope.MessageEnvelope, think string) {
+	if len(think) == 0 {
+		return
+	}
+	if m.IsInGroup() {
+		forwardMessage := onebot.NewGroupForwordMessage(*m.GroupId, think)
+		if _, err := s.doPost("send_group_forward_msg", forwardMessage); err != nil {
+			log.Printf("Failed to send group forward message: group=%d, id=%d: %v", *m.GroupId, m.UserId, err)
+		}
+	} else {
+		forwardMessage := onebot.NewPrivateForwordMessage(m.UserId, think)
+		if _, err := s.doPost("send_private_forward_msg", forwardMessage); err != nil {
+			log.Printf("Failed to send private forward message: id=%d: %v", m.UserId, err)
+		}
+	}
+}
+
+func (s Sender) sendText(m messageenvelope.MessageEnvelope, think, answer string) (messageId int32, err error) {
 	replyTo := strconv.Itoa(int(m.MessageId))
 
-	think, answer := splitThinkAndAnswer(m.Text)
+	// 流式回复只在第一段标注模型名
+	modelName := m.ModelName
+	if m.Stream != nil && m.Stream.Index > 0 {
+		modelName = ""
+	}
+
+	s.sendThink(m, think)
 	if m.IsInGroup() {
 		userIdStr := strconv.FormatInt(m.UserId, 10)
-		if len(think) != 0 {
-			forwardMessage := onebot.NewGroupForwordMessage(*m.GroupId, think)
-			if _, err = s.doPost("send_group_forward_msg", forwardMessage); err != nil {
-				log.Printf("Failed to send group forward message: group=%d, id=%d: %v", *m.GroupId, m.UserId, err)
-			}
-		}
-		groupMessage := onebot.NewGroupMessage(s.DialogEndpoint, *m.GroupId, m.ModelName, answer, &userIdStr, &replyTo)
+		groupMessage := onebot.NewGroupMessage(s.DialogEndpoint, *m.GroupId, modelName, answer, &userIdStr, &replyTo)
 		if messageId, err = s.doPost("send_group_msg", groupMessage); err != nil {
 			log.Printf("Failed to send group message: group=%d, id=%d: %v", *m.GroupId, m.UserId, err)
 			return
 		}
 	} else {
-		if len(think) != 0 {
-			forwardMessage := onebot.NewPrivateForwordMessage(m.UserId, think)
-			if _, err = s.doPost("send_private_forward_msg", forwardMessage); err != nil {
-				log.Printf("Failed to send private forward message: id=%d: %v", m.UserId, err)
-			}
-		}
-		privateMessage := onebot.NewPrivateMessage(s.DialogEndpoint, m.UserId, m.ModelName, answer, &replyTo)
+		privateMessage := onebot.NewPrivateMessage(s.DialogEndpoint, m.UserId, modelName, answer, &replyTo)
 		if messageId, err = s.doPost("send_private_msg", privateMessage); err != nil {
 			log.Printf("Failed to send private message: id=%d: %v", m.UserId, err)
 			return
 		}
 	}
+	return
+}
 
+func (s Sender) doSend(m messageenvelope.MessageEnvelope) {
+	var messageId int32
+
+	if m.Stream != nil && m.Stream.Cancelled {
+		// 问题被撤回了，已经发出去的各段也一起撤回
+		key := streamKey(m)
+		for _, id := range s.streamMessageIds[key] {
+			if err := s.OneBot.DeleteMsg(id); err != nil {
+				log.Printf("Failed to delete stream part %d of %s: %v", id, key, err)
+			}
+		}
+		delete(s.streamMessageIds, key)
+		return
+	}
+
+	mode := s.ttsMode(m)
+	if mode == speech.TTSOnly {
+		if m.Stream != nil {
+			// 只用语音回答时等流式回复结束后整体朗读，思考过程随第一段先发出去
+			if !m.Stream.Final {
+				think, _ := splitThinkAndAnswer(m.Text)
+				if len(m.Reasoning) != 0 {
+					think = m.Reasoning
+				}
+				s.sendThink(m, think)
+				return
+			}
+			_, answer := splitThinkAndAnswer(m.Stream.Full)
+			m.Text = m.Stream.Full
+			m.Stream = nil
+			s.speak(voiceTask{m: m, mode: mode, answer: answer})
+			return
+		}
+		think, answer := splitThinkAndAnswer(m.Text)
+		if len(m.Reasoning) != 0 {
+			think = m.Reasoning
+		}
+		s.speak(voiceTask{m: m, mode: mode, think: think, answer: answer})
+		return
+	}
+
+	think, answer := splitThinkAndAnswer(m.Text)
+	if len(m.Reasoning) != 0 {
+		think = m.Reasoning
+	}
+	// 流式回复的最后一段可能是空的，只需要记录上下文
+	if m.Stream == nil || len(think) != 0 || len(answer) != 0 {
+		var err error
+		if messageId, err = s.sendText(m, think, answer); err != nil {
+			if m.Stream != nil && m.Stream.Final {
+				delete(s.streamMessageIds, streamKey(m))
+			}
+			return
+		}
+	}
+	if mode == speech.TTSOn && (m.Stream == nil || m.Stream.Final) {
+		if m.Stream != nil {
+			_, answer = splitThinkAndAnswer(m.Stream.Full)
+		}
+		s.speak(voiceTask{m: m, mode: mode, answer: answer})
+	}
+
+	var aliases []int32
+	if m.Stream != nil {
+		key := streamKey(m)
+		if messageId != 0 {
+			s.streamMessageIds[key] = append(s.streamMessageIds[key], messageId)
+		}
+		if !m.Stream.Final {
+			s.logSent(m)
+			return
+		}
+		if ids := s.streamMessageIds[key]; len(ids) != 0 {
+			messageId = ids[len(ids)-1]
+			aliases = ids[:len(ids)-1]
+		}
+		delete(s.streamMessageIds, key)
+		m.Text = m.Stream.Full
+	}
+	s.finish(messageId, aliases, m)
+}
+
+func (s Sender) logSent(m messageenvelope.MessageEnvelope) time.Time {
 	timestamp := time.Now()
 	log.Printf("Cost %s to send message to %s: %s", timestamp.Sub(m.Timestamp), m.GetNamespacedGroupOrUserID(), util.TruncateLogStr(m.Text))
-	m.Timestamp = timestamp
+	return timestamp
+}
+
+// 发送完成后把回答写入上下文，aliases 是流式回复中其他各段的 message id
+func (s Sender) finish(messageId int32, aliases []int32, m messageenvelope.MessageEnvelope) {
+	m.Timestamp = s.logSent(m)
 
 	if m.Category == onebot.CategoryChat {
 		if messageId == 0 { // 被 QQ 拦截了，手动给它一个不会重复的值
 			messageId = -int32(time.Now().UnixMicro())
 		}
-		if err := s.recordSent(messageId, m); err != nil {
+		if err := s.recordSent(messageId, aliases, m); err != nil {
 			log.Printf("Failed to add user context: %v", err)
 		}
 	}
@@ -0,0 +1,286 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/speech"
+)
+
+// 每发送一条消息返回递增的 message id
+type fakeTransport struct {
+	mu      sync.Mutex
+	next    int32
+	actions []string
+	deleted []int32
+}
+
+func (ft *fakeTransport) Call(action string, params interface{}) (json.RawMessage, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.actions = append(ft.actions, action)
+	if action == "delete_msg" {
+		ft.deleted = append(ft.deleted, params.(map[string]int32)["message_id"])
+		return nil, nil
+	}
+	ft.next++
+	return json.RawMessage(fmt.Sprintf(`{"message_id":%d}`, ft.next)), nil
+}
+
+func newTestSender(t *testing.T) (Sender, *fakeTransport) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	prompt := filepath.Join(dir, "prompt.json")
+	if err := os.WriteFile(prompt, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chatContext, err := chatcontext.NewChatContext(db, prompt, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &fakeTransport{next: 100}
+	return NewSender(nil, *chatContext, onebot.NewClient(transport), "", preference.NewStore(db), nil), transport
+}
+
+func streamPart(m messageenvelope.MessageEnvelope, index int, text string) messageenvelope.MessageEnvelope {
+	m.Text = text
+	m.Stream = &messageenvelope.StreamPart{Index: index}
+	return m
+}
+
+func TestStreamRecordsEveryPart(t *testing.T) {
+	groupId := int64(1)
+	question := messageenvelope.MessageEnvelope{
+		UserId:    2,
+		TargetId:  new(int64),
+		GroupId:   &groupId,
+		MessageId: 10,
+		Category:  onebot.CategoryChat,
+		Timestamp: time.Now(),
+	}
+	*question.TargetId = 2
+
+	tests := []struct {
+		name     string
+		lastText string
+		wantIds  []int32
+	}{
+		// 最后一段有内容时也会单独发送
+		{"last part not empty", "c", []int32{101, 102, 103}},
+		{"last part empty", "", []int32{101, 102}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSender(t)
+			if err := s.ChatContext.AddContextNode(question.TargetId, &groupId, question.MessageId, nil, chatcontext.Message{Role: "user", Content: "q"}, question.Timestamp); err != nil {
+				t.Fatal(err)
+			}
+			s.doSend(streamPart(question, 0, "a"))
+			s.doSend(streamPart(question, 1, "b"))
+			final := streamPart(question, 2, tt.lastText)
+			final.Stream.Final = true
+			final.Stream.Full = "a\n\nb\n\nc"
+			s.doSend(final)
+
+			if len(s.streamMessageIds) != 0 {
+				t.Errorf("stream message ids leaked: %v", s.streamMessageIds)
+			}
+			for _, id := range tt.wantIds {
+				if !s.ChatContext.IsBotReply(question.TargetId, &groupId, id) {
+					t.Errorf("message %d is not recorded as bot reply", id)
+				}
+			}
+			messages, err := s.ChatContext.LoadContextMessages(question.TargetId, &groupId, tt.wantIds[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 2 || messages[1].Content != "a\n\nb\n\nc" {
+				t.Errorf("messages = %+v", messages)
+			}
+		})
+	}
+}
+
+func TestCancelledStream(t *testing.T) {
+	question := messageenvelope.MessageEnvelope{
+		UserId:    2,
+		MessageId: 10,
+		Category:  onebot.CategoryChat,
+		Timestamp: time.Now(),
+	}
+	question.TargetId = &question.UserId
+
+	s, transport := newTestSender(t)
+	s.doSend(streamPart(question, 0, "a"))
+	s.doSend(streamPart(question, 1, "b"))
+	cancel := streamPart(question, 2, "")
+	cancel.Stream.Cancelled = true
+	s.doSend(cancel)
+
+	if len(s.streamMessageIds) != 0 {
+		t.Errorf("stream message ids leaked: %v", s.streamMessageIds)
+	}
+	want := []string{"send_private_msg", "send_private_msg", "delete_msg", "delete_msg"}
+	if !reflect.DeepEqual(transport.actions, want) {
+		t.Errorf("actions = %v, want %v", transport.actions, want)
+	}
+	// 已经发出去的各段都被撤回
+	if !reflect.DeepEqual(transport.deleted, []int32{101, 102}) {
+		t.Errorf("deleted = %v, want [101 102]", transport.deleted)
+	}
+	if s.ChatContext.IsBotReply(question.TargetId, nil, 101) {
+		t.Errorf("cancelled answer was recorded")
+	}
+}
+
+// 在 release 关闭之前一直阻塞
+type slowSynthesizer struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (ss *slowSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	ss.calls.Add(1)
+	<-ss.release
+	return []byte("audio"), nil
+}
+
+func (ss *slowSynthesizer) Format() string { return "mp3" }
+func (ss *slowSynthesizer) MaxChars() int  { return 300 }
+
+func (ft *fakeTransport) getActions() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append([]string{}, ft.actions...)
+}
+
+func newTTSSender(t *testing.T, mode string) (Sender, *fakeTransport, *slowSynthesizer) {
+	t.Helper()
+	s, transport := newTestSender(t)
+	synthesizer := &slowSynthesizer{release: make(chan struct{})}
+	s.Synthesizer = synthesizer
+	if err := s.Preferences.Set(preference.KindTTS, "user/1", mode); err != nil {
+		t.Fatal(err)
+	}
+	return s, transport, synthesizer
+}
+
+func TestVoiceDoesNotBlockSender(t *testing.T) {
+	tests := []struct {
+		mode string
+		// 两条消息的文字和语音一共发送几次
+		wantActions int
+		// 语音生成之前就能发出去的回答的 message id
+		otherId int32
+		// 上下文记在哪条消息上
+		slowId int32
+	}{
+		{speech.TTSOn, 3, 102, 101},
+		{speech.TTSOnly, 2, 101, 102},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			s, transport, synthesizer := newTTSSender(t, tt.mode)
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			go s.runVoice(stopCh)
+
+			slow := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 10, Category: onebot.CategoryChat, Text: "hello"}
+			slow.TargetId = &slow.UserId
+			other := messageenvelope.MessageEnvelope{UserId: 2, MessageId: 20, Category: onebot.CategoryChat, Text: "hi"}
+			other.TargetId = &other.UserId
+
+			done := make(chan struct{})
+			go func() {
+				s.doSend(slow)
+				s.doSend(other)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("sender is blocked by speech synthesis")
+			}
+
+			// 语音还没生成，另一个用户的文字已经发出去了
+			if !s.ChatContext.IsBotReply(other.TargetId, nil, tt.otherId) {
+				t.Errorf("text answer to the other user was not sent first, actions = %v", transport.getActions())
+			}
+
+			close(synthesizer.release)
+			deadline := time.Now().Add(time.Second)
+			for len(transport.getActions()) < tt.wantActions {
+				if time.Now().After(deadline) {
+					t.Fatalf("voice was not sent, actions = %v", transport.getActions())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			// 回答写入了上下文
+			deadline = time.Now().Add(time.Second)
+			for !s.ChatContext.IsBotReply(slow.TargetId, nil, tt.slowId) {
+				if time.Now().After(deadline) {
+					t.Fatalf("answer was not recorded on message %d", tt.slowId)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if synthesizer.calls.Load() != 1 {
+				t.Errorf("synthesize called %d times", synthesizer.calls.Load())
+			}
+		})
+	}
+}
+
+func TestTTSOnlyStreamKeepsReasoning(t *testing.T) {
+	s, transport, synthesizer := newTTSSender(t, speech.TTSOnly)
+	close(synthesizer.release)
+
+	question := messageenvelope.MessageEnvelope{UserId: 1, MessageId: 10, Category: onebot.CategoryChat}
+	question.TargetId = &question.UserId
+	first := streamPart(question, 0, "a")
+	first.Reasoning = "because"
+	s.doSend(first)
+	s.doSend(streamPart(question, 1, "b"))
+	final := streamPart(question, 2, "")
+	final.Stream.Final = true
+	final.Stream.Full = "a\n\nb"
+	s.doSend(final)
+	s.doVoice(<-s.voiceCh)
+
+	want := []string{"send_private_forward_msg", "send_private_msg"}
+	if got := transport.getActions(); !equalStrings(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+	if !s.ChatContext.IsBotReply(question.TargetId, nil, 102) {
+		t.Errorf("voice answer was not recorded")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
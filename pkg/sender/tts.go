@@ -0,0 +1,132 @@
+package sender
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+	"github.com/vaaandark/qabot/pkg/onebot"
+	"github.com/vaaandark/qabot/pkg/preference"
+	"github.com/vaaandark/qabot/pkg/speech"
+)
+
+// 最多积压这么多条等待生成的语音
+const voiceQueueSize = 32
+
+type voiceTask struct {
+	m    messageenvelope.MessageEnvelope
+	mode string
+	// 只用语音回答时才会用到 think
+	think  string
+	answer string
+}
+
+// 积压太多时只用语音回答的消息改发文字，文字后面的语音直接丢掉
+func (s Sender) speak(task voiceTask) {
+	select {
+	case s.voiceCh <- task:
+		return
+	default:
+	}
+
+	log.Printf("Voice queue is full, skip voice for %s", task.m.GetNamespacedGroupOrUserID())
+	if task.mode == speech.TTSOnly {
+		messageId, err := s.sendText(task.m, task.think, task.answer)
+		if err != nil {
+			return
+		}
+		s.finish(messageId, nil, task.m)
+	}
+}
+
+func (s Sender) runVoice(stopCh <-chan struct{}) {
+	for {
+		select {
+		case task := <-s.voiceCh:
+			s.doVoice(task)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (s Sender) doVoice(task voiceTask) {
+	if task.mode != speech.TTSOnly {
+		if _, err := s.sendVoice(task.m, task.answer); err != nil {
+			log.Printf("Failed to send voice to %s: %v", task.m.GetNamespacedGroupOrUserID(), err)
+		}
+		return
+	}
+
+	messageId, err := s.sendVoiceOnly(task.m, task.think, task.answer)
+	if err != nil {
+		return
+	}
+	s.finish(messageId, nil, task.m)
+}
+
+// 只有对话的回答才可能用语音发送
+func (s Sender) ttsMode(m messageenvelope.MessageEnvelope) string {
+	if s.Synthesizer == nil || m.Category != onebot.CategoryChat {
+		return speech.TTSOff
+	}
+	mode, ok := s.Preferences.Get(preference.KindTTS, m.GetNamespacedGroupOrUserID())
+	if !ok {
+		return speech.TTSOff
+	}
+	return mode
+}
+
+// complete 为 false 时说明有内容（代码或超出长度的部分）没有被朗读
+func (s Sender) synthesize(answer string) (record onebot.Message, complete bool, err error) {
+	text, truncated := speech.PrepareText(answer, s.Synthesizer.MaxChars())
+	if len(text) == 0 {
+		return nil, false, fmt.Errorf("nothing to speak")
+	}
+
+	audio, err := s.Synthesizer.Synthesize(context.Background(), text)
+	if err != nil {
+		return nil, false, err
+	}
+	return onebot.NewRecordMessage("base64://" + base64.StdEncoding.EncodeToString(audio)), !truncated, nil
+}
+
+func (s Sender) sendRecord(m messageenvelope.MessageEnvelope, record onebot.Message) (int32, error) {
+	if m.IsInGroup() {
+		return s.doPost("send_group_msg", onebot.GroupMessage{GroupId: *m.GroupId, Message: record})
+	}
+	return s.doPost("send_private_msg", onebot.PrivateMessage{UserId: m.UserId, Message: record})
+}
+
+func (s Sender) sendVoice(m messageenvelope.MessageEnvelope, answer string) (int32, error) {
+	record, _, err := s.synthesize(answer)
+	if err != nil {
+		return 0, err
+	}
+	return s.sendRecord(m, record)
+}
+
+// 语音没能完整表达回答时仍然发送文字，上下文记在文字消息上
+func (s Sender) sendVoiceOnly(m messageenvelope.MessageEnvelope, think, answer string) (int32, error) {
+	record, complete, err := s.synthesize(answer)
+	if err != nil {
+		log.Printf("Failed to synthesize voice for %s, fall back to text: %v", m.GetNamespacedGroupOrUserID(), err)
+		return s.sendText(m, think, answer)
+	}
+	if !complete {
+		if _, err := s.sendRecord(m, record); err != nil {
+			log.Printf("Failed to send voice to %s: %v", m.GetNamespacedGroupOrUserID(), err)
+		}
+		return s.sendText(m, think, answer)
+	}
+
+	s.sendThink(m, think)
+	messageId, err := s.sendRecord(m, record)
+	if err != nil {
+		log.Printf("Failed to send voice to %s, fall back to text: %v", m.GetNamespacedGroupOrUserID(), err)
+		return s.sendText(m, "", answer)
+	}
+	return messageId, nil
+}
@@ -0,0 +1,202 @@
+package speech
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/util"
+)
+
+const (
+	BackendOpenAI  = "openai"
+	BackendCommand = "command"
+
+	defaultTranscribeTimeout = 60 * time.Second
+	// 命令参数中的占位符，会被替换成音频文件的路径
+	inputPlaceholder = "{input}"
+)
+
+type Transcriber interface {
+	// format 是音频的格式，比如 mp3、wav
+	Transcribe(ctx context.Context, audio []byte, format string) (string, error)
+	// 需要 onebot 实现把语音转换成的格式
+	Format() string
+}
+
+type STTConfig struct {
+	// openai 或 command
+	Backend string `json:"backend"`
+	// 让 onebot 实现把语音转换成的格式，默认 mp3
+	Format         string `json:"format,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+
+	// openai 兼容的 /audio/transcriptions 接口
+	Url      string `json:"url,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Language string `json:"language,omitempty"`
+
+	// 本地命令，比如 ["whisper-cli", "-m", "ggml-base.bin", "-l", "zh", "-nt", "-f", "{input}"]，
+	// 标准输出就是识别结果
+	Command []string `json:"command,omitempty"`
+}
+
+func LoadSTTConfigFromFile(path string) (*STTConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &STTConfig{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	if len(config.Format) == 0 {
+		config.Format = "mp3"
+	}
+	return config, nil
+}
+
+func (sc STTConfig) Timeout() time.Duration {
+	if sc.TimeoutSeconds <= 0 {
+		return defaultTranscribeTimeout
+	}
+	return time.Duration(sc.TimeoutSeconds) * time.Second
+}
+
+func NewTranscriber(config STTConfig) (Transcriber, error) {
+	switch config.Backend {
+	case BackendOpenAI:
+		if len(config.Url) == 0 {
+			return nil, fmt.Errorf("url is required for openai stt backend")
+		}
+		return &OpenAITranscriber{config: config, client: &http.Client{}}, nil
+	case BackendCommand:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("command is required for command stt backend")
+		}
+		return &CommandTranscriber{config: config}, nil
+	default:
+		return nil, fmt.Errorf("unknown stt backend %s", config.Backend)
+	}
+}
+
+type OpenAITranscriber struct {
+	config STTConfig
+	client *http.Client
+}
+
+func (t *OpenAITranscriber) Format() string {
+	return t.config.Format
+}
+
+func (t *OpenAITranscriber) Transcribe(ctx context.Context, audio []byte, format string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.config.Timeout())
+	defer cancel()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "voice."+format)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", err
+	}
+	fields := map[string]string{
+		"model":           t.config.Model,
+		"language":        t.config.Language,
+		"response_format": "json",
+	}
+	for name, value := range fields {
+		if len(value) == 0 {
+			continue
+		}
+		if err := writer.WriteField(name, value); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.Url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if len(t.config.Key) != 0 {
+		req.Header.Set("Authorization", "Bearer "+t.config.Key)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("transcription failed with status %d: %s", resp.StatusCode, util.TruncateLogStr(string(respBytes)))
+	}
+
+	result := struct {
+		Text string `json:"text"`
+	}{}
+	if err := json.Unmarshal(respBytes, &result); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+type CommandTranscriber struct {
+	config STTConfig
+}
+
+func (t *CommandTranscriber) Format() string {
+	return t.config.Format
+}
+
+func (t *CommandTranscriber) Transcribe(ctx context.Context, audio []byte, format string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.config.Timeout())
+	defer cancel()
+
+	f, err := os.CreateTemp("", "qabot-voice-*."+format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(audio); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	args := make([]string, 0, len(t.config.Command))
+	for _, arg := range t.config.Command {
+		args = append(args, strings.ReplaceAll(arg, inputPlaceholder, f.Name()))
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, util.TruncateLogStr(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,335 @@
+package speech
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaaandark/qabot/pkg/util"
+)
+
+const (
+	TTSOn   = "on"
+	TTSOff  = "off"
+	TTSOnly = "only"
+
+	defaultSynthesizeTimeout = 60 * time.Second
+	defaultMaxChars          = 300
+	defaultCacheDir          = "tts-cache"
+	defaultCacheMaxBytes     = 256 << 20
+	// 命令参数中的占位符，会被替换成输出文件的路径
+	outputPlaceholder = "{output}"
+)
+
+type Synthesizer interface {
+	// 返回 Format() 格式的音频
+	Synthesize(ctx context.Context, text string) ([]byte, error)
+	Format() string
+	// 一次最多朗读的字数
+	MaxChars() int
+}
+
+type TTSConfig struct {
+	// openai 或 command
+	Backend string `json:"backend"`
+	// 生成的音频格式，默认 mp3
+	Format         string `json:"format,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+	// 超过的部分不会朗读，默认 300
+	MaxChars int `json:"max_chars,omitempty"`
+	// 缓存生成的音频，相同的文字不会重复生成，默认 tts-cache
+	CacheDir      string `json:"cache_dir,omitempty"`
+	CacheMaxBytes int64  `json:"cache_max_bytes,omitempty"`
+
+	// openai 兼容的 /audio/speech 接口
+	Url   string   `json:"url,omitempty"`
+	Key   string   `json:"key,omitempty"`
+	Model string   `json:"model,omitempty"`
+	Voice string   `json:"voice,omitempty"`
+	Speed *float64 `json:"speed,omitempty"`
+
+	// 本地命令，文字从标准输入传入，比如
+	// ["piper", "--model", "zh_CN-huayan-medium.onnx", "--output_file", "{output}"]，
+	// 不含 {output} 时标准输出就是音频
+	Command []string `json:"command,omitempty"`
+}
+
+func LoadTTSConfigFromFile(path string) (*TTSConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &TTSConfig{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	if len(config.Format) == 0 {
+		config.Format = "mp3"
+	}
+	if config.MaxChars <= 0 {
+		config.MaxChars = defaultMaxChars
+	}
+	if len(config.CacheDir) == 0 {
+		config.CacheDir = defaultCacheDir
+	}
+	if config.CacheMaxBytes <= 0 {
+		config.CacheMaxBytes = defaultCacheMaxBytes
+	}
+	return config, nil
+}
+
+func (tc TTSConfig) Timeout() time.Duration {
+	if tc.TimeoutSeconds <= 0 {
+		return defaultSynthesizeTimeout
+	}
+	return time.Duration(tc.TimeoutSeconds) * time.Second
+}
+
+func NewSynthesizer(config TTSConfig) (Synthesizer, error) {
+	var synthesizer Synthesizer
+	switch config.Backend {
+	case BackendOpenAI:
+		if len(config.Url) == 0 {
+			return nil, fmt.Errorf("url is required for openai tts backend")
+		}
+		synthesizer = &OpenAISynthesizer{config: config, client: &http.Client{}}
+	case BackendCommand:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("command is required for command tts backend")
+		}
+		synthesizer = &CommandSynthesizer{config: config}
+	default:
+		return nil, fmt.Errorf("unknown tts backend %s", config.Backend)
+	}
+
+	if len(config.CacheDir) == 0 {
+		return synthesizer, nil
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &CachedSynthesizer{Synthesizer: synthesizer, config: config}, nil
+}
+
+type OpenAISynthesizer struct {
+	config TTSConfig
+	client *http.Client
+}
+
+func (s *OpenAISynthesizer) Format() string {
+	return s.config.Format
+}
+
+func (s *OpenAISynthesizer) MaxChars() int {
+	return s.config.MaxChars
+}
+
+func (s *OpenAISynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout())
+	defer cancel()
+
+	body, err := json.Marshal(struct {
+		Model          string   `json:"model,omitempty"`
+		Input          string   `json:"input"`
+		Voice          string   `json:"voice,omitempty"`
+		ResponseFormat string   `json:"response_format,omitempty"`
+		Speed          *float64 `json:"speed,omitempty"`
+	}{
+		Model:          s.config.Model,
+		Input:          text,
+		Voice:          s.config.Voice,
+		ResponseFormat: s.config.Format,
+		Speed:          s.config.Speed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.config.Key) != 0 {
+		req.Header.Set("Authorization", "Bearer "+s.config.Key)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	audio, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("speech synthesis failed with status %d: %s", resp.StatusCode, util.TruncateLogStr(string(audio)))
+	}
+	return audio, nil
+}
+
+type CommandSynthesizer struct {
+	config TTSConfig
+}
+
+func (s *CommandSynthesizer) Format() string {
+	return s.config.Format
+}
+
+func (s *CommandSynthesizer) MaxChars() int {
+	return s.config.MaxChars
+}
+
+func (s *CommandSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "qabot-tts-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "speech."+s.config.Format)
+
+	toFile := false
+	args := make([]string, 0, len(s.config.Command))
+	for _, arg := range s.config.Command {
+		if strings.Contains(arg, outputPlaceholder) {
+			toFile = true
+		}
+		args = append(args, strings.ReplaceAll(arg, outputPlaceholder, output))
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, util.TruncateLogStr(stderr.String()))
+	}
+	if !toFile {
+		return stdout.Bytes(), nil
+	}
+	return os.ReadFile(output)
+}
+
+// 按文字和声音参数的哈希缓存音频，总大小超过上限时删除最久没用的
+type CachedSynthesizer struct {
+	Synthesizer
+	config TTSConfig
+	mu     sync.Mutex
+}
+
+func (s *CachedSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(strings.Join([]string{s.config.Backend, s.config.Url, s.config.Model, s.config.Voice, strings.Join(s.config.Command, " "), text}, "\x00")))
+	path := filepath.Join(s.config.CacheDir, hex.EncodeToString(sum[:])+"."+s.Format())
+
+	if audio, err := os.ReadFile(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return audio, nil
+	}
+
+	audio, err := s.Synthesizer.Synthesize(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.WriteFile(path, audio, 0o644); err != nil {
+		log.Printf("Failed to cache speech: %v", err)
+		return audio, nil
+	}
+	s.evict()
+	return audio, nil
+}
+
+func (s *CachedSynthesizer) evict() {
+	entries, err := os.ReadDir(s.config.CacheDir)
+	if err != nil {
+		log.Printf("Failed to read speech cache dir: %v", err)
+		return
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cached{}
+	total := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cached{path: filepath.Join(s.config.CacheDir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	if total <= s.config.CacheMaxBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		if total <= s.config.CacheMaxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Failed to remove cached speech %s: %v", f.path, err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+var (
+	codeBlockPattern = regexp.MustCompile("(?s)```.*?```")
+	markdownPattern  = regexp.MustCompile("[*_`#>|~]+")
+	linkPattern      = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	sentenceEnds     = "。！？!?；;\n"
+)
+
+// 去掉不适合朗读的 Markdown 标记和代码块，超过 maxChars 时在句子结尾处截断，
+// truncated 表示有内容没有被朗读
+func PrepareText(text string, maxChars int) (speech string, truncated bool) {
+	truncated = codeBlockPattern.MatchString(text)
+	text = codeBlockPattern.ReplaceAllString(text, "（代码略）")
+	text = linkPattern.ReplaceAllString(text, "$1")
+	text = markdownPattern.ReplaceAllString(text, "")
+	text = strings.TrimSpace(text)
+
+	runes := []rune(text)
+	if maxChars <= 0 || len(runes) <= maxChars {
+		return text, truncated
+	}
+	cut := maxChars
+	for i := maxChars - 1; i > maxChars/2; i-- {
+		if strings.ContainsRune(sentenceEnds, runes[i]) {
+			cut = i + 1
+			break
+		}
+	}
+	return strings.TrimSpace(string(runes[:cut])), true
+}
@@ -0,0 +1,77 @@
+package speech
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTTSConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tts-config.json")
+	if err := os.WriteFile(path, []byte(`{"backend":"command","command":["cat"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadTTSConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Format != "mp3" || config.MaxChars != defaultMaxChars || config.CacheDir != defaultCacheDir || config.CacheMaxBytes != defaultCacheMaxBytes {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+type countingSynthesizer struct {
+	calls int
+}
+
+func (cs *countingSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	cs.calls++
+	return []byte("audio of " + text), nil
+}
+
+func (cs *countingSynthesizer) Format() string { return "mp3" }
+func (cs *countingSynthesizer) MaxChars() int  { return 300 }
+
+func TestCachedSynthesizer(t *testing.T) {
+	inner := &countingSynthesizer{}
+	s := &CachedSynthesizer{
+		Synthesizer: inner,
+		config:      TTSConfig{CacheDir: t.TempDir(), CacheMaxBytes: 1 << 20},
+	}
+	for i := 0; i < 3; i++ {
+		audio, err := s.Synthesize(context.Background(), "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(audio) != "audio of hello" {
+			t.Errorf("audio = %q", audio)
+		}
+	}
+	if _, err := s.Synthesize(context.Background(), "world"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 2 {
+		t.Errorf("synthesized %d times, want 2", inner.calls)
+	}
+}
+
+func TestPrepareText(t *testing.T) {
+	tests := []struct {
+		text          string
+		maxChars      int
+		want          string
+		wantTruncated bool
+	}{
+		{"**你好**，[链接](https://example.com)", 300, "你好，链接", false},
+		{"看代码：\n```go\nfmt.Println()\n```", 300, "看代码：\n（代码略）", true},
+		{"第一句。第二句。第三句。", 10, "第一句。第二句。", true},
+		{"没有句号的一长串文字", 5, "没有句号的", true},
+	}
+	for _, tt := range tests {
+		got, truncated := PrepareText(tt.text, tt.maxChars)
+		if got != tt.want || truncated != tt.wantTruncated {
+			t.Errorf("PrepareText(%q) = %q, %v, want %q, %v", tt.text, got, truncated, tt.want, tt.wantTruncated)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/vaaandark/qabot/pkg/chatcontext"
+)
+
+const (
+	keyPrefix = "usage/"
+	dayLayout = "2006-01-02"
+)
+
+// 一段时间内的用量合计
+type Totals struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	ReasoningTokens  int64   `json:"reasoning_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (t Totals) Add(other Totals) Totals {
+	return Totals{
+		Requests:         t.Requests + other.Requests,
+		PromptTokens:     t.PromptTokens + other.PromptTokens,
+		CompletionTokens: t.CompletionTokens + other.CompletionTokens,
+		ReasoningTokens:  t.ReasoningTokens + other.ReasoningTokens,
+		Cost:             t.Cost + other.Cost,
+	}
+}
+
+func (t Totals) TotalTokens() int64 {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+// 某一天某个提供商、群或用户的用量
+type Entry struct {
+	Day string
+	// provider/<名字>、group/<群号> 或 user/<QQ 号>
+	Id string
+	Totals
+}
+
+func (e Entry) Kind() string {
+	kind, _, _ := strings.Cut(e.Id, "/")
+	return kind
+}
+
+// 按天汇总用量，和上下文存在同一个数据库中
+type Store struct {
+	db *leveldb.DB
+	mu sync.Mutex
+}
+
+func NewStore(db *leveldb.DB) *Store {
+	return &Store{db: db}
+}
+
+func key(day, id string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s", keyPrefix, day, id))
+}
+
+func ProviderId(name string) string {
+	return "provider/" + name
+}
+
+// 把一次回答的用量同时计入今天的每个 id
+func (s *Store) Record(ids []string, u chatcontext.Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := time.Now().Format(dayLayout)
+	batch := new(leveldb.Batch)
+	for _, id := range ids {
+		totals := Totals{}
+		b, err := s.db.Get(key(day, id), nil)
+		if err == nil {
+			if err := json.Unmarshal(b, &totals); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return err
+		}
+
+		totals = totals.Add(Totals{
+			Requests:         1,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			ReasoningTokens:  u.ReasoningTokens,
+			Cost:             u.Cost,
+		})
+		b, err = json.Marshal(totals)
+		if err != nil {
+			return err
+		}
+		batch.Put(key(day, id), b)
+	}
+	return s.db.Write(batch, nil)
+}
+
+// 最近 days 天（包括今天）的用量，按日期从新到旧排列
+func (s *Store) Load(days int) ([]Entry, error) {
+	if days < 1 {
+		days = 1
+	}
+	since := time.Now().AddDate(0, 0, 1-days).Format(dayLayout)
+
+	entries := []Entry{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	for ok := iter.Seek(key(since, "")); ok; ok = iter.Next() {
+		day, id, found := strings.Cut(strings.TrimPrefix(string(iter.Key()), keyPrefix), "/")
+		if !found {
+			continue
+		}
+		entry := Entry{Day: day, Id: id}
+		if err := json.Unmarshal(iter.Value(), &entry.Totals); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Day > entries[j].Day
+	})
+	return entries, nil
+}
+
+// 按 id 合计，按费用和 token 数从多到少排列
+func SumById(entries []Entry) []Entry {
+	sums := make(map[string]Totals)
+	for _, entry := range entries {
+		sums[entry.Id] = sums[entry.Id].Add(entry.Totals)
+	}
+
+	result := make([]Entry, 0, len(sums))
+	for id, totals := range sums {
+		result = append(result, Entry{Id: id, Totals: totals})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Cost != result[j].Cost {
+			return result[i].Cost > result[j].Cost
+		}
+		if result[i].TotalTokens() != result[j].TotalTokens() {
+			return result[i].TotalTokens() > result[j].TotalTokens()
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+// 按天合计提供商的用量，每次回答只计入一个提供商，所以就是每天的总用量
+func SumByDay(entries []Entry) []Entry {
+	result := []Entry{}
+	for _, entry := range entries {
+		if entry.Kind() != "provider" {
+			continue
+		}
+		if len(result) == 0 || result[len(result)-1].Day != entry.Day {
+			result = append(result, Entry{Day: entry.Day})
+		}
+		last := &result[len(result)-1]
+		last.Totals = last.Totals.Add(entry.Totals)
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 读取 onebot 消息段中的文件，支持 http(s)://、file://、本地绝对路径和 base64://
+func Fetch(ctx context.Context, client *http.Client, source string, maxBytes int64) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch %s: status %d", TruncateLogStr(source), resp.StatusCode)
+		}
+		return readLimited(resp.Body, maxBytes)
+	case strings.HasPrefix(source, "base64://"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(source, "base64://"))
+	case strings.HasPrefix(source, "file://") || filepath.IsAbs(source):
+		f, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readLimited(f, maxBytes)
+	default:
+		return nil, fmt.Errorf("unsupported source %s", TruncateLogStr(source))
+	}
+}
+
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxBytes)
+	}
+	return data, nil
+}
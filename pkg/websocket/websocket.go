@@ -0,0 +1,319 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 为了不引入依赖自己实现，只实现 onebot 用到的部分：服务端握手、文本消息、分片、ping/pong 和关闭，不支持扩展
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+
+	acceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// 控制帧的负载不能超过 125 字节
+	maxControlPayload   = 125
+	closeProtocolError  = 1002
+	closeInvalidPayload = 1007
+	closeTooBig         = 1009
+	// 单条消息的上限，合并转发的 get_forward_msg 响应可能比较大
+	maxMessageBytes = 64 << 20
+	writeTimeout    = 10 * time.Second
+)
+
+var (
+	ErrClosed   = errors.New("websocket closed")
+	ErrProtocol = errors.New("websocket protocol error")
+)
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// 单条消息的上限
+	maxMessage int
+	mu         sync.Mutex
+	closed     bool
+}
+
+func computeAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, v := range header.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported websocket version %s", r.Header.Get("Sec-Websocket-Version"))
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if len(key) == 0 {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAccept(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, reader: rw.Reader, maxMessage: maxMessageBytes}, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// 返回一条完整的文本或二进制消息，自动回应 ping，收到 close 时返回 ErrClosed
+func (c *Conn) ReadMessage() (opcode byte, payload []byte, err error) {
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, c.closeByPeer(data)
+		case OpText, OpBinary:
+			opcode = op
+			payload = data
+		default:
+			return 0, nil, c.fail(closeProtocolError, "unexpected opcode %d", op)
+		}
+
+		// 分片消息，中间可能穿插控制帧
+		for !fin {
+			var next []byte
+			fin, op, next, err = c.readFrame()
+			if err != nil {
+				return 0, nil, err
+			}
+			switch op {
+			case OpPing:
+				if err := c.WriteMessage(OpPong, next); err != nil {
+					return 0, nil, err
+				}
+				fin = false
+				continue
+			case OpPong:
+				fin = false
+				continue
+			case OpClose:
+				return 0, nil, c.closeByPeer(next)
+			case OpContinuation:
+			default:
+				return 0, nil, c.fail(closeProtocolError, "unexpected opcode %d in fragmented message", op)
+			}
+			if len(payload)+len(next) > c.maxMessage {
+				return 0, nil, c.fail(closeTooBig, "message is larger than %d bytes", c.maxMessage)
+			}
+			payload = append(payload, next...)
+		}
+		if opcode == OpText && !utf8.Valid(payload) {
+			return 0, nil, c.fail(closeInvalidPayload, "text message is not valid UTF-8")
+		}
+		return opcode, payload, nil
+	}
+}
+
+// 回应对方的关闭帧，关闭帧的负载要么为空，要么是合法的状态码加 UTF-8 的原因
+func (c *Conn) closeByPeer(data []byte) error {
+	switch {
+	case len(data) == 0:
+	case len(data) == 1:
+		return c.fail(closeProtocolError, "close frame payload is 1 byte")
+	case !validCloseCode(binary.BigEndian.Uint16(data)):
+		return c.fail(closeProtocolError, "invalid close code %d", binary.BigEndian.Uint16(data))
+	case !utf8.Valid(data[2:]):
+		return c.fail(closeInvalidPayload, "close reason is not valid UTF-8")
+	}
+	c.WriteMessage(OpClose, data)
+	c.Close()
+	return ErrClosed
+}
+
+// 1005、1006 和 1015 只能在本地使用，不能出现在关闭帧里
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// 对方违反协议时发送关闭帧并断开连接
+func (c *Conn) fail(code uint16, format string, args ...interface{}) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	c.WriteMessage(OpClose, payload)
+	c.Close()
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	// 没有协商扩展，RSV 必须为 0；客户端发来的帧必须加掩码
+	if header[0]&0x70 != 0 {
+		err = c.fail(closeProtocolError, "reserved bits are set")
+		return
+	}
+	if !masked {
+		err = c.fail(closeProtocolError, "client frame is not masked")
+		return
+	}
+	if opcode&0x8 != 0 {
+		if !fin {
+			err = c.fail(closeProtocolError, "control frame is fragmented")
+			return
+		}
+		if length > maxControlPayload {
+			err = c.fail(closeProtocolError, "control frame is larger than %d bytes", maxControlPayload)
+			return
+		}
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > uint64(c.maxMessage) {
+		err = c.fail(closeTooBig, "frame is larger than %d bytes", c.maxMessage)
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	// 边读边分配，不按对方声明的长度一次性分配
+	buf := bytes.Buffer{}
+	if _, err = io.CopyN(&buf, c.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	payload = buf.Bytes()
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// 服务端发送的帧不加掩码，可以并发调用
+func (c *Conn) WriteMessage(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
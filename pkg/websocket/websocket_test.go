@@ -0,0 +1,374 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// 按客户端的方式编码一帧，masked 为 false 时不加掩码
+func encodeFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		b = append(b, maskBit|byte(length))
+	case length <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func masked(fin bool, opcode byte, payload string) []byte {
+	return encodeFrame(fin, opcode, []byte(payload), true)
+}
+
+// 读取服务端发来的一帧，服务端的帧不加掩码
+func decodeFrame(r io.Reader) (frame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame{}, err
+	}
+	if header[1]&0x80 != 0 {
+		return frame{}, errors.New("server frame is masked")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f, payload: payload}, nil
+}
+
+// 客户端发出 frames，返回服务端连接和服务端发来的所有帧（服务端连接关闭后才有结果）
+func pipe(t *testing.T, frames ...[]byte) (*Conn, <-chan []frame) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+
+	received := make(chan []frame, 1)
+	go func() {
+		frames := []frame{}
+		for {
+			f, err := decodeFrame(client)
+			if err != nil {
+				received <- frames
+				return
+			}
+			frames = append(frames, f)
+		}
+	}()
+	return &Conn{conn: server, reader: bufio.NewReader(server), maxMessage: maxMessageBytes}, received
+}
+
+func TestReadMessage(t *testing.T) {
+	conn, received := pipe(t,
+		masked(true, OpText, `{"post_type":"message"}`),
+		// 分片消息中间穿插 ping
+		masked(false, OpText, "hel"),
+		masked(true, OpPing, "are you there"),
+		masked(false, OpContinuation, "lo, "),
+		masked(true, OpPong, ""),
+		masked(true, OpContinuation, "world"),
+		masked(true, OpBinary, strings.Repeat("x", 70000)),
+		// 多字节字符被拆到两个分片里
+		masked(false, OpText, "你\xe5"),
+		masked(true, OpContinuation, "\xa5\xbd"),
+	)
+
+	want := []struct {
+		opcode  byte
+		payload string
+	}{
+		{OpText, `{"post_type":"message"}`},
+		{OpText, "hello, world"},
+		{OpBinary, strings.Repeat("x", 70000)},
+		{OpText, "你好"},
+	}
+	for _, w := range want {
+		opcode, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if opcode != w.opcode || string(payload) != w.payload {
+			t.Errorf("ReadMessage = %d %.20q, want %d %.20q", opcode, payload, w.opcode, w.payload)
+		}
+	}
+	conn.Close()
+
+	frames := <-received
+	if len(frames) != 1 || frames[0].opcode != OpPong || string(frames[0].payload) != "are you there" {
+		t.Errorf("server frames = %+v, want one pong", frames)
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	closePayload := string(binary.BigEndian.AppendUint16(nil, 1000))
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"close", [][]byte{masked(true, OpClose, closePayload)}},
+		{"close inside fragmented message", [][]byte{masked(false, OpText, "a"), masked(true, OpClose, closePayload)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, received := pipe(t, tt.frames...)
+			if _, _, err := conn.ReadMessage(); !errors.Is(err, ErrClosed) {
+				t.Fatalf("err = %v, want ErrClosed", err)
+			}
+			frames := <-received
+			if len(frames) != 1 || frames[0].opcode != OpClose || string(frames[0].payload) != closePayload {
+				t.Errorf("server frames = %+v, want close echo", frames)
+			}
+			if err := conn.WriteMessage(OpText, []byte("late")); !errors.Is(err, ErrClosed) {
+				t.Errorf("write after close: err = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestReadMessageProtocolError(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		wantCode uint16
+	}{
+		{"unmasked frame", [][]byte{encodeFrame(true, OpText, []byte("hi"), false)}, closeProtocolError},
+		{"unmasked control frame", [][]byte{encodeFrame(true, OpPing, nil, false)}, closeProtocolError},
+		{"reserved bits", [][]byte{append([]byte{0x80 | 0x40 | OpText}, masked(true, OpText, "hi")[1:]...)}, closeProtocolError},
+		{"fragmented ping", [][]byte{masked(false, OpPing, "p"), masked(true, OpContinuation, "q")}, closeProtocolError},
+		{"fragmented close", [][]byte{masked(false, OpClose, "")}, closeProtocolError},
+		{"large ping", [][]byte{masked(true, OpPing, strings.Repeat("p", maxControlPayload+1))}, closeProtocolError},
+		{"continuation without start", [][]byte{masked(true, OpContinuation, "x")}, closeProtocolError},
+		{"new message inside fragmented message", [][]byte{masked(false, OpText, "a"), masked(true, OpText, "b")}, closeProtocolError},
+		{"unknown opcode", [][]byte{masked(true, 0x3, "")}, closeProtocolError},
+		{"unknown control opcode", [][]byte{masked(true, 0xb, "")}, closeProtocolError},
+		{"unknown opcode inside fragmented message", [][]byte{masked(false, OpText, "a"), masked(true, 0x3, "b")}, closeProtocolError},
+		{"large ping inside fragmented message", [][]byte{masked(false, OpText, "a"), masked(true, OpPing, strings.Repeat("p", maxControlPayload+1))}, closeProtocolError},
+		{"close with 1 byte", [][]byte{masked(true, OpClose, "x")}, closeProtocolError},
+		{"close with reserved code", [][]byte{masked(true, OpClose, string(binary.BigEndian.AppendUint16(nil, 1005)))}, closeProtocolError},
+		{"close with invalid reason", [][]byte{masked(true, OpClose, string(binary.BigEndian.AppendUint16(nil, 1000))+"\xff")}, closeInvalidPayload},
+		{"invalid UTF-8 text", [][]byte{masked(true, OpText, "\xff")}, closeInvalidPayload},
+		{"truncated UTF-8 in fragmented text", [][]byte{masked(false, OpText, "a"), masked(true, OpContinuation, "\xe4\xbd")}, closeInvalidPayload},
+		{"frame too large", [][]byte{append([]byte{0x80 | OpBinary, 0x80 | 127}, binary.BigEndian.AppendUint64(nil, maxMessageBytes+1)...)}, closeTooBig},
+		{"frame length overflows", [][]byte{append([]byte{0x80 | OpBinary, 0x80 | 127}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)}, closeTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, received := pipe(t, tt.frames...)
+			if _, _, err := conn.ReadMessage(); !errors.Is(err, ErrProtocol) {
+				t.Fatalf("err = %v, want ErrProtocol", err)
+			}
+			frames := <-received
+			if len(frames) != 1 || frames[0].opcode != OpClose {
+				t.Fatalf("server frames = %+v, want close", frames)
+			}
+			if code := binary.BigEndian.Uint16(frames[0].payload); code != tt.wantCode {
+				t.Errorf("close code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// 每个分片都不超过上限，但合起来超过
+func TestReadMessageFragmentsTooLarge(t *testing.T) {
+	conn, received := pipe(t, masked(false, OpText, strings.Repeat("a", 10)), masked(true, OpContinuation, "b"))
+	conn.maxMessage = 10
+	if _, _, err := conn.ReadMessage(); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("err = %v, want ErrProtocol", err)
+	}
+	frames := <-received
+	if len(frames) != 1 || frames[0].opcode != OpClose || binary.BigEndian.Uint16(frames[0].payload) != closeTooBig {
+		t.Errorf("server frames = %+v, want close %d", frames, closeTooBig)
+	}
+}
+
+// 对方声明了很长的负载但没有发完就断开
+func TestReadMessageTruncated(t *testing.T) {
+	tests := [][]byte{
+		{0x80 | OpText},
+		{0x80 | OpText, 0x80 | 126, 0x01},
+		masked(true, OpText, "hello")[:8],
+		append([]byte{0x80 | OpBinary, 0x80 | 127}, append(binary.BigEndian.AppendUint64(nil, maxMessageBytes), 1, 2, 3, 4, 5)...),
+	}
+	for _, data := range tests {
+		conn := &Conn{conn: discardConn(t), reader: bufio.NewReader(bytes.NewReader(data)), maxMessage: maxMessageBytes}
+		if _, _, err := conn.ReadMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%x: err = %v, want ErrUnexpectedEOF", data, err)
+		}
+	}
+}
+
+// 写入的内容全部丢弃的连接
+func discardConn(t testing.TB) net.Conn {
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(masked(true, OpText, "hello"))
+	f.Add(append(masked(false, OpText, "hel"), append(masked(true, OpPing, "p"), masked(true, OpContinuation, "lo")...)...))
+	f.Add(masked(true, OpClose, string(binary.BigEndian.AppendUint16(nil, 1000))))
+	f.Add(encodeFrame(true, OpBinary, bytes.Repeat([]byte{0}, 300), true))
+	f.Add(encodeFrame(true, OpText, []byte("hi"), false))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &Conn{conn: discardConn(t), reader: bufio.NewReader(bytes.NewReader(data)), maxMessage: 1 << 10}
+		for {
+			opcode, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode != OpText && opcode != OpBinary {
+				t.Fatalf("opcode = %d", opcode)
+			}
+			if len(payload) > conn.maxMessage {
+				t.Fatalf("payload length = %d", len(payload))
+			}
+			if opcode == OpText && !utf8.Valid(payload) {
+				t.Fatalf("invalid UTF-8 text %q", payload)
+			}
+		}
+	})
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, length := range []int{0, 125, 126, 0xffff, 0x10000} {
+		server, client := net.Pipe()
+		conn := &Conn{conn: server, reader: bufio.NewReader(server)}
+		payload := bytes.Repeat([]byte("a"), length)
+		go conn.WriteMessage(OpText, payload)
+
+		f, err := decodeFrame(client)
+		if err != nil {
+			t.Fatalf("length %d: %v", length, err)
+		}
+		if !f.fin || f.opcode != OpText || !bytes.Equal(f.payload, payload) {
+			t.Errorf("length %d: got fin=%v opcode=%d length=%d", length, f.fin, f.opcode, len(f.payload))
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(OpText, payload)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET: status = %d, want 400", resp.StatusCode)
+	}
+
+	client, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// RFC 6455 1.3 中的例子
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("accept = %q", got)
+	}
+
+	if _, err := client.Write(masked(true, OpText, "echo")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := decodeFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.opcode != OpText || string(f.payload) != "echo" {
+		t.Errorf("echo = %+v", f)
+	}
+}
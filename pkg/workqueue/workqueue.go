@@ -0,0 +1,213 @@
+package workqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+)
+
+const keyPrefix = "queue/"
+
+var ErrFull = errors.New("work queue is full")
+
+type Task struct {
+	seq     uint64
+	Message messageenvelope.MessageEnvelope
+}
+
+func (t Task) key() []byte {
+	// 补零让数据库中的顺序就是入队顺序
+	return []byte(fmt.Sprintf("%s%020d", keyPrefix, t.seq))
+}
+
+// 同一个用户在同一个群或私聊中的提问是一个会话，群里不同用户的提问互不影响
+func (t Task) conversation() string {
+	if t.Message.IsInGroup() {
+		return fmt.Sprintf("%s/%s", t.Message.GetNamespacedGroupOrUserID(), t.Message.GetNamespacedUserID())
+	}
+	return t.Message.GetNamespacedUserID()
+}
+
+// 有界的消息队列，同一个会话的消息按顺序一条一条处理，不同的会话可以并发。
+// 还没处理完的消息保存在数据库中，重启后继续处理
+type Queue struct {
+	db    *leveldb.DB
+	depth int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	seq  uint64
+	// 等待处理的消息，按入队顺序排列
+	pending []Task
+	// 正在处理的会话
+	busy map[string]bool
+	// 正在等待消息的 worker 数
+	idle   int
+	closed bool
+}
+
+func NewQueue(db *leveldb.DB, depth int) (*Queue, error) {
+	q := &Queue{
+		db:    db,
+		depth: depth,
+		busy:  make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	iter := db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), keyPrefix), 10, 64)
+		if err != nil {
+			log.Printf("Failed to parse queue key %s: %v", iter.Key(), err)
+			continue
+		}
+		task := Task{seq: seq}
+		if err := json.Unmarshal(iter.Value(), &task.Message); err != nil {
+			log.Printf("Failed to unmarshal queued message: %v", err)
+			continue
+		}
+		q.pending = append(q.pending, task)
+		q.seq = seq
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(q.pending) != 0 {
+		log.Printf("Restore %d queued messages", len(q.pending))
+	}
+	return q, nil
+}
+
+// 返回前面还有几条消息要等，0 表示马上就会开始处理
+func (q *Queue) Push(m messageenvelope.MessageEnvelope) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= q.depth {
+		return 0, ErrFull
+	}
+
+	task := Task{seq: q.seq + 1, Message: m}
+	b, err := json.Marshal(task.Message)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.db.Put(task.key(), b, nil); err != nil {
+		return 0, err
+	}
+	q.seq = task.seq
+	q.pending = append(q.pending, task)
+	q.cond.Signal()
+
+	return q.position(len(q.pending) - 1), nil
+}
+
+// 按 Pop 的规则模拟空闲的 worker 取消息，返回第 i 条消息前面还有几条没开始处理的消息，
+// 马上就会开始处理时返回 0
+func (q *Queue) position(i int) int {
+	busy := make(map[string]bool, len(q.busy))
+	for conversation := range q.busy {
+		busy[conversation] = true
+	}
+	idle := q.idle
+	waiting := 0
+	for j, task := range q.pending[:i+1] {
+		if idle > 0 && !busy[task.conversation()] {
+			if j == i {
+				return 0
+			}
+			busy[task.conversation()] = true
+			idle--
+			continue
+		}
+		waiting++
+	}
+	return waiting
+}
+
+// 取出最早的一条所在会话空闲的消息，没有时阻塞，队列关闭后返回 false
+func (q *Queue) Pop() (Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.idle++
+	defer func() { q.idle-- }()
+
+	for !q.closed {
+		for i, task := range q.pending {
+			if q.busy[task.conversation()] {
+				continue
+			}
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.busy[task.conversation()] = true
+			return task, true
+		}
+		q.cond.Wait()
+	}
+	return Task{}, false
+}
+
+// 消息处理完后调用，同一会话的下一条消息才能开始处理
+func (q *Queue) Done(task Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.db.Delete(task.key(), nil); err != nil {
+		log.Printf("Failed to delete queued message: %v", err)
+	}
+	delete(q.busy, task.conversation())
+	q.cond.Broadcast()
+}
+
+// 删除还没开始处理的消息，比如被撤回的消息，namespacedId 为群或私聊的 id
+func (q *Queue) Remove(namespacedId string, messageId int32) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, task := range q.pending {
+		if task.Message.GetNamespacedGroupOrUserID() != namespacedId || task.Message.MessageId != messageId {
+			continue
+		}
+		if err := q.db.Delete(task.key(), nil); err != nil {
+			log.Printf("Failed to delete queued message: %v", err)
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// 正在等待的 Pop 会返回 false，留在队列中的消息下次启动时继续处理
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+type Stats struct {
+	Pending int `json:"pending"`
+	Running int `json:"running"`
+	Depth   int `json:"depth"`
+}
+
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return Stats{
+		Pending: len(q.pending),
+		Running: len(q.busy),
+		Depth:   q.depth,
+	}
+}
@@ -0,0 +1,242 @@
+package workqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/vaaandark/qabot/pkg/messageenvelope"
+)
+
+func openDB(t *testing.T, dir string) *leveldb.DB {
+	t.Helper()
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	return db
+}
+
+func groupMessage(groupId, userId int64, messageId int32) messageenvelope.MessageEnvelope {
+	return messageenvelope.MessageEnvelope{GroupId: &groupId, UserId: userId, MessageId: messageId}
+}
+
+func privateMessage(userId int64, messageId int32) messageenvelope.MessageEnvelope {
+	return messageenvelope.MessageEnvelope{UserId: userId, MessageId: messageId}
+}
+
+func push(t *testing.T, q *Queue, m messageenvelope.MessageEnvelope) int {
+	t.Helper()
+	waiting, err := q.Push(m)
+	if err != nil {
+		t.Fatalf("push %d: %v", m.MessageId, err)
+	}
+	return waiting
+}
+
+func pop(t *testing.T, q *Queue) Task {
+	t.Helper()
+	ch := make(chan Task, 1)
+	go func() {
+		task, ok := q.Pop()
+		if ok {
+			ch <- task
+		}
+	}()
+	select {
+	case task := <-ch:
+		return task
+	case <-time.After(time.Second):
+		t.Fatalf("pop timed out")
+		return Task{}
+	}
+}
+
+func TestConversation(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b messageenvelope.MessageEnvelope
+		same bool
+	}{
+		{"same user in same group", groupMessage(1, 10, 1), groupMessage(1, 10, 2), true},
+		{"different users in same group", groupMessage(1, 10, 1), groupMessage(1, 11, 2), false},
+		{"same user in different groups", groupMessage(1, 10, 1), groupMessage(2, 10, 2), false},
+		{"same user in group and private", groupMessage(1, 10, 1), privateMessage(10, 2), false},
+		{"same user in private", privateMessage(10, 1), privateMessage(10, 2), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same := Task{Message: tt.a}.conversation() == Task{Message: tt.b}.conversation()
+			if same != tt.same {
+				t.Errorf("same conversation = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestPopKeepsConversationOrder(t *testing.T) {
+	q, err := NewQueue(openDB(t, t.TempDir()), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, groupMessage(1, 10, 1))
+	push(t, q, groupMessage(1, 10, 2))
+	push(t, q, groupMessage(1, 11, 3))
+
+	first := pop(t, q)
+	if first.Message.MessageId != 1 {
+		t.Fatalf("first = %d, want 1", first.Message.MessageId)
+	}
+	// 同一个用户的第二条消息要等第一条处理完，同群其他用户的消息可以先处理
+	second := pop(t, q)
+	if second.Message.MessageId != 3 {
+		t.Fatalf("second = %d, want 3", second.Message.MessageId)
+	}
+
+	q.Done(first)
+	third := pop(t, q)
+	if third.Message.MessageId != 2 {
+		t.Fatalf("third = %d, want 2", third.Message.MessageId)
+	}
+}
+
+func TestPushPosition(t *testing.T) {
+	tests := []struct {
+		name string
+		// 正在处理的会话
+		running []messageenvelope.MessageEnvelope
+		// 已经在排队的消息
+		pending []messageenvelope.MessageEnvelope
+		idle    int
+		push    messageenvelope.MessageEnvelope
+		want    int
+	}{
+		{
+			name: "idle worker",
+			idle: 1,
+			push: privateMessage(10, 1),
+			want: 0,
+		},
+		{
+			name: "no idle worker",
+			push: privateMessage(10, 1),
+			want: 1,
+		},
+		{
+			name:    "own conversation is busy",
+			running: []messageenvelope.MessageEnvelope{groupMessage(1, 10, 1)},
+			idle:    1,
+			push:    groupMessage(1, 10, 2),
+			want:    1,
+		},
+		{
+			name:    "tasks blocked behind another busy conversation do not take workers",
+			running: []messageenvelope.MessageEnvelope{groupMessage(1, 10, 1)},
+			pending: []messageenvelope.MessageEnvelope{groupMessage(1, 10, 2), groupMessage(1, 10, 3), groupMessage(1, 10, 4)},
+			idle:    1,
+			push:    groupMessage(1, 11, 5),
+			want:    0,
+		},
+		{
+			name:    "behind own conversation and other waiting tasks",
+			running: []messageenvelope.MessageEnvelope{groupMessage(1, 10, 1)},
+			pending: []messageenvelope.MessageEnvelope{privateMessage(20, 2), groupMessage(1, 10, 3)},
+			push:    groupMessage(1, 10, 4),
+			want:    3,
+		},
+		{
+			name:    "idle worker takes an earlier task",
+			pending: []messageenvelope.MessageEnvelope{privateMessage(20, 1), privateMessage(21, 2)},
+			idle:    1,
+			push:    privateMessage(22, 3),
+			want:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQueue(openDB(t, t.TempDir()), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range tt.running {
+				q.busy[Task{Message: m}.conversation()] = true
+			}
+			for _, m := range tt.pending {
+				push(t, q, m)
+			}
+			// 直接设置空闲的 worker 数，不启动真正的 Pop
+			q.idle = tt.idle
+			if got := push(t, q, tt.push); got != tt.want {
+				t.Errorf("position = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushFull(t *testing.T) {
+	q, err := NewQueue(openDB(t, t.TempDir()), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, privateMessage(10, 1))
+	push(t, q, privateMessage(11, 2))
+	if _, err := q.Push(privateMessage(12, 3)); !errors.Is(err, ErrFull) {
+		t.Fatalf("push = %v, want ErrFull", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	q, err := NewQueue(openDB(t, t.TempDir()), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, groupMessage(1, 10, 1))
+	push(t, q, groupMessage(1, 11, 2))
+
+	if q.Remove("group/2", 1) {
+		t.Errorf("removed message from another group")
+	}
+	if !q.Remove("group/1", 1) {
+		t.Fatalf("failed to remove message")
+	}
+	if got := pop(t, q); got.Message.MessageId != 2 {
+		t.Errorf("pop = %d, want 2", got.Message.MessageId)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	q, err := NewQueue(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, privateMessage(10, 1))
+	push(t, q, privateMessage(11, 2))
+	push(t, q, privateMessage(12, 3))
+	q.Done(pop(t, q))
+	db.Close()
+
+	db = openDB(t, dir)
+	defer db.Close()
+	q, err = NewQueue(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Pending != 2 {
+		t.Fatalf("pending = %d, want 2", stats.Pending)
+	}
+	for _, want := range []int32{2, 3} {
+		task := pop(t, q)
+		if task.Message.MessageId != want {
+			t.Errorf("pop = %d, want %d", task.Message.MessageId, want)
+		}
+		q.Done(task)
+	}
+	// 恢复后新消息的序号要接在后面
+	push(t, q, privateMessage(13, 4))
+	if task := pop(t, q); task.Message.MessageId != 4 {
+		t.Errorf("pop = %d, want 4", task.Message.MessageId)
+	}
+}